@@ -5,6 +5,7 @@ import (
 	"net/http"
 
 	"github.com/lyttonliao/StratCheck/internal/data"
+	"github.com/lyttonliao/StratCheck/internal/jsonlog"
 )
 
 type contextKey string
@@ -12,9 +13,57 @@ type contextKey string
 // Convert the string "user" to a contextKey type and assign it to a constant
 const userContextKey = contextKey("user")
 
+const requestInfoContextKey = contextKey("request_info")
+
+const loggerContextKey = contextKey("logger")
+
+// requestInfo is shared by pointer through the request's context, so details found further down
+// the middleware chain, like the authenticated user, are visible to the access log
+type requestInfo struct {
+	id     string
+	userID int64
+}
+
+func (app *application) contextSetRequestInfo(r *http.Request, info *requestInfo) *http.Request {
+	ctx := context.WithValue(r.Context(), requestInfoContextKey, info)
+	return r.WithContext(ctx)
+}
+
+// contextGetRequestID() returns the ID the requestID() middleware assigned to the request, or an
+// empty string for requests that didn't pass through it
+func (app *application) contextGetRequestID(r *http.Request) string {
+	info, ok := r.Context().Value(requestInfoContextKey).(*requestInfo)
+	if !ok {
+		return ""
+	}
+
+	return info.id
+}
+
+// contextWithLogger() binds a child logger to the context, such as one carrying the request ID or
+// the name of the job
+func contextWithLogger(ctx context.Context, logger *jsonlog.Logger) context.Context {
+	return context.WithValue(ctx, loggerContextKey, logger)
+}
+
+// contextLogger() returns the logger bound to the context, or the application's logger if there
+// isn't one
+func (app *application) contextLogger(ctx context.Context) *jsonlog.Logger {
+	logger, ok := ctx.Value(loggerContextKey).(*jsonlog.Logger)
+	if !ok {
+		return app.logger
+	}
+
+	return logger
+}
+
 // Returns a new copy of the request with the provided User struct added to the context
 // 'userContextKey' constant is the key
 func (app *application) contextSetUser(r *http.Request, user *data.User) *http.Request {
+	if info, ok := r.Context().Value(requestInfoContextKey).(*requestInfo); ok {
+		info.userID = user.ID
+	}
+
 	ctx := context.WithValue(r.Context(), userContextKey, user)
 	return r.WithContext(ctx)
 }
@@ -1,20 +1,41 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"net/http"
+
+	"github.com/lyttonliao/StratCheck/internal/data"
+	"github.com/lyttonliao/StratCheck/internal/jsonlog"
+	"github.com/lyttonliao/StratCheck/internal/tracing"
 )
 
+// requestLogger() returns the logger requestID() bound to the request, which adds its ID, method
+// and URL to every entry
+func (app *application) requestLogger(r *http.Request) *jsonlog.Logger {
+	logger := app.contextLogger(r.Context())
+
+	// The trace ID links the entry to the request's spans. The span starts after requestID() runs,
+	// so it's added here
+	if sc := tracing.SpanFromContext(r.Context()).SpanContext(); sc.IsValid() {
+		return logger.With(jsonlog.Properties{"trace_id": sc.TraceID.String()})
+	}
+
+	return logger
+}
+
 func (app *application) logError(r *http.Request, err error) {
-	app.logger.PrintError(err, map[string]string{
-		"request_method": r.Method,
-		"request_url":    r.URL.String(),
-	})
+	app.requestLogger(r).PrintError(err, nil)
 }
 
 func (app *application) errorResponse(w http.ResponseWriter, r *http.Request, status int, message interface{}) {
 	env := envelope{"error": message}
 
+	// The request ID lets users quote a failed request when reporting a problem
+	if id := app.contextGetRequestID(r); id != "" {
+		env["request_id"] = id
+	}
+
 	err := app.writeJSON(w, status, env, nil)
 	if err != nil {
 		app.logError(r, err)
@@ -22,7 +43,15 @@ func (app *application) errorResponse(w http.ResponseWriter, r *http.Request, st
 	}
 }
 
+// serverErrorResponse() is the fallback for unexpected errors. A transaction worth retrying is
+// answered with a 503 instead of a 500. Constraint violations are only expected by some handlers,
+// which map them to a response themselves, so any others are logged here like other errors
 func (app *application) serverErrorResponse(w http.ResponseWriter, r *http.Request, err error) {
+	if errors.Is(err, data.ErrSerializationFailure) || errors.Is(err, data.ErrQueryCanceled) {
+		app.serviceUnavailableResponse(w, r, err)
+		return
+	}
+
 	app.logError(r, err)
 
 	message := "the server encountered a problem and could not process your request"
@@ -47,6 +76,17 @@ func (app *application) failedValidationResponse(w http.ResponseWriter, r *http.
 	app.errorResponse(w, r, http.StatusUnprocessableEntity, errors)
 }
 
+// serviceUnavailableResponse() is sent when the database gave up on a query or transaction that
+// should succeed if tried again
+func (app *application) serviceUnavailableResponse(w http.ResponseWriter, r *http.Request, err error) {
+	app.logError(r, err)
+
+	w.Header().Set("Retry-After", "1")
+
+	message := "the server is temporarily unable to handle your request, please try again"
+	app.errorResponse(w, r, http.StatusServiceUnavailable, message)
+}
+
 func (app *application) editConflictResponse(w http.ResponseWriter, r *http.Request) {
 	message := "unable to update the record due to an edit conflict, please try again"
 	app.errorResponse(w, r, http.StatusConflict, message)
@@ -57,6 +97,16 @@ func (app *application) rateLimitExceededResponse(w http.ResponseWriter, r *http
 	app.errorResponse(w, r, http.StatusTooManyRequests, message)
 }
 
+func (app *application) tooManyRunsResponse(w http.ResponseWriter, r *http.Request) {
+	message := "you have reached your plan's limit of concurrent backtests, please wait for one to finish"
+	app.errorResponse(w, r, http.StatusTooManyRequests, message)
+}
+
+func (app *application) quotaExceededResponse(w http.ResponseWriter, r *http.Request) {
+	message := "you have used your plan's backtesting quota for this month"
+	app.errorResponse(w, r, http.StatusPaymentRequired, message)
+}
+
 func (app *application) invalidCredentialsResponse(w http.ResponseWriter, r *http.Request) {
 	message := "invalid authentication credentials"
 	app.errorResponse(w, r, http.StatusUnauthorized, message)
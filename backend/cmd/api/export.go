@@ -0,0 +1,111 @@
+package main
+
+import (
+	"archive/zip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// exportCurrentUserHandler() streams a zip archive holding everything we store about the user.
+// Backtests are kept by the Backtrader service, so their history is requested from it using the
+// same jwt cookie forwardRequestHandler() relies on
+func (app *application) exportCurrentUserHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.contextGetUser(r)
+
+	strategies, err := app.models.Strategies.GetAllForUser(r.Context(), user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	folders, err := app.models.Folders.GetAllForUser(r.Context(), user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	cookie, err := r.Cookie("jwt")
+	if err != nil {
+		app.invalidAuthenticationTokenResponse(w, r)
+		return
+	}
+
+	backtests, err := app.fetchBacktestHistory(r.Context(), cookie.Value, app.contextGetRequestID(r))
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	files := []struct {
+		name    string
+		content interface{}
+	}{
+		{"profile.json", envelope{"user": user}},
+		{"strategies.json", envelope{"strategies": strategies}},
+		{"folders.json", envelope{"folders": folders}},
+		{"backtests.json", envelope{"backtests": backtests}},
+	}
+
+	filename := fmt.Sprintf("stratcheck-export-%d-%s.zip", user.ID, time.Now().UTC().Format("20060102"))
+
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filename))
+	w.WriteHeader(http.StatusOK)
+
+	// The status has been sent, so from here on errors can only be logged
+	archive := zip.NewWriter(w)
+
+	for _, file := range files {
+		f, err := archive.Create(file.name)
+		if err != nil {
+			app.logError(r, err)
+			return
+		}
+
+		enc := json.NewEncoder(f)
+		enc.SetIndent("", "\t")
+
+		err = enc.Encode(file.content)
+		if err != nil {
+			app.logError(r, err)
+			return
+		}
+	}
+
+	err = archive.Close()
+	if err != nil {
+		app.logError(r, err)
+	}
+}
+
+func (app *application) fetchBacktestHistory(ctx context.Context, jwt, requestID string) (interface{}, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, app.config.backtest.url+"/v1/backtests", nil)
+	if err != nil {
+		return nil, err
+	}
+
+	req.Header.Set("Authorization", "Bearer "+jwt)
+	req.Header.Set("X-Request-ID", requestID)
+
+	client := &http.Client{Timeout: 10 * time.Second}
+	res, err := app.doUpstream("backtest_history", client, req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("backtest history request returned %s", res.Status)
+	}
+
+	var payload interface{}
+	err = json.NewDecoder(res.Body).Decode(&payload)
+	if err != nil {
+		return nil, err
+	}
+
+	return payload, nil
+}
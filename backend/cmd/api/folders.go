@@ -0,0 +1,220 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/lyttonliao/StratCheck/internal/data"
+	"github.com/lyttonliao/StratCheck/internal/validator"
+)
+
+func (app *application) createFolderHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Name     string `json:"name"`
+		ParentID *int64 `json:"parent_id"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	user := app.contextGetUser(r)
+
+	folder := &data.Folder{
+		UserID:   user.ID,
+		ParentID: input.ParentID,
+		Name:     input.Name,
+	}
+
+	v := validator.New()
+	if data.ValidateFolder(v, folder); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	if !app.checkFolderParent(w, r, folder, v) {
+		return
+	}
+
+	err = app.models.Folders.Insert(r.Context(), folder)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrDuplicateFolder):
+			v.AddError("name", "a folder with this name already exists here")
+			app.failedValidationResponse(w, r, v.Errors)
+		case errors.Is(err, data.ErrForeignKeyViolation):
+			// The parent was deleted after it was checked
+			v.AddError("parent_id", "must be one of your folders")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	headers := make(http.Header)
+	headers.Set("Location", fmt.Sprintf("/v1/folders/%d", folder.ID))
+
+	err = app.writeJSON(w, http.StatusCreated, envelope{"folder": folder}, headers)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) listFoldersHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.contextGetUser(r)
+
+	folders, err := app.models.Folders.GetAllForUser(r.Context(), user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"folders": folders}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// updateFolderHandler() renames a folder or moves it under another parent. A parent_id of 0 moves
+// it to the top level
+func (app *application) updateFolderHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	user := app.contextGetUser(r)
+
+	folder, err := app.models.Folders.Get(r.Context(), user.ID, id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	if r.Header.Get("X-Expected-Version") != "" {
+		if strconv.FormatInt(int64(folder.Version), 10) != r.Header.Get("X-Expected-Version") {
+			app.editConflictResponse(w, r)
+			return
+		}
+	}
+
+	var input struct {
+		Name     *string `json:"name"`
+		ParentID *int64  `json:"parent_id"`
+	}
+
+	err = app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	if input.Name != nil {
+		folder.Name = *input.Name
+	}
+	if input.ParentID != nil {
+		folder.ParentID = input.ParentID
+		if *input.ParentID == 0 {
+			folder.ParentID = nil
+		}
+	}
+
+	v := validator.New()
+	if data.ValidateFolder(v, folder); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	if !app.checkFolderParent(w, r, folder, v) {
+		return
+	}
+
+	// The cycle check and the update share a transaction so the folders stay locked in between
+	err = app.models.WithTx(r.Context(), func(tx data.Models) error {
+		return tx.Folders.Update(r.Context(), folder)
+	})
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrFolderCycle):
+			v.AddError("parent_id", "must not be the folder itself or one of its subfolders")
+			app.failedValidationResponse(w, r, v.Errors)
+		case errors.Is(err, data.ErrDuplicateFolder):
+			v.AddError("name", "a folder with this name already exists here")
+			app.failedValidationResponse(w, r, v.Errors)
+		case errors.Is(err, data.ErrForeignKeyViolation):
+			v.AddError("parent_id", "must be one of your folders")
+			app.failedValidationResponse(w, r, v.Errors)
+		case errors.Is(err, data.ErrEditConflict):
+			app.editConflictResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"folder": folder}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) deleteFolderHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	user := app.contextGetUser(r)
+
+	err = app.models.Folders.Delete(r.Context(), user.ID, id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	message := "folder successfully deleted, its strategies have moved to the top level"
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"message": message}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// checkFolderParent() makes sure a folder's parent belongs to the same user, since the foreign key
+// only checks that it exists. If it doesn't an error response has been sent and ok is false
+func (app *application) checkFolderParent(w http.ResponseWriter, r *http.Request, folder *data.Folder, v *validator.Validator) bool {
+	if folder.ParentID == nil {
+		return true
+	}
+
+	_, err := app.models.Folders.Get(r.Context(), folder.UserID, *folder.ParentID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			v.AddError("parent_id", "must be one of your folders")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return false
+	}
+
+	return true
+}
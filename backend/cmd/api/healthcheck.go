@@ -1,7 +1,13 @@
 package main
 
 import (
+	"context"
+	"fmt"
 	"net/http"
+	"sync"
+	"time"
+
+	"github.com/lyttonliao/StratCheck/internal/jsonlog"
 )
 
 func (app *application) healthcheckHandler(w http.ResponseWriter, r *http.Request) {
@@ -18,3 +24,240 @@ func (app *application) healthcheckHandler(w http.ResponseWriter, r *http.Reques
 		app.serverErrorResponse(w, r, err)
 	}
 }
+
+// livenessHandler() only shows the process is serving requests. It deliberately checks no
+// dependencies, so an outage elsewhere doesn't get every instance restarted
+func (app *application) livenessHandler(w http.ResponseWriter, r *http.Request) {
+	err := app.writeJSON(w, http.StatusOK, envelope{"status": "alive", "version": version}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// dependencyCheck probes one dependency. A failing critical dependency makes the instance
+// unavailable, while a failing non-critical one only marks it as degraded
+type dependencyCheck struct {
+	name     string
+	critical bool
+	check    func(ctx context.Context) (envelope, error)
+}
+
+type checkResult struct {
+	Status    string   `json:"status"`
+	Critical  bool     `json:"critical"`
+	LatencyMS float64  `json:"latency_ms"`
+	Error     string   `json:"error,omitempty"`
+	Details   envelope `json:"details,omitempty"`
+}
+
+// readiness holds the outcome of the last run of the dependency checks. Load balancers probe
+// often, so the checks are only run again once the results are older than the cache TTL
+type readiness struct {
+	mu        sync.Mutex
+	checkedAt time.Time
+	status    string
+	code      int
+	results   map[string]checkResult
+}
+
+// readinessHandler() responds with 503 Service Unavailable if a critical dependency is down, so
+// the load balancer stops sending traffic here. Only whether each dependency is up is shown,
+// the details are at /v1/admin/health
+func (app *application) readinessHandler(w http.ResponseWriter, r *http.Request) {
+	status, code, results := app.checkReadiness(r.Context())
+
+	checks := make(map[string]string, len(results))
+	for name, result := range results {
+		checks[name] = result.Status
+	}
+
+	err := app.writeJSON(w, code, envelope{"status": status, "checks": checks}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// showHealthDetailsHandler() shows admins the latency, details and error of each check
+func (app *application) showHealthDetailsHandler(w http.ResponseWriter, r *http.Request) {
+	status, _, results := app.checkReadiness(r.Context())
+
+	err := app.writeJSON(w, http.StatusOK, envelope{"status": status, "checks": results}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// checkReadiness() returns the cached results, or runs every dependency check concurrently when
+// they have expired. Requests arriving during a run wait for it rather than starting their own
+func (app *application) checkReadiness(ctx context.Context) (string, int, map[string]checkResult) {
+	app.readiness.mu.Lock()
+	defer app.readiness.mu.Unlock()
+
+	if app.readiness.results != nil && time.Since(app.readiness.checkedAt) < app.config.health.cacheTTL {
+		return app.readiness.status, app.readiness.code, app.readiness.results
+	}
+
+	// The results are shared, so a client hanging up mustn't cut the checks short
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), app.config.health.timeout)
+	defer cancel()
+
+	checks := app.dependencyChecks()
+
+	var (
+		mu      sync.Mutex
+		wg      sync.WaitGroup
+		results = make(map[string]checkResult, len(checks))
+	)
+
+	for _, c := range checks {
+		wg.Add(1)
+
+		go func(c dependencyCheck) {
+			defer wg.Done()
+
+			result := runCheck(ctx, c)
+
+			mu.Lock()
+			results[c.name] = result
+			mu.Unlock()
+		}(c)
+	}
+
+	wg.Wait()
+
+	status, code := "ready", http.StatusOK
+
+	for name, result := range results {
+		if result.Status == "up" {
+			continue
+		}
+
+		app.contextLogger(ctx).PrintWarn("readiness check failed", jsonlog.Properties{
+			"check":    name,
+			"critical": result.Critical,
+			"error":    result.Error,
+		})
+
+		if result.Critical {
+			status, code = "unavailable", http.StatusServiceUnavailable
+		} else if code == http.StatusOK {
+			status = "degraded"
+		}
+	}
+
+	app.readiness.checkedAt = time.Now()
+	app.readiness.status, app.readiness.code, app.readiness.results = status, code, results
+
+	return status, code, results
+}
+
+// runCheck() times a check, giving up when ctx is done even if the check itself can't be cancelled
+func runCheck(ctx context.Context, c dependencyCheck) checkResult {
+	type outcome struct {
+		details envelope
+		err     error
+	}
+
+	done := make(chan outcome, 1)
+	start := time.Now()
+
+	go func() {
+		details, err := c.check(ctx)
+		done <- outcome{details, err}
+	}()
+
+	var o outcome
+
+	select {
+	case o = <-done:
+	case <-ctx.Done():
+		o.err = ctx.Err()
+	}
+
+	result := checkResult{
+		Status:    "up",
+		Critical:  c.critical,
+		LatencyMS: float64(time.Since(start).Microseconds()) / 1000,
+		Details:   o.details,
+	}
+
+	if o.err != nil {
+		result.Status = "down"
+		result.Error = o.err.Error()
+	}
+
+	return result
+}
+
+func (app *application) dependencyChecks() []dependencyCheck {
+	return []dependencyCheck{
+		{
+			name:     "database",
+			critical: true,
+			check: func(ctx context.Context) (envelope, error) {
+				return nil, app.models.Ping(ctx)
+			},
+		},
+		{
+			name:     "backtest",
+			critical: true,
+			check:    app.checkBacktestService,
+		},
+		{
+			name: "mailer",
+			check: func(ctx context.Context) (envelope, error) {
+				return envelope{"transport": app.config.mail.transport}, app.mailer.Check()
+			},
+		},
+		{
+			name: "email_outbox",
+			check: func(ctx context.Context) (envelope, error) {
+				return app.checkBacklog(ctx, app.models.EmailOutbox.Backlog)
+			},
+		},
+		{
+			name: "webhook_deliveries",
+			check: func(ctx context.Context) (envelope, error) {
+				return app.checkBacklog(ctx, app.models.WebhookDeliveries.Backlog)
+			},
+		},
+	}
+}
+
+// checkBacktestService() treats any response below 500 as the service being up, since it's the
+// connection and the service's own health that matter here, not the route
+func (app *application) checkBacktestService(ctx context.Context) (envelope, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, app.config.backtest.url, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode >= 500 {
+		return envelope{"status_code": res.StatusCode}, fmt.Errorf("backtest service returned %s", res.Status)
+	}
+
+	return envelope{"status_code": res.StatusCode}, nil
+}
+
+// checkBacklog() fails when the oldest due job has waited longer than allowed, meaning its worker
+// has stopped or can't keep up
+func (app *application) checkBacklog(ctx context.Context, backlog func(context.Context) (int, time.Duration, error)) (envelope, error) {
+	count, oldest, err := backlog(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	details := envelope{"pending": count, "oldest_seconds": int(oldest.Seconds())}
+
+	if oldest > app.config.health.maxBacklogAge {
+		return details, fmt.Errorf("oldest pending job has waited %s", oldest.Round(time.Second))
+	}
+
+	return details, nil
+}
@@ -1,18 +1,24 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
+	"math"
 	"net/http"
 	"net/url"
 	"os"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/julienschmidt/httprouter"
 
+	"github.com/lyttonliao/StratCheck/internal/data"
+	"github.com/lyttonliao/StratCheck/internal/jsonlog"
+	"github.com/lyttonliao/StratCheck/internal/tracing"
 	"github.com/lyttonliao/StratCheck/internal/validator"
 )
 
@@ -131,7 +137,7 @@ func (app *application) readCSV(qs url.Values, key string, defaultValue []string
 		return defaultValue
 	}
 
-	return strings.Split(csv, ",")
+	return splitCSV(csv)
 }
 
 func (app *application) readInt(qs url.Values, key string, defaultValue int, v *validator.Validator) int {
@@ -150,6 +156,134 @@ func (app *application) readInt(qs url.Values, key string, defaultValue int, v *
 	return i
 }
 
+// readOperators() reads the query string parameters filtering a column, which take the form
+// column[operator]=value. A bare column=value uses defaultOperator, or is rejected if that's empty.
+// The values are returned keyed by operator
+func (app *application) readOperators(qs url.Values, column string, defaultOperator string, operators []string, v *validator.Validator) map[string]string {
+	values := make(map[string]string)
+
+	for key := range qs {
+		var op string
+
+		switch {
+		case key == column:
+			op = defaultOperator
+		case strings.HasPrefix(key, column+"[") && strings.HasSuffix(key, "]"):
+			op = strings.TrimSuffix(strings.TrimPrefix(key, column+"["), "]")
+		default:
+			continue
+		}
+
+		if !validator.In(op, operators...) {
+			v.AddError(key, "unsupported filter operator")
+			continue
+		}
+
+		values[op] = qs.Get(key)
+	}
+
+	return values
+}
+
+// splitCSV() splits a comma-separated query string value, returning an empty slice for an empty
+// value
+func splitCSV(s string) []string {
+	if s == "" {
+		return []string{}
+	}
+
+	return strings.Split(s, ",")
+}
+
+// parseTimeOrDate() parses an RFC 3339 timestamp, or a date taken as midnight UTC
+func parseTimeOrDate(s string) (time.Time, error) {
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		return time.Parse(time.DateOnly, s)
+	}
+
+	return t, nil
+}
+
+func (app *application) readBool(qs url.Values, key string, defaultValue bool, v *validator.Validator) bool {
+	s := qs.Get(key)
+
+	if s == "" {
+		return defaultValue
+	}
+
+	b, err := strconv.ParseBool(s)
+	if err != nil {
+		v.AddError(key, "must be a boolean value")
+		return defaultValue
+	}
+
+	return b
+}
+
+// readCursor() decodes a pagination cursor issued by setCursorLinks(), returning nil if there is
+// none
+func (app *application) readCursor(qs url.Values, key string, v *validator.Validator) *data.Cursor {
+	s := qs.Get(key)
+
+	if s == "" {
+		return nil
+	}
+
+	cursor, err := data.DecodeCursor(s, app.cursorKey)
+	if err != nil {
+		v.AddError(key, "is invalid")
+		return nil
+	}
+
+	return cursor
+}
+
+// setCursorLinks() signs the cursors either side of a page of results and adds links to those
+// pages, made from the request's URL with the page swapped for the cursor
+func (app *application) setCursorLinks(r *http.Request, metadata *data.Metadata) {
+	link := func(cursor *data.Cursor) (string, string) {
+		encoded := cursor.Encode(app.cursorKey)
+
+		qs := r.URL.Query()
+		qs.Del("page")
+		qs.Set("cursor", encoded)
+
+		return encoded, r.URL.Path + "?" + qs.Encode()
+	}
+
+	if metadata.Next != nil {
+		metadata.NextCursor, metadata.NextLink = link(metadata.Next)
+	}
+
+	if metadata.Prev != nil {
+		metadata.PrevCursor, metadata.PrevLink = link(metadata.Prev)
+	}
+}
+
+// readLanguage() returns the first language in the Accept-Language header if it is a valid
+// language code, or an empty string otherwise. Quality values are ignored
+func (app *application) readLanguage(r *http.Request) string {
+	header := r.Header.Get("Accept-Language")
+
+	first, _, _ := strings.Cut(header, ",")
+	first, _, _ = strings.Cut(first, ";")
+	first = strings.TrimSpace(first)
+
+	// Normalize "fr-ca" to "fr-CA" to match data.LanguageRX
+	if language, region, found := strings.Cut(first, "-"); found {
+		first = strings.ToLower(language) + "-" + strings.ToUpper(region)
+	} else {
+		first = strings.ToLower(first)
+	}
+
+	if !validator.Matches(first, data.LanguageRX) {
+		return ""
+	}
+
+	return first
+}
+
 func (app *application) readFile(filename string) ([]byte, error) {
 	data, err := os.ReadFile(filename)
 	if err != nil {
@@ -168,10 +302,67 @@ func (app *application) background(fn func()) {
 
 		defer func() {
 			if err := recover(); err != nil {
-				app.logger.PrintError(fmt.Errorf("%s", err), nil)
+				app.logger.PrintErrorTrace(fmt.Errorf("%s", err), nil)
 			}
 		}()
+
+		fn()
+	}()
+}
+
+// The schedule() helper runs fn every interval until the server shuts down. The job is tracked by
+// the same WaitGroup as background(), so shutdown waits for a run in progress to complete
+func (app *application) schedule(name string, interval time.Duration, fn func(ctx context.Context) error) {
+	app.wg.Add(1)
+
+	go func() {
+		defer app.wg.Done()
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-app.shutdown:
+				return
+			case <-ticker.C:
+				app.runJob(name, fn)
+			}
+		}
 	}()
+}
+
+// runJob() recovers panics so one failed run doesn't stop the job from being scheduled again. Each
+// run is traced as its own root span, which the job's queries are recorded under
+// The job's name is bound to the logger in ctx, which the job should log with
+func (app *application) runJob(name string, fn func(ctx context.Context) error) {
+	ctx, span := tracing.Start(context.Background(), "job "+name, tracing.KindInternal)
+	defer span.End()
+
+	logger := app.logger.With(jsonlog.Properties{"job": name})
+	ctx = contextWithLogger(ctx, logger)
+
+	defer func() {
+		if err := recover(); err != nil {
+			span.SetError(fmt.Errorf("%s", err))
+			logger.PrintErrorTrace(fmt.Errorf("%s", err), nil)
+		}
+	}()
+
+	err := fn(ctx)
+	span.SetError(err)
+	if err != nil {
+		logger.PrintError(err, nil)
+	}
+}
+
+// retryBackoff() returns the delay before the next attempt of a failed background delivery,
+// doubling from 30 seconds up to 6 hours
+func retryBackoff(attempts int) time.Duration {
+	delay := 30 * time.Second * time.Duration(math.Pow(2, float64(attempts-1)))
+	if delay <= 0 || delay > 6*time.Hour {
+		return 6 * time.Hour
+	}
 
-	fn()
+	return delay
 }
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"expvar"
+	"time"
+
+	"github.com/lyttonliao/StratCheck/internal/data"
+	"github.com/lyttonliao/StratCheck/internal/jsonlog"
+)
+
+// janitorStats is published at /debug/vars so cleanup activity can be monitored
+var janitorStats = expvar.NewMap("janitor")
+
+func (app *application) startJobs() {
+	app.schedule("purge_deleted_accounts", time.Hour, app.purgeDeletedAccounts)
+	app.schedule("janitor", app.config.janitor.interval, app.cleanup)
+	app.schedule("rate_limit_sweep", time.Minute, app.sweepRateLimits)
+	app.schedule("email_outbox", app.config.outbox.interval, app.deliverEmails)
+	app.schedule("webhook_deliveries", app.config.webhooks.interval, app.deliverWebhooks)
+	app.schedule("notification_digest", app.config.notifications.digestInterval, app.sendNotificationDigests)
+}
+
+// cleanup() deletes expired tokens of every scope and, if configured, accounts that were never
+// activated within the allowed time. Backtests that never reported back are expired so they stop holding a concurrent run slot
+func (app *application) cleanup(ctx context.Context) error {
+	tokens, err := app.models.Tokens.DeleteExpired(ctx)
+	if err != nil {
+		return err
+	}
+
+	var users int64
+
+	if app.config.janitor.unactivatedTTL > 0 {
+		users, err = app.models.Users.DeleteUnactivatedBefore(ctx, time.Now().Add(-app.config.janitor.unactivatedTTL))
+		if err != nil {
+			return err
+		}
+	}
+
+	expired, err := app.models.BacktestRuns.ExpireStartedBefore(ctx, time.Now().Add(-app.config.backtest.runTimeout))
+	if err != nil {
+		return err
+	}
+
+	janitorStats.Add("runs", 1)
+	janitorStats.Add("expired_tokens_deleted", tokens)
+	janitorStats.Add("unactivated_users_deleted", users)
+	janitorStats.Add("backtest_runs_expired", expired)
+
+	app.contextLogger(ctx).PrintInfo("janitor run completed", jsonlog.Properties{
+		"expired_tokens_deleted":    tokens,
+		"unactivated_users_deleted": users,
+		"backtest_runs_expired":     expired,
+	})
+
+	return nil
+}
+
+// idleDeleter is implemented by rate limiter stores which keep buckets until they're removed
+type idleDeleter interface {
+	DeleteIdle(ctx context.Context, before time.Time) (int64, error)
+}
+
+// sweepRateLimits() removes buckets once they would have refilled, otherwise a client could reset
+// a slow bucket such as registrations just by waiting for it to be removed
+func (app *application) sweepRateLimits(ctx context.Context) error {
+	limiter, ok := app.limiter.(idleDeleter)
+	if !ok {
+		return nil
+	}
+
+	idle := 3 * time.Minute
+	if refill := app.policies.MaxRefill(); refill > idle {
+		idle = refill
+	}
+
+	buckets, err := limiter.DeleteIdle(ctx, time.Now().Add(-idle))
+	if err != nil {
+		return err
+	}
+
+	janitorStats.Add("rate_limit_buckets_deleted", buckets)
+
+	return nil
+}
+
+// purgeDeletedAccounts() removes the data of every account whose deletion grace period has ended.
+// A failure for one user is logged and the rest are still purged
+func (app *application) purgeDeletedAccounts(ctx context.Context) error {
+	ids, err := app.models.Users.GetAllScheduledForDeletion(ctx, time.Now())
+	if err != nil {
+		return err
+	}
+
+	for _, id := range ids {
+		err = app.models.WithTx(ctx, func(tx data.Models) error {
+			return tx.Users.Purge(ctx, id)
+		})
+		if err != nil {
+			app.contextLogger(ctx).PrintError(err, jsonlog.Properties{
+				"user_id": id,
+			})
+			continue
+		}
+
+		app.contextLogger(ctx).PrintInfo("purged deleted account", jsonlog.Properties{
+			"user_id": id,
+		})
+	}
+
+	return nil
+}
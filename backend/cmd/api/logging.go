@@ -0,0 +1,53 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/lyttonliao/StratCheck/internal/jsonlog"
+	"github.com/lyttonliao/StratCheck/internal/validator"
+)
+
+func (app *application) showLogLevelHandler(w http.ResponseWriter, r *http.Request) {
+	err := app.writeJSON(w, http.StatusOK, envelope{"level": app.logger.Level().String()}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// updateLogLevelHandler() changes the minimum log level until the next restart, for turning on
+// debug logging while investigating a problem in production
+func (app *application) updateLogLevelHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Level string `json:"level"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	level, err := jsonlog.ParseLevel(input.Level)
+
+	v := validator.New()
+	v.Check(err == nil, "level", "must be one of debug, info, warn, error, fatal or off")
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	previous := app.logger.Level()
+	app.logger.SetLevel(level)
+
+	app.requestLogger(r).PrintWarn("log level changed", jsonlog.Properties{
+		"from":    previous.String(),
+		"to":      level.String(),
+		"user_id": app.contextGetUser(r).ID,
+	})
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"level": level.String()}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
@@ -2,10 +2,13 @@ package main
 
 import (
 	"context"
+	"crypto/rand"
 	"database/sql"
+	"errors"
 	"expvar"
 	"flag"
 	"fmt"
+	"net/http"
 	"os"
 	"runtime"
 	"strings"
@@ -13,8 +16,14 @@ import (
 	"time"
 
 	"github.com/lyttonliao/StratCheck/internal/data"
+	"github.com/lyttonliao/StratCheck/internal/egress"
 	"github.com/lyttonliao/StratCheck/internal/jsonlog"
 	"github.com/lyttonliao/StratCheck/internal/mailer"
+	"github.com/lyttonliao/StratCheck/internal/migrate"
+	"github.com/lyttonliao/StratCheck/internal/ratelimit"
+	"github.com/lyttonliao/StratCheck/internal/tracing"
+	"github.com/lyttonliao/StratCheck/internal/validator"
+	"github.com/lyttonliao/StratCheck/migrations"
 
 	// Alias this import to blank identifier to stop Go compiler from erroring
 
@@ -30,18 +39,30 @@ var (
 // For now, config settings will only have the network port that we want the server to listen on
 // and the name of the operation environment for the application (dev, staging, prod)
 type config struct {
-	port int
-	env  string
-	db   struct {
+	port    int
+	env     string
+	baseURL string
+	log     struct {
+		level    string
+		sampling jsonlog.Sampling
+	}
+	db struct {
 		dsn          string
 		maxOpenConns int
 		maxIdleConns int
 		maxIdleTime  string
 	}
 	limiter struct {
-		rps     float64
-		burst   int
-		enabled bool
+		rps      float64
+		burst    int
+		enabled  bool
+		store    string
+		policies string
+	}
+	mail struct {
+		transport    string
+		dir          string
+		templatesDir string
 	}
 	smtp struct {
 		host     string
@@ -53,6 +74,52 @@ type config struct {
 	cors struct {
 		trustedOrigins []string
 	}
+	password validator.PasswordPolicy
+	backtest struct {
+		url        string
+		runTimeout time.Duration
+	}
+	accounts struct {
+		deletionGrace time.Duration
+	}
+	events struct {
+		secret string
+	}
+	cursors struct {
+		secret string
+	}
+	jwt struct {
+		keyFile string
+	}
+	notifications struct {
+		digestInterval time.Duration
+	}
+	outbox struct {
+		interval    time.Duration
+		batchSize   int
+		maxAttempts int
+	}
+	webhooks struct {
+		interval     time.Duration
+		batchSize    int
+		maxAttempts  int
+		allowPrivate bool
+	}
+	tracing struct {
+		exporter    string
+		endpoint    string
+		serviceName string
+		sampleRatio float64
+	}
+	health struct {
+		timeout       time.Duration
+		cacheTTL      time.Duration
+		maxBacklogAge time.Duration
+	}
+	janitor struct {
+		interval       time.Duration
+		unactivatedTTL time.Duration
+	}
 }
 
 // Define application struct to hold dependencies for our HTTP handlers, helpers, middleware
@@ -61,7 +128,22 @@ type application struct {
 	logger *jsonlog.Logger
 	models data.Models
 	mailer mailer.Mailer
-	wg     sync.WaitGroup
+	// limiter holds the rate limiting buckets, either in memory or shared through Postgres
+	limiter ratelimit.Limiter
+	// policies are the rate limits of each route group and plan
+	policies *ratelimit.Policies
+	tracer   *tracing.Tracer
+	wg       sync.WaitGroup
+	// shutdown is closed once the server stops accepting requests, telling scheduled jobs to exit
+	shutdown chan struct{}
+	// cursorKey signs the pagination cursors handed out by list endpoints
+	cursorKey []byte
+	// egress checks the URLs users give for webhooks, and webhookClient only connects to the
+	// addresses it allows
+	egress        *egress.Guard
+	webhookClient *http.Client
+	// readiness caches the results of the readiness checks
+	readiness readiness
 }
 
 func main() {
@@ -77,11 +159,18 @@ func main() {
 	smtpUser := os.Getenv("SMTP_USER")
 	smtpPassword := os.Getenv("SMTP_PASSWORD")
 	trustedOrigins := os.Getenv("TRUSTED_ORIGINS")
+	eventsSecret := os.Getenv("EVENTS_SECRET")
+	cursorSecret := os.Getenv("CURSOR_SECRET")
 
 	var cfg config
 
 	flag.IntVar(&cfg.port, "port", 4000, "API server port")
 	flag.StringVar(&cfg.env, "env", "development", "Environment (development|staging|production)")
+	flag.StringVar(&cfg.baseURL, "base-url", "http://localhost:4000", "Public URL of the API, used in emailed links")
+	flag.StringVar(&cfg.log.level, "log-level", "info", "Minimum log level (debug|info|warn|error|fatal|off)")
+	flag.IntVar(&cfg.log.sampling.First, "log-sample-first", 0, "Identical log messages written per tick before sampling starts (0 disables sampling)")
+	flag.IntVar(&cfg.log.sampling.Thereafter, "log-sample-thereafter", 100, "Write every nth identical log message once sampling starts")
+	flag.DurationVar(&cfg.log.sampling.Tick, "log-sample-tick", time.Second, "Period over which identical log messages are counted")
 	flag.StringVar(&cfg.db.dsn, "db-dsn", dsn, "PostgreSQL DSN")
 	flag.IntVar(&cfg.db.maxOpenConns, "db-max-open-conns", 25, "PostgreSQL max open connections")
 	flag.IntVar(&cfg.db.maxIdleConns, "db-max-idle-conns", 25, "PostgreSQL max idle connections")
@@ -89,13 +178,50 @@ func main() {
 	flag.Float64Var(&cfg.limiter.rps, "limiter-rps", 2, "Rate limiter maximum requests per second")
 	flag.IntVar(&cfg.limiter.burst, "limiter-burst", 4, "Rate limiter maximum burst")
 	flag.BoolVar(&cfg.limiter.enabled, "limiter-enabled", true, "Enable rate limiter")
+	flag.StringVar(&cfg.limiter.store, "limiter-store", "memory", "Where rate limit buckets are kept (memory|postgres)")
+	flag.StringVar(&cfg.limiter.policies, "limiter-policies", "", "JSON file of rate limit policies per route group and plan")
+	flag.StringVar(&cfg.mail.transport, "mail-transport", "smtp", "Email transport (smtp|file|log)")
+	flag.StringVar(&cfg.mail.dir, "mail-dir", "./tmp/mail", "Maildir written to by the file email transport")
+	flag.StringVar(&cfg.mail.templatesDir, "mail-templates-dir", "", "Directory of email templates overriding the built-in ones")
 	flag.StringVar(&cfg.smtp.host, "smtp-host", smtpHost, "SMTP host")
 	flag.IntVar(&cfg.smtp.port, "smtp-port", 25, "SMTP port")
 	flag.StringVar(&cfg.smtp.username, "smtp-username", smtpUser, "SMTP username")
 	flag.StringVar(&cfg.smtp.password, "smtp-password", smtpPassword, "SMTP password")
 	flag.StringVar(&cfg.smtp.sender, "smtp-sender", "StratCheck <noreply@StratCheck.com>", "SMTP sender")
+	flag.IntVar(&cfg.password.MinLength, "password-min-length", 8, "Minimum password length")
+	flag.BoolVar(&cfg.password.RequireUpper, "password-require-upper", false, "Require an uppercase letter in passwords")
+	flag.BoolVar(&cfg.password.RequireLower, "password-require-lower", false, "Require a lowercase letter in passwords")
+	flag.BoolVar(&cfg.password.RequireDigit, "password-require-digit", false, "Require a digit in passwords")
+	flag.BoolVar(&cfg.password.RequireSymbol, "password-require-symbol", false, "Require a symbol in passwords")
+	flag.StringVar(&cfg.backtest.url, "backtest-url", "http://localhost:8000", "Backtrader service base URL")
+	flag.DurationVar(&cfg.backtest.runTimeout, "backtest-run-timeout", 6*time.Hour, "Time after which a backtest that never reported back stops counting against concurrent runs")
+	flag.DurationVar(&cfg.accounts.deletionGrace, "account-deletion-grace", 30*24*time.Hour, "Time before a deleted account is purged")
+	flag.StringVar(&cfg.events.secret, "events-secret", eventsSecret, "Shared secret the Backtrader service uses to post events")
+	flag.StringVar(&cfg.cursors.secret, "cursor-secret", cursorSecret, "Secret pagination cursors are signed with (required unless -env=development with the memory limiter store)")
+	flag.StringVar(&cfg.jwt.keyFile, "jwt-key-file", "C:/Users/xlord/.ssh/id_ecdsa", "PEM encoded EC private key the jwt cookie for the Backtrader service is signed with")
+	flag.DurationVar(&cfg.notifications.digestInterval, "notifications-digest-interval", 24*time.Hour, "Time between notification digest emails")
+	flag.DurationVar(&cfg.outbox.interval, "outbox-interval", 5*time.Second, "Time between email outbox delivery runs")
+	flag.IntVar(&cfg.outbox.batchSize, "outbox-batch-size", 20, "Maximum emails delivered per outbox run")
+	flag.IntVar(&cfg.outbox.maxAttempts, "outbox-max-attempts", 8, "Delivery attempts before an email is marked as failed")
+	flag.DurationVar(&cfg.webhooks.interval, "webhooks-interval", 5*time.Second, "Time between webhook delivery runs")
+	flag.IntVar(&cfg.webhooks.batchSize, "webhooks-batch-size", 20, "Maximum webhook deliveries sent per run")
+	flag.IntVar(&cfg.webhooks.maxAttempts, "webhooks-max-attempts", 8, "Delivery attempts before a webhook delivery is marked as failed")
+	flag.BoolVar(&cfg.webhooks.allowPrivate, "webhooks-allow-private", false, "Allow webhooks to private and loopback addresses (development only)")
+	flag.DurationVar(&cfg.janitor.interval, "janitor-interval", time.Hour, "Time between expired token and stale account cleanups")
+	flag.DurationVar(&cfg.janitor.unactivatedTTL, "janitor-unactivated-ttl", 30*24*time.Hour, "Age after which unactivated accounts are deleted (0 to keep them)")
+	flag.StringVar(&cfg.password.BreachedDir, "password-breached-dir", "", "Directory of SHA-1 prefix files of breached password hashes")
+
+	flag.StringVar(&cfg.tracing.exporter, "tracing-exporter", "none", "Tracing span exporter (none|stdout|otlp)")
+	flag.StringVar(&cfg.tracing.endpoint, "tracing-endpoint", "http://localhost:4318/v1/traces", "OTLP/HTTP endpoint spans are sent to")
+	flag.StringVar(&cfg.tracing.serviceName, "tracing-service-name", "stratcheck-api", "Service name reported with spans")
+	flag.Float64Var(&cfg.tracing.sampleRatio, "tracing-sample-ratio", 1, "Fraction of new traces that are recorded")
+
+	flag.DurationVar(&cfg.health.timeout, "health-timeout", 3*time.Second, "Time allowed for readiness checks")
+	flag.DurationVar(&cfg.health.cacheTTL, "health-cache-ttl", 5*time.Second, "Time readiness check results are reused for")
+	flag.DurationVar(&cfg.health.maxBacklogAge, "health-max-backlog-age", 15*time.Minute, "Age of the oldest due email or webhook delivery before readiness reports degraded")
 
 	displayVersion := flag.Bool("version", false, "Display version and exit")
+	migrateFirst := flag.Bool("migrate", false, "Apply pending database migrations before serving")
 
 	flag.Parse()
 
@@ -109,6 +235,14 @@ func main() {
 		os.Exit(0)
 	}
 
+	level, err := jsonlog.ParseLevel(cfg.log.level)
+	if err != nil {
+		logger.PrintFatal(err, nil)
+	}
+
+	logger.SetLevel(level)
+	logger.SetSampling(cfg.log.sampling)
+
 	db, err := openDB(cfg)
 	if err != nil {
 		logger.PrintFatal(err, nil)
@@ -118,6 +252,37 @@ func main() {
 
 	logger.PrintInfo("database connection pool established", nil)
 
+	migrator, err := migrate.New(db, migrations.FS)
+	if err != nil {
+		logger.PrintFatal(err, nil)
+	}
+
+	// Commands are given after the flags, e.g. `api -db-dsn=... migrate up`
+	if args := flag.Args(); len(args) > 0 {
+		if args[0] != "migrate" {
+			logger.PrintFatal(fmt.Errorf("unknown command %q", args[0]), nil)
+		}
+
+		err = runMigrateCommand(migrator, args[1:], logger)
+		if err != nil {
+			logger.PrintFatal(err, nil)
+		}
+
+		return
+	}
+
+	if *migrateFirst {
+		err = migrateOnStartup(migrator, logger)
+		if err != nil {
+			logger.PrintFatal(err, nil)
+		}
+	}
+
+	err = checkSchema(migrator, logger)
+	if err != nil {
+		logger.PrintFatal(err, nil)
+	}
+
 	expvar.NewString("version").Set(version)
 	expvar.Publish("goroutines", expvar.Func(func() interface{} {
 		return runtime.NumGoroutine()
@@ -129,11 +294,65 @@ func main() {
 		return time.Now().Unix()
 	}))
 
+	publishMetrics(db)
+
+	transport, err := newMailTransport(cfg, logger)
+	if err != nil {
+		logger.PrintFatal(err, nil)
+	}
+
+	mail, err := mailer.New(transport, cfg.smtp.sender, cfg.mail.templatesDir)
+	if err != nil {
+		logger.PrintFatal(err, nil)
+	}
+
+	tracer, err := newTracer(cfg, logger)
+	if err != nil {
+		logger.PrintFatal(err, nil)
+	}
+
+	if tracer != nil {
+		tracing.SetTracer(tracer)
+	}
+
+	policies := ratelimit.DefaultPolicies(cfg.limiter.rps, cfg.limiter.burst)
+	if cfg.limiter.policies != "" {
+		policies, err = ratelimit.LoadPolicies(cfg.limiter.policies, policies)
+		if err != nil {
+			logger.PrintFatal(err, nil)
+		}
+	}
+
+	limiter, err := newLimiter(cfg, db)
+	if err != nil {
+		logger.PrintFatal(err, nil)
+	}
+
+	cursorKey, err := newCursorKey(cfg, logger)
+	if err != nil {
+		logger.PrintFatal(err, nil)
+	}
+
+	// Webhooks must not be able to reach the Backtrader service or the API itself
+	guard := &egress.Guard{AllowPrivate: cfg.webhooks.allowPrivate}
+
+	err = guard.Deny(context.Background(), cfg.backtest.url, cfg.baseURL)
+	if err != nil {
+		logger.PrintFatal(err, nil)
+	}
+
 	app := &application{
-		config: cfg,
-		logger: logger,
-		models: data.NewModels(db),
-		mailer: mailer.New(cfg.smtp.host, cfg.smtp.port, cfg.smtp.username, cfg.smtp.password, cfg.smtp.sender),
+		config:        cfg,
+		logger:        logger,
+		models:        data.NewModels(db),
+		mailer:        mail,
+		limiter:       limiter,
+		policies:      policies,
+		tracer:        tracer,
+		shutdown:      make(chan struct{}),
+		cursorKey:     cursorKey,
+		egress:        guard,
+		webhookClient: guard.Client(10 * time.Second),
 	}
 
 	err = app.serve()
@@ -142,6 +361,54 @@ func main() {
 	}
 }
 
+func newMailTransport(cfg config, logger *jsonlog.Logger) (mailer.Transport, error) {
+	switch cfg.mail.transport {
+	case "smtp":
+		return mailer.NewSMTPTransport(cfg.smtp.host, cfg.smtp.port, cfg.smtp.username, cfg.smtp.password), nil
+	case "file":
+		return mailer.NewFileTransport(cfg.mail.dir)
+	case "log":
+		return mailer.NewLogTransport(logger), nil
+	default:
+		return nil, fmt.Errorf("unknown mail transport %q", cfg.mail.transport)
+	}
+}
+
+// newCursorKey() returns the key pagination cursors are signed with. A secret is required outside
+// of development, and whenever instances share rate limits through Postgres, since a random key
+// stops cursors working on restart and on every other instance
+func newCursorKey(cfg config, logger *jsonlog.Logger) ([]byte, error) {
+	if cfg.cursors.secret != "" {
+		return []byte(cfg.cursors.secret), nil
+	}
+
+	if cfg.env != "development" || cfg.limiter.store == "postgres" {
+		return nil, errors.New("a cursor secret must be set with -cursor-secret or CURSOR_SECRET")
+	}
+
+	key := make([]byte, 32)
+
+	_, err := rand.Read(key)
+	if err != nil {
+		return nil, err
+	}
+
+	logger.PrintWarn("no cursor secret configured, pagination cursors won't survive a restart", nil)
+
+	return key, nil
+}
+
+func newLimiter(cfg config, db *sql.DB) (ratelimit.Limiter, error) {
+	switch cfg.limiter.store {
+	case "memory":
+		return ratelimit.NewMemoryLimiter(), nil
+	case "postgres":
+		return ratelimit.NewPostgresLimiter(db), nil
+	default:
+		return nil, fmt.Errorf("unknown rate limiter store %q", cfg.limiter.store)
+	}
+}
+
 func openDB(cfg config) (*sql.DB, error) {
 	db, err := sql.Open("postgres", cfg.db.dsn)
 	if err != nil {
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"database/sql"
+	"net/http"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+
+	"github.com/lyttonliao/StratCheck/internal/metrics"
+	"github.com/lyttonliao/StratCheck/internal/tracing"
+)
+
+// registry is served at /metrics in the Prometheus text format. The expvar counters at
+// /debug/vars are still published for existing dashboards
+var registry = metrics.NewRegistry()
+
+var (
+	httpRequestsTotal = registry.NewCounterVec("http_requests_total",
+		"Total HTTP requests handled.", "route", "method", "status")
+	httpRequestDuration = registry.NewHistogramVec("http_request_duration_seconds",
+		"Time taken to handle HTTP requests.", metrics.DefaultBuckets, "route", "method", "status")
+	upstreamRequestDuration = registry.NewHistogramVec("upstream_request_duration_seconds",
+		"Time taken by requests to the Backtrader service.", metrics.DefaultBuckets, "operation", "method", "status")
+)
+
+// publishMetrics() registers the gauges read from the runtime and the database pool at scrape time
+func publishMetrics(db *sql.DB) {
+	registry.NewGaugeFunc("go_goroutines", "Number of goroutines that currently exist.", func() float64 {
+		return float64(runtime.NumGoroutine())
+	})
+
+	stat := func(fn func(s sql.DBStats) float64) func() float64 {
+		return func() float64 {
+			return fn(db.Stats())
+		}
+	}
+
+	registry.NewGaugeFunc("db_max_open_connections", "Maximum number of open connections to the database.",
+		stat(func(s sql.DBStats) float64 { return float64(s.MaxOpenConnections) }))
+	registry.NewGaugeFunc("db_open_connections", "Number of established connections, both in use and idle.",
+		stat(func(s sql.DBStats) float64 { return float64(s.OpenConnections) }))
+	registry.NewGaugeFunc("db_in_use_connections", "Number of connections currently in use.",
+		stat(func(s sql.DBStats) float64 { return float64(s.InUse) }))
+	registry.NewGaugeFunc("db_idle_connections", "Number of idle connections.",
+		stat(func(s sql.DBStats) float64 { return float64(s.Idle) }))
+	registry.NewCounterFunc("db_wait_count_total", "Total number of connections waited for.",
+		stat(func(s sql.DBStats) float64 { return float64(s.WaitCount) }))
+	registry.NewCounterFunc("db_wait_duration_seconds_total", "Total time blocked waiting for a new connection.",
+		stat(func(s sql.DBStats) float64 { return s.WaitDuration.Seconds() }))
+	registry.NewCounterFunc("db_max_idle_closed_total", "Total connections closed due to SetMaxIdleConns.",
+		stat(func(s sql.DBStats) float64 { return float64(s.MaxIdleClosed) }))
+	registry.NewCounterFunc("db_max_idle_time_closed_total", "Total connections closed due to SetConnMaxIdleTime.",
+		stat(func(s sql.DBStats) float64 { return float64(s.MaxIdleTimeClosed) }))
+	registry.NewCounterFunc("db_max_lifetime_closed_total", "Total connections closed due to SetConnMaxLifetime.",
+		stat(func(s sql.DBStats) float64 { return float64(s.MaxLifetimeClosed) }))
+}
+
+// routeTable is the router along with the pattern of every route registered on it, so requests
+// can be labelled with the route they matched, such as /v1/webhooks/:id, rather than every
+// distinct ID. httprouter doesn't report which pattern it matched
+type routeTable struct {
+	*httprouter.Router
+	patterns map[string][]string
+}
+
+func newRouteTable() *routeTable {
+	return &routeTable{Router: httprouter.New(), patterns: make(map[string][]string)}
+}
+
+func (rt *routeTable) Handler(method, path string, handler http.Handler) {
+	rt.patterns[method] = append(rt.patterns[method], path)
+	rt.Router.Handler(method, path, handler)
+}
+
+func (rt *routeTable) HandlerFunc(method, path string, handler http.HandlerFunc) {
+	rt.Handler(method, path, handler)
+}
+
+// pattern() returns the pattern of the route the request matches. httprouter refuses conflicting
+// routes, so only one registered pattern can match a path it routes. Unmatched requests share a
+// single label
+func (rt *routeTable) pattern(r *http.Request) string {
+	handle, _, _ := rt.Lookup(r.Method, r.URL.Path)
+	if handle == nil {
+		return "unmatched"
+	}
+
+	for _, pattern := range rt.patterns[r.Method] {
+		if matchPattern(pattern, r.URL.Path) {
+			return pattern
+		}
+	}
+
+	return "unmatched"
+}
+
+func matchPattern(pattern, path string) bool {
+	patternSegments := strings.Split(pattern, "/")
+	pathSegments := strings.Split(path, "/")
+
+	for i, segment := range patternSegments {
+		switch {
+		case strings.HasPrefix(segment, "*"):
+			return true
+		case i >= len(pathSegments):
+			return false
+		case strings.HasPrefix(segment, ":"):
+			if pathSegments[i] == "" {
+				return false
+			}
+		case segment != pathSegments[i]:
+			return false
+		}
+	}
+
+	return len(patternSegments) == len(pathSegments)
+}
+
+// knownMethods are labelled as they are, anything else is counted as "other" so clients can't
+// create a label for every method name they send
+var knownMethods = map[string]bool{
+	http.MethodGet:     true,
+	http.MethodHead:    true,
+	http.MethodPost:    true,
+	http.MethodPut:     true,
+	http.MethodPatch:   true,
+	http.MethodDelete:  true,
+	http.MethodOptions: true,
+}
+
+func methodLabel(method string) string {
+	if knownMethods[method] {
+		return method
+	}
+
+	return "other"
+}
+
+// doUpstream() sends a request to the Backtrader service inside a client span, passing the trace on
+// in the traceparent header and recording how long it took under the operation name
+func (app *application) doUpstream(operation string, client *http.Client, req *http.Request) (*http.Response, error) {
+	ctx, span := tracing.Start(req.Context(), "upstream "+operation, tracing.KindClient)
+	defer span.End()
+
+	req = req.WithContext(ctx)
+	tracing.Inject(ctx, req.Header)
+
+	span.SetAttribute("http.method", req.Method)
+	span.SetAttribute("http.url", req.URL.String())
+
+	start := time.Now()
+
+	res, err := client.Do(req)
+
+	status := "error"
+	if err == nil {
+		status = strconv.Itoa(res.StatusCode)
+		span.SetAttribute("http.status_code", res.StatusCode)
+	}
+	span.SetError(err)
+
+	upstreamRequestDuration.Observe(time.Since(start).Seconds(), operation, req.Method, status)
+
+	return res, err
+}
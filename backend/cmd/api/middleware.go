@@ -1,23 +1,96 @@
 package main
 
 import (
+	"crypto/rand"
+	"encoding/hex"
 	"errors"
 	"expvar"
 	"fmt"
+	"math"
 	"net/http"
 	"strconv"
 	"strings"
-	"sync"
 	"time"
 
 	"github.com/lyttonliao/StratCheck/internal/data"
+	"github.com/lyttonliao/StratCheck/internal/jsonlog"
+	"github.com/lyttonliao/StratCheck/internal/ratelimit"
+	"github.com/lyttonliao/StratCheck/internal/tracing"
 	"github.com/lyttonliao/StratCheck/internal/validator"
 
 	"github.com/felixge/httpsnoop"
 	"github.com/tomasen/realip"
-	"golang.org/x/time/rate"
 )
 
+// requestID() reuses the X-Request-ID sent by a trusted proxy or client, or generates a new one,
+// and echoes it on the response. IDs that are too long or contain odd characters are replaced so
+// they can't be used to inject content into logs
+func (app *application) requestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get("X-Request-ID")
+
+		if !validRequestID(id) {
+			randomBytes := make([]byte, 16)
+
+			_, err := rand.Read(randomBytes)
+			if err != nil {
+				app.serverErrorResponse(w, r, err)
+				return
+			}
+
+			id = hex.EncodeToString(randomBytes)
+		}
+
+		w.Header().Set("X-Request-ID", id)
+
+		r = app.contextSetRequestInfo(r, &requestInfo{id: id})
+
+		logger := app.logger.With(jsonlog.Properties{
+			"request_id":     id,
+			"request_method": r.Method,
+			"request_url":    r.URL.String(),
+		})
+		r = r.WithContext(contextWithLogger(r.Context(), logger))
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+func validRequestID(id string) bool {
+	if id == "" || len(id) > 128 {
+		return false
+	}
+
+	for _, c := range id {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || strings.ContainsRune("-_.:", c)) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// logRequest() writes one access log entry per request once the response has been sent. The user
+// ID is 0 for anonymous requests
+func (app *application) logRequest(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		metrics := httpsnoop.CaptureMetrics(next, w, r)
+
+		var userID int64
+		if info, ok := r.Context().Value(requestInfoContextKey).(*requestInfo); ok {
+			userID = info.userID
+		}
+
+		app.requestLogger(r).PrintInfo("request completed", jsonlog.Properties{
+			"remote_addr": realip.FromRequest(r),
+			"status":      metrics.Code,
+			"bytes":       metrics.Written,
+			"duration_ms": float64(metrics.Duration.Microseconds()) / 1000,
+			"user_id":     userID,
+		})
+	})
+}
+
 // This middleware will only recover panics that happen in the same goroutine that executed the
 // recoverPanic() middleware. Must recover any panics from within goroutines
 func (app *application) recoverPanic(next http.Handler) http.Handler {
@@ -29,7 +102,13 @@ func (app *application) recoverPanic(next http.Handler) http.Handler {
 			// recover() returns a value with type interface{}, use fmt.Errorf() to normalize it into an error
 			if err := recover(); err != nil {
 				w.Header().Set("Connection", "close")
-				app.serverErrorResponse(w, r, fmt.Errorf("%s", err))
+
+				// Panics are the one case where the stack trace is logged, since it shows where
+				// the panic happened
+				app.requestLogger(r).PrintErrorTrace(fmt.Errorf("%s", err), nil)
+
+				message := "the server encountered a problem and could not process your request"
+				app.errorResponse(w, r, http.StatusInternalServerError, message)
 			}
 		}()
 
@@ -37,68 +116,126 @@ func (app *application) recoverPanic(next http.Handler) http.Handler {
 	})
 }
 
-// This pattern of rate limiting will only work if your API application is running on
-// a single machine. If the infrastructure is distributed, with your app running
-// on multiple servers behind a load balancer, can use a fast database like Redis to
-// maintain a request count for clients
-func (app *application) rateLimit(next http.Handler) http.Handler {
-	type client struct {
-		limiter  *rate.Limiter
-		lastSeen time.Time
-	}
+// rateLimitGroups maps routes to the policy group they're limited under. Unlisted GET routes are
+// reads and everything else falls into the default group
+var rateLimitGroups = map[string]string{
+	"POST /v1/tokens/authentication": ratelimit.GroupLogin,
+	"POST /v1/users":                 ratelimit.GroupRegister,
+}
 
-	var (
-		mu      sync.Mutex
-		clients = make(map[string]*client)
-	)
+// rateLimitExempt routes are polled by infrastructure and are never limited
+var rateLimitExempt = map[string]bool{
+	"/v1/health/live":  true,
+	"/v1/health/ready": true,
+	"/metrics":         true,
+	"/debug/vars":      true,
+}
 
-	go func() {
-		for {
-			time.Sleep(time.Minute)
+// rateLimitGroup() returns the policy group of the route a request matches, or "" if it is exempt
+func rateLimitGroup(router *routeTable, r *http.Request) string {
+	pattern := router.pattern(r)
 
-			mu.Lock()
+	if rateLimitExempt[pattern] {
+		return ""
+	}
 
-			for ip, client := range clients {
-				if time.Since(client.lastSeen) < 3*time.Minute {
-					delete(clients, ip)
-				}
-			}
+	if group, ok := rateLimitGroups[r.Method+" "+pattern]; ok {
+		return group
+	}
 
-			mu.Unlock()
-		}
-	}()
+	if r.Method == http.MethodGet || r.Method == http.MethodHead {
+		return ratelimit.GroupReads
+	}
+
+	return ratelimit.GroupDefault
+}
 
-	// The function we return is a closure, which closes over the limiter variable
+// rateLimitClient() caps every request from one IP under the client policy. It runs before
+// authenticate(), so requests with made up tokens are throttled before they reach the database
+func (app *application) rateLimitClient(router *routeTable, next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		if app.config.limiter.enabled {
-			ip := realip.FromRequest(r)
+		if !app.config.limiter.enabled || rateLimitGroup(router, r) == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
 
-			mu.Lock()
+		policy := app.policies.For(ratelimit.GroupClient, "")
+		key := fmt.Sprintf("%s:ip:%s", ratelimit.GroupClient, realip.FromRequest(r))
 
-			if _, found := clients[ip]; !found {
-				clients[ip] = &client{
-					limiter: rate.NewLimiter(
-						rate.Limit(app.config.limiter.rps),
-						app.config.limiter.burst,
-					),
-				}
-			}
+		if app.allowRequest(w, r, key, policy.Rate()) {
+			next.ServeHTTP(w, r)
+		}
+	})
+}
 
-			clients[ip].lastSeen = time.Now()
+// rateLimit() applies the policy of the request's route group. Buckets are kept per group, so
+// heavy use of one group can't use up the budget of another, and are keyed by the authenticated
+// user where the policy allows it, so users behind a shared IP don't limit each other. A user's
+// plan can override the policy. It must run after authenticate() for the user to be known
+//
+// Which store the buckets live in is up to app.limiter: the in-memory one only works on a single
+// machine, while the Postgres one shares budgets across every instance behind a load balancer
+func (app *application) rateLimit(router *routeTable, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !app.config.limiter.enabled {
+			next.ServeHTTP(w, r)
+			return
+		}
 
-			if !clients[ip].limiter.Allow() {
-				mu.Unlock()
-				app.rateLimitExceededResponse(w, r)
-				return
-			}
+		group := rateLimitGroup(router, r)
+		if group == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
 
-			mu.Unlock()
+		user := app.contextGetUser(r)
+		policy := app.policies.For(group, user.Plan)
+
+		key := fmt.Sprintf("%s:ip:%s", group, realip.FromRequest(r))
+		if policy.Key == ratelimit.KeyUser && !user.IsAnonymous() {
+			key = fmt.Sprintf("%s:user:%d", group, user.ID)
 		}
 
-		next.ServeHTTP(w, r)
+		if app.allowRequest(w, r, key, policy.Rate()) {
+			next.ServeHTTP(w, r)
+		}
 	})
 }
 
+// allowRequest() takes a token from the bucket under key, sending a 429 response and returning
+// false if it's empty
+func (app *application) allowRequest(w http.ResponseWriter, r *http.Request, key string, rate ratelimit.Rate) bool {
+	res, err := app.limiter.Allow(r.Context(), key, rate)
+	if err != nil {
+		// Fail open, an unavailable store shouldn't take the whole API down with it
+		app.logError(r, err)
+		return true
+	}
+
+	setRateLimitHeaders(w, res)
+
+	if !res.Allowed {
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(res.RetryAfter.Seconds()))))
+		app.rateLimitExceededResponse(w, r)
+		return false
+	}
+
+	return true
+}
+
+// setRateLimitHeaders() tells clients their budget. X-RateLimit-Reset is the number of seconds
+// until the bucket is full again
+func setRateLimitHeaders(w http.ResponseWriter, res ratelimit.Result) {
+	reset := int(math.Ceil(time.Until(res.Reset).Seconds()))
+	if reset < 0 {
+		reset = 0
+	}
+
+	w.Header().Set("X-RateLimit-Limit", strconv.Itoa(res.Limit))
+	w.Header().Set("X-RateLimit-Remaining", strconv.Itoa(res.Remaining))
+	w.Header().Set("X-RateLimit-Reset", strconv.Itoa(reset))
+}
+
 func (app *application) authenticate(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		// This header indicates to caches that response may vary based on the value
@@ -126,7 +263,7 @@ func (app *application) authenticate(next http.Handler) http.Handler {
 			return
 		}
 
-		user, err := app.models.Users.GetForToken(data.ScopeAuthentication, token)
+		user, err := app.models.Users.GetForToken(r.Context(), data.ScopeAuthentication, token)
 		if err != nil {
 			switch {
 			case errors.Is(err, data.ErrRecordNotFound):
@@ -178,7 +315,13 @@ func (app *application) requirePermission(code string, next http.HandlerFunc) ht
 	fn := func(w http.ResponseWriter, r *http.Request) {
 		user := app.contextGetUser(r)
 
-		permissions, err := app.models.Permissions.GetAllForUser(user.ID)
+		ctx, span := tracing.Start(r.Context(), "requirePermission", tracing.KindInternal)
+		span.SetAttribute("permission", code)
+
+		permissions, err := app.models.Permissions.GetAllForUser(ctx, user.ID)
+		span.SetError(err)
+		span.End()
+
 		if err != nil {
 			app.serverErrorResponse(w, r, err)
 			return
@@ -211,7 +354,7 @@ func (app *application) enableCORS(next http.Handler) http.Handler {
 					if r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != "" {
 						// Not all browsers support wildcards for these headers and will block preflight requests
 						w.Header().Set("Access-Control-Allow-Methods", "OPTIONS, PUT, PATCH, DELETE")
-						w.Header().Set("Access-Control-Allow-Headers", "Authorization, Content-Type")
+						w.Header().Set("Access-Control-Allow-Headers", "Authorization, Content-Type, X-Request-ID")
 						// Send 200 OK status rather than 204 No Content, browsers might not support 204 responses
 						w.WriteHeader(http.StatusOK)
 						return
@@ -224,17 +367,28 @@ func (app *application) enableCORS(next http.Handler) http.Handler {
 	})
 }
 
-func (app *application) metrics(next http.Handler) http.Handler {
-	totalRequestsReceived := expvar.NewInt("total_requests_received")
-	totalResponsesSent := expvar.NewInt("total_responses_sent")
-	totalProcessingTimeMicroseconds := expvar.NewInt("total_processing_time_μs")
-	totalResponsesSentByStatus := expvar.NewMap("total_responses_sent_by_status")
+// The expvar counters are published once per process, so routes() can be built more than once
+var (
+	totalRequestsReceived           = expvar.NewInt("total_requests_received")
+	totalResponsesSent              = expvar.NewInt("total_responses_sent")
+	totalProcessingTimeMicroseconds = expvar.NewInt("total_processing_time_μs")
+	totalResponsesSentByStatus      = expvar.NewMap("total_responses_sent_by_status")
+)
 
+// metrics() records each request both to the expvar counters and to the Prometheus registry. The
+// router is used to label requests with the route pattern they matched
+func (app *application) metrics(router *routeTable, next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		totalRequestsReceived.Add(1)
 		metrics := httpsnoop.CaptureMetrics(next, w, r)
 		totalResponsesSent.Add(1)
 		totalProcessingTimeMicroseconds.Add(metrics.Duration.Microseconds())
 		totalResponsesSentByStatus.Add(strconv.Itoa(metrics.Code), 1)
+
+		route := router.pattern(r)
+		method := methodLabel(r.Method)
+		status := strconv.Itoa(metrics.Code)
+		httpRequestsTotal.Inc(route, method, status)
+		httpRequestDuration.Observe(metrics.Duration.Seconds(), route, method, status)
 	})
 }
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/signal"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/lyttonliao/StratCheck/internal/jsonlog"
+	"github.com/lyttonliao/StratCheck/internal/migrate"
+)
+
+// migrateTimeout bounds the migrations applied on startup, including the wait for another
+// instance's lock. Index builds aren't applied on startup, so it doesn't have to cover them
+const migrateTimeout = 10 * time.Minute
+
+// runMigrateCommand() handles `api migrate up|down [steps]|force <version>|status`. down rolls back
+// one migration unless told otherwise. An index build on a large table can take hours, so the
+// command runs until it's done or interrupted rather than under migrateTimeout. An interrupted
+// build is run again by the next `api migrate up`
+func runMigrateCommand(migrator *migrate.Migrator, args []string, logger *jsonlog.Logger) error {
+	if len(args) == 0 {
+		return errors.New("usage: api migrate up|down [steps]|force <version>|status")
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	switch args[0] {
+	case "up":
+		applied, err := migrator.Up(ctx)
+		logMigrations(logger, "applied migration", applied)
+		return err
+
+	case "down":
+		steps := 1
+
+		if len(args) > 1 {
+			n, err := strconv.Atoi(args[1])
+			if err != nil || n < 1 {
+				return fmt.Errorf("invalid number of steps %q", args[1])
+			}
+			steps = n
+		}
+
+		reverted, err := migrator.Down(ctx, steps)
+		logMigrations(logger, "reverted migration", reverted)
+		return err
+
+	case "force":
+		if len(args) < 2 {
+			return errors.New("usage: api migrate force <version>")
+		}
+
+		version, err := strconv.ParseInt(args[1], 10, 64)
+		if err != nil || version < 0 {
+			return fmt.Errorf("invalid version %q", args[1])
+		}
+
+		err = migrator.Force(ctx, version)
+		if err != nil {
+			return err
+		}
+
+		logger.PrintInfo("forced migration version", jsonlog.Properties{"version": version})
+		return nil
+
+	case "status":
+		status, err := migrator.Status(ctx)
+		if err != nil {
+			return err
+		}
+
+		fmt.Printf("Version:\t%d\n", status.Version)
+		fmt.Printf("Latest:\t\t%d\n", status.Latest)
+		fmt.Printf("Dirty:\t\t%t\n", status.Dirty)
+
+		for _, m := range status.Pending {
+			if m.NoTransaction {
+				fmt.Printf("Pending:\t%06d_%s (no transaction)\n", m.Version, m.Name)
+				continue
+			}
+			fmt.Printf("Pending:\t%06d_%s\n", m.Version, m.Name)
+		}
+
+		return nil
+
+	default:
+		return fmt.Errorf("unknown migrate command %q", args[0])
+	}
+}
+
+// migrateOnStartup() applies any pending migrations when the api is started with -migrate. When
+// several instances start together one migrates while the others wait on the lock, then find
+// nothing left to do. Index builds can take a long time on a large table, so they're left for
+// `api migrate up` instead of holding up the start
+func migrateOnStartup(migrator *migrate.Migrator, logger *jsonlog.Logger) error {
+	ctx, cancel := context.WithTimeout(context.Background(), migrateTimeout)
+	defer cancel()
+
+	applied, err := migrator.UpRequired(ctx)
+	logMigrations(logger, "applied migration", applied)
+
+	return err
+}
+
+// checkSchema() refuses to serve against a database missing migrations this binary relies on.
+// Pending and failed index builds are only logged
+func checkSchema(migrator *migrate.Migrator, logger *jsonlog.Logger) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	err := migrator.Check(ctx)
+	if err != nil {
+		if errors.Is(err, migrate.ErrSchemaOutdated) {
+			return fmt.Errorf("%w, run `api migrate up` or start with -migrate", err)
+		}
+		return err
+	}
+
+	status, err := migrator.Status(ctx)
+	if err != nil {
+		return err
+	}
+
+	if status.Dirty {
+		logger.PrintWarn("index migration failed, run `api migrate up` to retry it", jsonlog.Properties{
+			"version": status.Version,
+		})
+	}
+
+	for _, m := range status.Pending {
+		logger.PrintWarn("index migration pending, run `api migrate up` to apply it", jsonlog.Properties{
+			"version": m.Version,
+			"name":    m.Name,
+		})
+	}
+
+	return nil
+}
+
+func logMigrations(logger *jsonlog.Logger, message string, migrations []migrate.Migration) {
+	for _, m := range migrations {
+		logger.PrintInfo(message, jsonlog.Properties{
+			"version": m.Version,
+			"name":    m.Name,
+		})
+	}
+}
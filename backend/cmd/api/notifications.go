@@ -0,0 +1,204 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/lyttonliao/StratCheck/internal/data"
+	"github.com/lyttonliao/StratCheck/internal/jsonlog"
+	"github.com/lyttonliao/StratCheck/internal/validator"
+)
+
+// event is posted by the Backtrader service when something happens that a user should hear about,
+// or as backtest.started before it runs a backtest. For strategy.shared the user is the one the
+// strategy was shared with
+type event struct {
+	Type   string                `json:"type"`
+	UserID int64                 `json:"user_id"`
+	Data   data.NotificationData `json:"data"`
+}
+
+// createEventHandler() receives events from the Backtrader service, which authenticates with the
+// shared secret in the X-Events-Secret header. The endpoint is disabled when no secret is set
+func (app *application) createEventHandler(w http.ResponseWriter, r *http.Request) {
+	if app.config.events.secret == "" {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	secret := r.Header.Get("X-Events-Secret")
+	if subtle.ConstantTimeCompare([]byte(secret), []byte(app.config.events.secret)) != 1 {
+		app.invalidCredentialsResponse(w, r)
+		return
+	}
+
+	var input event
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+	v.Check(input.Type == data.EventBacktestStarted || validator.In(input.Type, data.NotificationEvents...), "type", "must be a known event type")
+	v.Check(input.UserID > 0, "user_id", "must be provided")
+
+	// A finished backtest is charged to the run its backtest.started event reserved
+	if input.Type == data.EventBacktestCompleted || input.Type == data.EventBacktestFailed {
+		_, ok := input.Data["run_id"].(float64)
+		v.Check(ok, "data.run_id", "must be the id of the run returned for the backtest.started event")
+	}
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	user, err := app.models.Users.Get(r.Context(), input.UserID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			v.AddError("user_id", "no matching user found")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	if input.Type == data.EventBacktestStarted {
+		app.startBacktestRun(w, r, user)
+		return
+	}
+
+	if input.Type == data.EventBacktestCompleted || input.Type == data.EventBacktestFailed {
+		err = app.recordBacktestUsage(r, input)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+	}
+
+	err = app.notify(r.Context(), user, input)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	if validator.In(input.Type, data.WebhookEvents...) {
+		err = app.dispatchWebhookEvent(r.Context(), app.models, user.ID, input.Type, input.Data)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+	}
+
+	err = app.writeJSON(w, http.StatusAccepted, envelope{"message": "event accepted"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// notify() records the event as a notification and delivers it on the channels the user has
+// chosen. Emails go through the outbox in the same transaction, or wait for the next digest, and
+// the webhook in the user's preferences is queued with the webhook deliveries
+func (app *application) notify(ctx context.Context, user *data.User, e event) error {
+	prefs := user.Preferences.Notifications
+
+	if !prefs.Wants(e.Type) {
+		return nil
+	}
+
+	notification := &data.Notification{
+		UserID:        user.ID,
+		Type:          e.Type,
+		Data:          e.Data,
+		DigestPending: prefs.Email && prefs.Digest,
+	}
+
+	err := app.models.WithTx(ctx, func(tx data.Models) error {
+		err := tx.Notifications.Insert(ctx, notification)
+		if err != nil {
+			return err
+		}
+
+		if prefs.WebhookURL != "" {
+			payload, err := json.Marshal(envelope{"notification": notification})
+			if err != nil {
+				return err
+			}
+
+			err = tx.WebhookDeliveries.Insert(ctx, &data.WebhookDelivery{
+				UserID:  user.ID,
+				URL:     prefs.WebhookURL,
+				Event:   notification.Type,
+				Payload: payload,
+			})
+			if err != nil {
+				return err
+			}
+		}
+
+		if !prefs.Email || prefs.Digest {
+			return nil
+		}
+
+		return app.enqueueEmail(ctx, tx, user.Email, user.Preferences.Language, "notification.tmpl", map[string]interface{}{
+			"name": user.Name,
+			"type": notification.Type,
+			"data": map[string]interface{}(notification.Data),
+		})
+	})
+
+	return err
+}
+
+// sendNotificationDigests() sends one email per user holding every notification that was held back
+// for their digest. Taking the notifications and queueing the email share a transaction, so a
+// notification is never marked as sent without its email being queued
+func (app *application) sendNotificationDigests(ctx context.Context) error {
+	ids, err := app.models.Notifications.GetUsersWithPendingDigest(ctx)
+	if err != nil {
+		return err
+	}
+
+	for _, id := range ids {
+		user, err := app.models.Users.Get(ctx, id)
+		if err != nil {
+			app.contextLogger(ctx).PrintError(err, jsonlog.Properties{"user_id": id})
+			continue
+		}
+
+		err = app.models.WithTx(ctx, func(tx data.Models) error {
+			notifications, err := tx.Notifications.TakePendingDigest(ctx, user.ID)
+			if err != nil || len(notifications) == 0 {
+				return err
+			}
+
+			var items []map[string]interface{}
+
+			for _, n := range notifications {
+				items = append(items, map[string]interface{}{
+					"type":       n.Type,
+					"created_at": n.CreatedAt.Format(time.RFC1123),
+					"data":       map[string]interface{}(n.Data),
+				})
+			}
+
+			return app.enqueueEmail(ctx, tx, user.Email, user.Preferences.Language, "notification_digest.tmpl", map[string]interface{}{
+				"name":          user.Name,
+				"notifications": items,
+			})
+		})
+		if err != nil {
+			app.contextLogger(ctx).PrintError(err, jsonlog.Properties{"user_id": id})
+		}
+	}
+
+	return nil
+}
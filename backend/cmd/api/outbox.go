@@ -0,0 +1,267 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+
+	"github.com/lyttonliao/StratCheck/internal/data"
+	"github.com/lyttonliao/StratCheck/internal/jsonlog"
+	"github.com/lyttonliao/StratCheck/internal/mailer"
+	"github.com/lyttonliao/StratCheck/internal/validator"
+)
+
+// enqueueEmail() adds a message to the outbox. Pass the models bound to the transaction making the
+// change the email is about, so the email is only sent if that change is committed. The locale
+// picks the template variant and is usually the recipient's language preference
+func (app *application) enqueueEmail(ctx context.Context, models data.Models, recipient, locale, templateFile string, templateData map[string]interface{}) error {
+	return models.EmailOutbox.Insert(ctx, &data.EmailMessage{
+		Recipient: recipient,
+		Template:  templateFile,
+		Locale:    locale,
+		Data:      templateData,
+	})
+}
+
+// deliverEmails() sends the outbox messages that are due. Failed sends are retried with
+// exponential backoff and dead-lettered once they reach the configured number of attempts
+func (app *application) deliverEmails(ctx context.Context) error {
+	messages, err := app.models.EmailOutbox.Claim(ctx, app.config.outbox.batchSize, 5*time.Minute)
+	if err != nil {
+		return err
+	}
+
+	for _, msg := range messages {
+		sendErr := app.mailer.Send(msg.Recipient, msg.Template, msg.Locale, msg.Data)
+		if sendErr == nil {
+			err = app.models.EmailOutbox.MarkSent(ctx, msg.ID)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+
+		attempts := msg.Attempts + 1
+		dead := attempts >= app.config.outbox.maxAttempts
+
+		err = app.models.EmailOutbox.MarkFailed(ctx, msg.ID, sendErr, time.Now().Add(retryBackoff(attempts)), dead)
+		if err != nil {
+			return err
+		}
+
+		properties := jsonlog.Properties{
+			"email_id": msg.ID,
+			"template": msg.Template,
+			"attempts": attempts,
+		}
+
+		if dead {
+			app.contextLogger(ctx).PrintError(errors.New("email delivery failed permanently: "+sendErr.Error()), properties)
+		} else {
+			app.contextLogger(ctx).PrintWarn("email delivery failed, will retry: "+sendErr.Error(), properties)
+		}
+	}
+
+	return nil
+}
+
+func (app *application) listEmailsHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Status string
+		data.Filters
+	}
+
+	v := validator.New()
+	qs := r.URL.Query()
+
+	input.Status = app.readString(qs, "status", "")
+	input.Filters.Page = app.readInt(qs, "page", 1, v)
+	input.Filters.PageSize = app.readInt(qs, "page_size", 20, v)
+	input.Filters.Sort = app.readString(qs, "sort", "-id")
+	input.Filters.Cursor = app.readCursor(qs, "cursor", v)
+	input.Filters.SkipTotal = app.readBool(qs, "skip_total", false, v)
+	input.Filters.SortSafelist = []string{"id", "created_at", "next_attempt_at", "-id", "-created_at", "-next_attempt_at"}
+
+	if input.Status != "" {
+		v.Check(validator.In(input.Status, data.EmailPending, data.EmailSent, data.EmailFailed), "status", "invalid status value")
+	}
+
+	if data.ValidateFilters(v, input.Filters); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	emails, metadata, err := app.models.EmailOutbox.GetAll(r.Context(), input.Status, input.Filters)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	app.setCursorLinks(r, &metadata)
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"emails": emails, "metadata": metadata}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) showEmailHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	email, err := app.models.EmailOutbox.Get(r.Context(), id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"email": email}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// Only failed messages can be requeued, pending ones are already waiting to be sent. Messages
+// whose tokens were redacted can't be, the user has to ask for a new token instead
+func (app *application) requeueEmailHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	email, err := app.models.EmailOutbox.Get(r.Context(), id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	if email.Redacted() {
+		message := "this email's one-time token was redacted when it failed, so it can't be resent"
+		app.errorResponse(w, r, http.StatusConflict, message)
+		return
+	}
+
+	email, err = app.models.EmailOutbox.Requeue(r.Context(), id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"email": email}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// emailSampleData holds the template data used to preview each email. Keep it in step with the
+// data passed to enqueueEmail() for the template
+var emailSampleData = map[string]map[string]interface{}{
+	"user_welcome.tmpl": {
+		"activationToken": "Y3QMGX3PJ3WLRL2YRTQGQ6KRHU",
+		"activationURL":   "https://example.com/v1/users/activate?token=Y3QMGX3PJ3WLRL2YRTQGQ6KRHU",
+		"userID":          123,
+	},
+	"token_activation.tmpl": {
+		"activationToken": "Y3QMGX3PJ3WLRL2YRTQGQ6KRHU",
+		"activationURL":   "https://example.com/v1/users/activate?token=Y3QMGX3PJ3WLRL2YRTQGQ6KRHU",
+	},
+	"token_password_reset.tmpl": {
+		"passwordResetToken": "Y3QMGX3PJ3WLRL2YRTQGQ6KRHU",
+	},
+	"user_email_change.tmpl": {
+		"emailChangeToken": "Y3QMGX3PJ3WLRL2YRTQGQ6KRHU",
+		"newEmail":         "new.address@example.com",
+	},
+	"notification.tmpl": {
+		"name": "Alice",
+		"type": "backtest.completed",
+		"data": map[string]interface{}{"backtest_id": 42, "strategy_name": "Golden Cross"},
+	},
+	"notification_digest.tmpl": {
+		"name": "Alice",
+		"notifications": []map[string]interface{}{
+			{"type": "backtest.completed", "created_at": "Mon, 02 Jan 2006 15:04:05 UTC", "data": map[string]interface{}{"backtest_id": 42, "strategy_name": "Golden Cross"}},
+			{"type": "strategy.shared", "created_at": "Mon, 02 Jan 2006 16:20:00 UTC", "data": map[string]interface{}{"shared_by": "Bob", "strategy_name": "Mean Reversion"}},
+		},
+	},
+}
+
+func (app *application) listEmailTemplatesHandler(w http.ResponseWriter, r *http.Request) {
+	var templates []envelope
+
+	for _, name := range app.mailer.Templates() {
+		templates = append(templates, envelope{
+			"name":    name,
+			"locales": app.mailer.Locales(name),
+		})
+	}
+
+	err := app.writeJSON(w, http.StatusOK, envelope{"templates": templates}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// previewEmailTemplateHandler() renders a template with sample data in the locale given by the
+// locale query string parameter, falling back to the default variant as Send() does
+func (app *application) previewEmailTemplateHandler(w http.ResponseWriter, r *http.Request) {
+	name := httprouter.ParamsFromContext(r.Context()).ByName("name")
+
+	v := validator.New()
+	locale := app.readString(r.URL.Query(), "locale", "")
+
+	if locale != "" {
+		v.Check(validator.Matches(locale, data.LanguageRX), "locale", "must be a language code such as en or fr-CA")
+	}
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	msg, err := app.mailer.Render("recipient@example.com", name, locale, emailSampleData[name])
+	if err != nil {
+		switch {
+		case errors.Is(err, mailer.ErrTemplateNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	env := envelope{
+		"template":   name,
+		"locale":     locale,
+		"subject":    msg.Subject,
+		"plain_body": msg.PlainBody,
+		"html_body":  msg.HTMLBody,
+	}
+
+	err = app.writeJSON(w, http.StatusOK, env, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"embed"
+	"errors"
+	"html/template"
+	"net/http"
+
+	"github.com/lyttonliao/StratCheck/internal/data"
+	"github.com/lyttonliao/StratCheck/internal/validator"
+)
+
+//go:embed "templates"
+var pageFS embed.FS
+
+var pages = template.Must(template.ParseFS(pageFS, "templates/*.tmpl"))
+
+type activationPage struct {
+	Token     string
+	Name      string
+	Activated bool
+	Error     string
+}
+
+func (app *application) renderPage(w http.ResponseWriter, r *http.Request, status int, name string, data interface{}) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(status)
+
+	err := pages.ExecuteTemplate(w, name, data)
+	if err != nil {
+		app.logError(r, err)
+	}
+}
+
+// The emailed link only shows a confirmation form. Mail scanners follow links in emails, so
+// activating on GET would let them activate accounts nobody has looked at
+func (app *application) showActivationPageHandler(w http.ResponseWriter, r *http.Request) {
+	page := activationPage{Token: r.URL.Query().Get("token")}
+
+	v := validator.New()
+	if data.ValidateTokenPlaintext(v, page.Token); !v.Valid() {
+		page.Error = "This activation link is invalid."
+		app.renderPage(w, r, http.StatusBadRequest, "activate.tmpl", page)
+		return
+	}
+
+	app.renderPage(w, r, http.StatusOK, "activate.tmpl", page)
+}
+
+func (app *application) submitActivationPageHandler(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, 4096)
+
+	err := r.ParseForm()
+	if err != nil {
+		app.renderPage(w, r, http.StatusBadRequest, "activate.tmpl", activationPage{Error: "This activation link is invalid."})
+		return
+	}
+
+	page := activationPage{Token: r.PostForm.Get("token")}
+
+	v := validator.New()
+	if data.ValidateTokenPlaintext(v, page.Token); !v.Valid() {
+		page.Error = "This activation link is invalid."
+		app.renderPage(w, r, http.StatusBadRequest, "activate.tmpl", page)
+		return
+	}
+
+	user, err := app.models.Users.GetForToken(r.Context(), data.ScopeActivation, page.Token)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			page.Error = "This activation link is invalid or has expired."
+			app.renderPage(w, r, http.StatusUnprocessableEntity, "activate.tmpl", page)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.activateUser(r.Context(), user)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrEditConflict):
+			page.Error = "Your account could not be activated, please try again."
+			app.renderPage(w, r, http.StatusConflict, "activate.tmpl", page)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	page.Name = user.Name
+	page.Activated = true
+
+	app.renderPage(w, r, http.StatusOK, "activate.tmpl", page)
+}
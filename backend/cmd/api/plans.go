@@ -0,0 +1,102 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/lyttonliao/StratCheck/internal/data"
+	"github.com/lyttonliao/StratCheck/internal/jsonlog"
+	"github.com/lyttonliao/StratCheck/internal/ratelimit"
+	"github.com/lyttonliao/StratCheck/internal/validator"
+)
+
+// listPlansHandler() shows each plan with the rate limit it gets for every route group under the
+// loaded policies
+func (app *application) listPlansHandler(w http.ResponseWriter, r *http.Request) {
+	plans, err := app.models.Plans.GetAll(r.Context())
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	type planLimits struct {
+		*data.Plan
+		Limits map[string]ratelimit.Policy `json:"limits"`
+	}
+
+	output := make([]planLimits, 0, len(plans))
+
+	for _, plan := range plans {
+		limits := make(map[string]ratelimit.Policy, len(ratelimit.Groups))
+		for _, group := range ratelimit.Groups {
+			limits[group] = app.policies.For(group, plan.Code)
+		}
+
+		output = append(output, planLimits{Plan: plan, Limits: limits})
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"plans": output}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) updateUserPlanHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	var input struct {
+		Plan string `json:"plan"`
+	}
+
+	err = app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+	v.Check(input.Plan != "", "plan", "must be provided")
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	plan, err := app.models.Plans.Get(r.Context(), input.Plan)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			v.AddError("plan", "no matching plan found")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.models.Plans.SetForUser(r.Context(), id, plan.Code)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	app.requestLogger(r).PrintInfo("user plan changed", jsonlog.Properties{
+		"user_id":  id,
+		"plan":     plan.Code,
+		"admin_id": app.contextGetUser(r).ID,
+	})
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"user_id": id, "plan": plan}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
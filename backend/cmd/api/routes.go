@@ -3,36 +3,97 @@ package main
 import (
 	"expvar"
 	"net/http"
-
-	"github.com/julienschmidt/httprouter"
 )
 
 func (app *application) routes() http.Handler {
-	router := httprouter.New()
+	router := newRouteTable()
 
 	router.NotFound = http.HandlerFunc(app.notFoundResponse)
 
 	router.MethodNotAllowed = http.HandlerFunc(app.methodNotAllowedResponse)
 
 	router.HandlerFunc(http.MethodGet, "/v1/healthcheck", app.healthcheckHandler)
+	router.HandlerFunc(http.MethodGet, "/v1/health/live", app.livenessHandler)
+	router.HandlerFunc(http.MethodGet, "/v1/health/ready", app.readinessHandler)
 	router.HandlerFunc(http.MethodPost, "/v1/strategies", app.requirePermission("strategies:write", app.forwardRequestHandler))
 	router.HandlerFunc(http.MethodGet, "/v1/strategies", app.requirePermission("strategies:read", app.forwardRequestHandler))
 	router.HandlerFunc(http.MethodGet, "/v1/strategies/:id", app.requirePermission("strategies:read", app.forwardRequestHandler))
 	router.HandlerFunc(http.MethodPatch, "/v1/strategies/:id", app.requirePermission("strategies:write", app.forwardRequestHandler))
 	router.HandlerFunc(http.MethodDelete, "/v1/strategies/:id", app.requirePermission("strategies:write", app.forwardRequestHandler))
+	router.HandlerFunc(http.MethodPatch, "/v1/strategies/:id/details", app.requirePermission("strategies:write", app.updateStrategyDetailsHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/search/strategies", app.requirePermission("strategies:read", app.listStrategiesHandler))
+
+	router.HandlerFunc(http.MethodGet, "/v1/folders", app.requirePermission("strategies:read", app.listFoldersHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/folders", app.requirePermission("strategies:write", app.createFolderHandler))
+	router.HandlerFunc(http.MethodPatch, "/v1/folders/:id", app.requirePermission("strategies:write", app.updateFolderHandler))
+	router.HandlerFunc(http.MethodDelete, "/v1/folders/:id", app.requirePermission("strategies:write", app.deleteFolderHandler))
+
+	router.HandlerFunc(http.MethodGet, "/v1/tags", app.requirePermission("strategies:read", app.listTagsHandler))
+	router.HandlerFunc(http.MethodPut, "/v1/tags/:tag", app.requirePermission("strategies:write", app.renameTagHandler))
+	router.HandlerFunc(http.MethodDelete, "/v1/tags/:tag", app.requirePermission("strategies:write", app.deleteTagHandler))
 
 	router.HandlerFunc(http.MethodPost, "/v1/users", app.registerUserHandler)
 	router.HandlerFunc(http.MethodPut, "/v1/users/activated", app.activateUserHandler)
+	router.HandlerFunc(http.MethodGet, "/v1/users/activate", app.showActivationPageHandler)
+	router.HandlerFunc(http.MethodPost, "/v1/users/activate", app.submitActivationPageHandler)
 
 	router.HandlerFunc(http.MethodPut, "/v1/users/password", app.updateUserPasswordHandler)
+	router.HandlerFunc(http.MethodPut, "/v1/users/email", app.confirmEmailChangeHandler)
+
+	router.HandlerFunc(http.MethodGet, "/v1/users/me", app.requireAuthenticatedUser(app.showCurrentUserHandler))
+	router.HandlerFunc(http.MethodPatch, "/v1/users/me", app.requireAuthenticatedUser(app.updateCurrentUserHandler))
+	router.HandlerFunc(http.MethodDelete, "/v1/users/me", app.requireAuthenticatedUser(app.deleteCurrentUserHandler))
+	router.HandlerFunc(http.MethodDelete, "/v1/users/me/deletion", app.requireAuthenticatedUser(app.cancelCurrentUserDeletionHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/users/me/export", app.requireActivatedUser(app.exportCurrentUserHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/users/me/email", app.requireActivatedUser(app.requestEmailChangeHandler))
+	router.HandlerFunc(http.MethodPut, "/v1/users/me/password", app.requireActivatedUser(app.changeCurrentUserPasswordHandler))
+
+	router.HandlerFunc(http.MethodGet, "/v1/usage", app.requireActivatedUser(app.showUsageHandler))
+
+	router.HandlerFunc(http.MethodGet, "/v1/webhooks", app.requireActivatedUser(app.listWebhooksHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/webhooks", app.requireActivatedUser(app.createWebhookHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/webhooks/:id", app.requireActivatedUser(app.showWebhookHandler))
+	router.HandlerFunc(http.MethodPatch, "/v1/webhooks/:id", app.requireActivatedUser(app.updateWebhookHandler))
+	router.HandlerFunc(http.MethodDelete, "/v1/webhooks/:id", app.requireActivatedUser(app.deleteWebhookHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/webhooks/:id/deliveries", app.requireActivatedUser(app.listWebhookDeliveriesHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/webhooks/:id/ping", app.requireActivatedUser(app.pingWebhookHandler))
 
 	router.HandlerFunc(http.MethodPost, "/v1/tokens/authentication", app.createAuthenticationTokenHandler)
 
 	router.HandlerFunc(http.MethodPost, "/v1/tokens/password-reset", app.createPasswordResetTokenHandler)
+	router.HandlerFunc(http.MethodPost, "/v1/tokens/activation", app.createActivationTokenHandler)
+
+	router.HandlerFunc(http.MethodPost, "/v1/events", app.createEventHandler)
+
+	router.HandlerFunc(http.MethodGet, "/v1/admin/emails", app.requirePermission("admin", app.listEmailsHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/admin/emails/:id", app.requirePermission("admin", app.showEmailHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/admin/emails/:id/requeue", app.requirePermission("admin", app.requeueEmailHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/admin/email-templates", app.requirePermission("admin", app.listEmailTemplatesHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/admin/email-templates/:name/preview", app.requirePermission("admin", app.previewEmailTemplateHandler))
+
+	router.HandlerFunc(http.MethodGet, "/v1/admin/health", app.requirePermission("admin", app.showHealthDetailsHandler))
+
+	router.HandlerFunc(http.MethodGet, "/v1/admin/log-level", app.requirePermission("admin", app.showLogLevelHandler))
+	router.HandlerFunc(http.MethodPut, "/v1/admin/log-level", app.requirePermission("admin", app.updateLogLevelHandler))
+
+	router.HandlerFunc(http.MethodGet, "/v1/admin/plans", app.requirePermission("admin", app.listPlansHandler))
+	router.HandlerFunc(http.MethodPut, "/v1/admin/users/:id/plan", app.requirePermission("admin", app.updateUserPlanHandler))
 
 	router.Handler(http.MethodGet, "/debug/vars", expvar.Handler())
+	router.Handler(http.MethodGet, "/metrics", registry.Handler())
+
+	// Each middleware runs inside a span named after it, so a slow request shows which one the time
+	// went to
+	// The per-user rate limiter runs after authentication so it can key buckets by user and apply
+	// their plan, while the per-IP one runs before it so failed authentications are limited too
+	handler := app.traceMiddleware("rateLimit", app.rateLimit(router, router))
+	handler = app.traceMiddleware("authenticate", app.authenticate(handler))
+	handler = app.traceMiddleware("rateLimitClient", app.rateLimitClient(router, handler))
 
 	// Position CORs middleware before rate limiter because any CORs that exceed the rate limit
 	// should not have the Access-Control-Allow-Origin header set
-	return app.metrics(app.recoverPanic(app.enableCORS(app.rateLimit(app.authenticate(router)))))
+	handler = app.traceMiddleware("enableCORS", app.enableCORS(handler))
+	handler = app.traceMiddleware("recoverPanic", app.recoverPanic(handler))
+
+	return app.requestID(app.trace(router, app.logRequest(app.metrics(router, handler))))
 }
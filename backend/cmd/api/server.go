@@ -9,6 +9,8 @@ import (
 	"os/signal"
 	"syscall"
 	"time"
+
+	"github.com/lyttonliao/StratCheck/internal/jsonlog"
 )
 
 // Declare a HTTP server with timeout settings, which listens on the port
@@ -33,7 +35,7 @@ func (app *application) serve() error {
 		signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
 		s := <-quit
 
-		app.logger.PrintInfo("caught signal", map[string]string{
+		app.logger.PrintInfo("caught signal", jsonlog.Properties{
 			"signal": s.String(),
 		})
 
@@ -45,16 +47,34 @@ func (app *application) serve() error {
 			shutdownError <- err
 		}
 
-		app.logger.PrintInfo("completing background tasks", map[string]string{
+		app.logger.PrintInfo("completing background tasks", jsonlog.Properties{
 			"addr": srv.Addr,
 		})
 
+		// Stop scheduled jobs from starting another run
+		close(app.shutdown)
+
 		// Call Wait() to block until our WaitGroup counter is zero
 		app.wg.Wait()
+
+		// Export the spans of the last requests and jobs
+		if app.tracer != nil {
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+
+			err = app.tracer.Shutdown(ctx)
+			if err != nil {
+				shutdownError <- err
+				return
+			}
+		}
+
 		shutdownError <- nil
 	}()
 
-	app.logger.PrintInfo("starting server", map[string]string{
+	app.startJobs()
+
+	app.logger.PrintInfo("starting server", jsonlog.Properties{
 		"addr": srv.Addr,
 		"env":  app.config.env,
 	})
@@ -69,7 +89,7 @@ func (app *application) serve() error {
 		return nil
 	}
 
-	app.logger.PrintInfo("stopped server", map[string]string{
+	app.logger.PrintInfo("stopped server", jsonlog.Properties{
 		"addr": srv.Addr,
 	})
 
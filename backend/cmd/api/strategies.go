@@ -3,57 +3,106 @@ package main
 import (
 	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/lyttonliao/StratCheck/internal/data"
+	"github.com/lyttonliao/StratCheck/internal/jsonlog"
+	"github.com/lyttonliao/StratCheck/internal/validator"
 )
 
 func (app *application) forwardRequestHandler(w http.ResponseWriter, r *http.Request) {
+	status, payload, header, ok := app.forwardRequest(w, r)
+	if !ok {
+		return
+	}
+
+	if strings.HasPrefix(r.URL.Path, "/v1/strategies") && status >= 200 && status <= 299 {
+		event := ""
+
+		switch r.Method {
+		case http.MethodPost:
+			event = data.EventStrategyCreated
+		case http.MethodPatch:
+			event = data.EventStrategyUpdated
+		}
+
+		if event != "" {
+			err := app.dispatchWebhookEvent(r.Context(), app.models, app.contextGetUser(r).ID, event, payload)
+			if err != nil {
+				app.logError(r, err)
+			}
+		}
+	}
+
+	err := app.writeJSON(w, status, envelope{"payload": payload}, header)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// forwardedHeaders are the upstream response headers passed back to the client. Anything else,
+// like hop-by-hop or framing headers, stays between the API and the Backtrader service
+var forwardedHeaders = []string{"Cache-Control", "ETag", "Last-Modified", "Link", "Location"}
+
+// forwardRequest() sends the request on to the Backtrader service with the user's jwt, returning
+// the upstream status, decoded payload and the headers in forwardedHeaders. If it fails an error
+// response has already been sent and ok is false
+func (app *application) forwardRequest(w http.ResponseWriter, r *http.Request) (status int, payload interface{}, header http.Header, ok bool) {
 	cookie, err := r.Cookie("jwt")
 	if err != nil {
 		app.invalidAuthenticationTokenResponse(w, r)
-		return
+		return 0, nil, nil, false
 	}
 
 	body, err := io.ReadAll(r.Body)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
-		return
+		return 0, nil, nil, false
 	}
 
-	url := fmt.Sprintf("http://localhost:8000%s", r.URL)
-	fmt.Println("Forwarding request to: ", url)
+	url := fmt.Sprintf("%s%s", app.config.backtest.url, r.URL)
+	app.requestLogger(r).PrintDebug("forwarding request", jsonlog.Properties{"url": url})
 
-	proxyReq, err := http.NewRequest(r.Method, url, bytes.NewBuffer(body))
+	proxyReq, err := http.NewRequestWithContext(r.Context(), r.Method, url, bytes.NewBuffer(body))
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
-		return
+		return 0, nil, nil, false
 	}
 	proxyReq.Close = true
 
 	proxyReq.Header.Set("Host", r.Host)
 	proxyReq.Header.Set("Content-Type", "application/json")
 	proxyReq.Header.Set("Authorization", "Bearer "+cookie.Value)
+	proxyReq.Header.Set("X-Request-ID", app.contextGetRequestID(r))
 
 	client := &http.Client{}
-	proxyRes, err := client.Do(proxyReq)
+
+	proxyRes, err := app.doUpstream("strategies", client, proxyReq)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
-		return
+		return 0, nil, nil, false
 	}
 	defer proxyRes.Body.Close()
 
-	var payload interface{}
 	err = json.NewDecoder(proxyRes.Body).Decode(&payload)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
-		return
+		return 0, nil, nil, false
 	}
 
-	err = app.writeJSON(w, proxyRes.StatusCode, envelope{"payload": payload}, proxyReq.Header)
-	if err != nil {
-		app.serverErrorResponse(w, r, err)
+	header = make(http.Header)
+	for _, key := range forwardedHeaders {
+		if values := proxyRes.Header.Values(key); len(values) > 0 {
+			header[key] = values
+		}
 	}
+
+	return proxyRes.StatusCode, payload, header, true
 }
 
 // func (app *application) createStrategyHandler(w http.ResponseWriter, r *http.Request) {
@@ -229,43 +278,200 @@ func (app *application) forwardRequestHandler(w http.ResponseWriter, r *http.Req
 // 	}
 // }
 
-// func (app *application) listStrategiesHandler(w http.ResponseWriter, r *http.Request) {
-// 	var input struct {
-// 		Name     string
-// 		Fields   []string
-// 		Criteria []string
-// 		data.Filters
-// 	}
+// listStrategiesHandler() searches the user's strategies and everyone's public ones. It's served at
+// GET /v1/search/strategies, leaving GET /v1/strategies to the Backtrader service. Filters use the
+// column[operator]=value grammar, e.g. ?search=momentum&tags[overlaps]=fx,crypto&created_at[gte]=2024-01-01.
+// folder=id lists the strategies in one of the user's folders and its subfolders
+func (app *application) listStrategiesHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		data.StrategyFilter
+		data.Filters
+	}
 
-// 	user := app.contextGetUser(r)
+	user := app.contextGetUser(r)
 
-// 	v := validator.New()
-// 	// r.URL.Query() returns url.Values map containing the query string data
-// 	qs := r.URL.Query()
-
-// 	input.Name = app.readString(qs, "name", "")
-// 	input.Fields = app.readCSV(qs, "fields", []string{})
-// 	input.Criteria = app.readCSV(qs, "criteria", []string{})
-// 	input.Filters.Page = app.readInt(qs, "page", 1, v)
-// 	input.Filters.PageSize = app.readInt(qs, "page_size", 20, v)
-// 	input.Filters.Sort = app.readString(qs, "sort", "id")
-// 	input.Filters.SortSafelist = []string{"id", "name", "fields", "-id", "-name", "-fields"}
-
-// 	if data.ValidateFilters(v, input.Filters); !v.Valid() {
-// 		app.failedValidationResponse(w, r, v.Errors)
-// 		return
-// 	}
+	v := validator.New()
+	// r.URL.Query() returns url.Values map containing the query string data
+	qs := r.URL.Query()
 
-// 	strategies, metadata, err := app.models.Strategies.GetAll(user.ID, input.Name, input.Fields, input.Filters)
-// 	if err != nil {
-// 		app.serverErrorResponse(w, r, err)
-// 		return
-// 	}
+	input.Search = app.readString(qs, "search", "")
+	input.Fields = splitCSV(app.readOperators(qs, "fields", "contains", []string{"contains"}, v)["contains"])
+	input.Criteria = splitCSV(app.readOperators(qs, "criteria", "contains", []string{"contains"}, v)["contains"])
 
-// 	err = app.writeJSON(w, http.StatusOK, envelope{"strategies": strategies, "metadata": metadata}, nil)
-// 	if err != nil {
-// 		app.serverErrorResponse(w, r, err)
-// 	}
+	tags := app.readOperators(qs, "tags", "contains", []string{"contains", "overlaps"}, v)
+	input.Tags = splitCSV(tags["contains"])
+	input.AnyTags = splitCSV(tags["overlaps"])
 
-// 	fmt.Fprintf(w, "%+v\n", input)
-// }
+	input.FolderID = int64(app.readInt(qs, "folder", 0, v))
+
+	if qs.Has("public") {
+		public := app.readBool(qs, "public", false, v)
+		input.Public = &public
+	}
+
+	switch owner := qs.Get("owner"); owner {
+	case "":
+	case "me":
+		input.OwnerID = user.ID
+	default:
+		id, err := strconv.ParseInt(owner, 10, 64)
+		if err != nil || id < 1 {
+			v.AddError("owner", "must be a positive integer or me")
+		}
+		input.OwnerID = id
+	}
+
+	for op, value := range app.readOperators(qs, "created_at", "", []string{"gt", "gte", "lt", "lte"}, v) {
+		t, err := parseTimeOrDate(value)
+		if err != nil {
+			v.AddError("created_at["+op+"]", "must be an RFC 3339 timestamp or a date")
+			continue
+		}
+
+		switch op {
+		case "gt":
+			input.Created.GT = &t
+		case "gte":
+			input.Created.GTE = &t
+		case "lt":
+			input.Created.LT = &t
+		case "lte":
+			input.Created.LTE = &t
+		}
+	}
+
+	// Searches are listed best match first unless another sort is asked for
+	defaultSort := "id"
+	if input.Search != "" {
+		defaultSort = "-rank"
+	}
+
+	input.Filters.Page = app.readInt(qs, "page", 1, v)
+	input.Filters.PageSize = app.readInt(qs, "page_size", 20, v)
+	input.Filters.Sort = app.readString(qs, "sort", defaultSort)
+	input.Filters.SortSafelist = []string{"id", "name", "fields", "created_at", "rank", "-id", "-name", "-fields", "-created_at", "-rank"}
+	input.Filters.Cursor = app.readCursor(qs, "cursor", v)
+	input.Filters.SkipTotal = app.readBool(qs, "skip_total", false, v)
+
+	data.ValidateStrategyFilter(v, input.StrategyFilter)
+
+	if data.ValidateFilters(v, input.Filters); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	strategies, metadata, err := app.models.Strategies.GetAll(r.Context(), user.ID, input.StrategyFilter, input.Filters)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	app.setCursorLinks(r, &metadata)
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"strategies": strategies, "metadata": metadata}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// updateStrategyDetailsHandler() changes how one of the user's strategies is described and
+// organized. The Backtrader service owns the rest of the strategy, so edits to it still go through
+// PATCH /v1/strategies/:id. A folder_id of 0 moves the strategy to the top level
+func (app *application) updateStrategyDetailsHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	user := app.contextGetUser(r)
+
+	strategy, err := app.models.Strategies.Get(r.Context(), user.ID, id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	if r.Header.Get("X-Expected-Version") != "" {
+		if strconv.FormatInt(int64(strategy.Version), 10) != r.Header.Get("X-Expected-Version") {
+			app.editConflictResponse(w, r)
+			return
+		}
+	}
+
+	var input struct {
+		Description *string  `json:"description"`
+		Tags        []string `json:"tags"`
+		FolderID    *int64   `json:"folder_id"`
+	}
+
+	err = app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	if input.Description != nil {
+		strategy.Description = *input.Description
+	}
+	if input.Tags != nil {
+		strategy.Tags = data.NormalizeTags(input.Tags)
+	}
+	if input.FolderID != nil {
+		strategy.FolderID = input.FolderID
+		if *input.FolderID == 0 {
+			strategy.FolderID = nil
+		}
+	}
+
+	v := validator.New()
+	if data.ValidateStrategyDetails(v, strategy); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	// The foreign key only checks the folder exists, not whose it is
+	if strategy.FolderID != nil {
+		_, err = app.models.Folders.Get(r.Context(), user.ID, *strategy.FolderID)
+		if err != nil {
+			switch {
+			case errors.Is(err, data.ErrRecordNotFound):
+				v.AddError("folder_id", "must be one of your folders")
+				app.failedValidationResponse(w, r, v.Errors)
+			default:
+				app.serverErrorResponse(w, r, err)
+			}
+			return
+		}
+	}
+
+	err = app.models.Strategies.Update(r.Context(), user.ID, strategy)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrEditConflict):
+			app.editConflictResponse(w, r)
+		case errors.Is(err, data.ErrForeignKeyViolation):
+			// The folder was deleted after it was checked
+			v.AddError("folder_id", "must be one of your folders")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.dispatchWebhookEvent(r.Context(), app.models, user.ID, data.EventStrategyUpdated, envelope{"strategy": strategy})
+	if err != nil {
+		app.logError(r, err)
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"strategy": strategy}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
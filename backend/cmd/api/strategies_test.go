@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+	"testing"
+
+	"github.com/lyttonliao/StratCheck/internal/data"
+)
+
+func TestUpdateStrategyDetailsNotFound(t *testing.T) {
+	app, transport := newTestApplication(t)
+	ts := newTestServer(t, app.routes())
+
+	token := newActivatedUser(t, app, transport, ts, "alice@example.com")
+
+	input := map[string]string{"description": "mean reversion"}
+
+	if code := ts.do(t, http.MethodPatch, "/v1/strategies/999/details", token, nil, input, nil); code != http.StatusNotFound {
+		t.Errorf("unknown strategy: got status %d; want %d", code, http.StatusNotFound)
+	}
+}
+
+func TestUpdateStrategyDetailsVersionConflict(t *testing.T) {
+	app, transport := newTestApplication(t)
+	ts := newTestServer(t, app.routes())
+
+	token := newActivatedUser(t, app, transport, ts, "alice@example.com")
+
+	user, err := app.models.Users.GetByEmail(context.Background(), "alice@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	strategy := &data.Strategy{
+		Name:     "Crossover",
+		Fields:   []string{"close"},
+		Criteria: []string{"sma(10) > sma(50)"},
+	}
+
+	err = app.models.Strategies.Insert(context.Background(), user.ID, strategy)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	path := "/v1/strategies/" + strconv.FormatInt(strategy.ID, 10) + "/details"
+	header := http.Header{"X-Expected-Version": {strconv.Itoa(int(strategy.Version))}}
+
+	code := ts.do(t, http.MethodPatch, path, token, header, map[string]string{"description": "first"}, nil)
+	if code != http.StatusOK {
+		t.Fatalf("first update: got status %d; want %d", code, http.StatusOK)
+	}
+
+	// The first update moved the strategy on to the next version
+	code = ts.do(t, http.MethodPatch, path, token, header, map[string]string{"description": "second"}, nil)
+	if code != http.StatusConflict {
+		t.Errorf("stale update: got status %d; want %d", code, http.StatusConflict)
+	}
+
+	// A stale copy is refused by the model too, not only by the header check
+	stale := *strategy
+	stale.Description = "third"
+
+	err = app.models.Strategies.Update(context.Background(), user.ID, &stale)
+	if !errors.Is(err, data.ErrEditConflict) {
+		t.Errorf("got %v updating a stale strategy; want ErrEditConflict", err)
+	}
+}
+
+// The name, fields and criteria belong to the Backtrader service, so a strategy it stored without
+// them can still have its details changed
+func TestUpdateStrategyDetailsOnlyValidatesDetails(t *testing.T) {
+	app, transport := newTestApplication(t)
+	ts := newTestServer(t, app.routes())
+
+	token := newActivatedUser(t, app, transport, ts, "alice@example.com")
+
+	user, err := app.models.Users.GetByEmail(context.Background(), "alice@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	strategy := &data.Strategy{Name: "Draft"}
+
+	err = app.models.Strategies.Insert(context.Background(), user.ID, strategy)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	path := "/v1/strategies/" + strconv.FormatInt(strategy.ID, 10) + "/details"
+
+	input := map[string]interface{}{"description": "work in progress", "tags": []string{"FX", "crypto"}}
+
+	code := ts.do(t, http.MethodPatch, path, token, nil, input, nil)
+	if code != http.StatusOK {
+		t.Fatalf("got status %d; want %d", code, http.StatusOK)
+	}
+
+	var body errorBody
+
+	input = map[string]interface{}{"folder_id": -1}
+
+	code = ts.do(t, http.MethodPatch, path, token, nil, input, &body)
+	if code != http.StatusUnprocessableEntity {
+		t.Fatalf("negative folder: got status %d; want %d", code, http.StatusUnprocessableEntity)
+	}
+
+	if len(body.Error) != 1 || body.Error["folder_id"] == "" {
+		t.Errorf("got errors %v; want only folder_id", body.Error)
+	}
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/julienschmidt/httprouter"
+
+	"github.com/lyttonliao/StratCheck/internal/data"
+	"github.com/lyttonliao/StratCheck/internal/validator"
+)
+
+func (app *application) listTagsHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.contextGetUser(r)
+
+	tags, err := app.models.Strategies.GetTags(r.Context(), user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"tags": tags}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// renameTagHandler() renames a tag on all of the user's strategies. Renaming it to a tag that's
+// already in use merges the two
+func (app *application) renameTagHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Name string `json:"name"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	tag := httprouter.ParamsFromContext(r.Context()).ByName("tag")
+	newTag := data.NormalizeTags([]string{input.Name})[0]
+
+	v := validator.New()
+	if data.ValidateTag(v, "name", newTag); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	user := app.contextGetUser(r)
+
+	changed, err := app.models.Strategies.RenameTag(r.Context(), user.ID, tag, newTag)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	if changed == 0 {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"tag": newTag, "strategies": changed}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) deleteTagHandler(w http.ResponseWriter, r *http.Request) {
+	tag := httprouter.ParamsFromContext(r.Context()).ByName("tag")
+
+	user := app.contextGetUser(r)
+
+	changed, err := app.models.Strategies.DeleteTag(r.Context(), user.ID, tag)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	if changed == 0 {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"message": "tag successfully removed", "strategies": changed}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
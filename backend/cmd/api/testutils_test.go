@@ -0,0 +1,167 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/lyttonliao/StratCheck/internal/data/memory"
+	"github.com/lyttonliao/StratCheck/internal/egress"
+	"github.com/lyttonliao/StratCheck/internal/jsonlog"
+	"github.com/lyttonliao/StratCheck/internal/mailer"
+	"github.com/lyttonliao/StratCheck/internal/ratelimit"
+)
+
+// newTestApplication() returns an application backed by the in-memory models, with emails kept by
+// the capture transport returned alongside it
+func newTestApplication(t *testing.T) (*application, *mailer.CaptureTransport) {
+	t.Helper()
+
+	transport := mailer.NewCaptureTransport()
+
+	mail, err := mailer.New(transport, "StratCheck <no-reply@stratcheck.test>", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var cfg config
+	cfg.env = "testing"
+	cfg.baseURL = "http://stratcheck.test"
+	cfg.limiter.enabled = true
+	cfg.password.MinLength = 8
+	cfg.outbox.batchSize = 20
+	cfg.outbox.maxAttempts = 3
+	cfg.jwt.keyFile = newTestKeyFile(t)
+
+	guard := &egress.Guard{}
+
+	app := &application{
+		config:        cfg,
+		logger:        jsonlog.New(io.Discard, jsonlog.LevelOff),
+		models:        memory.NewModels(),
+		mailer:        mail,
+		limiter:       ratelimit.NewMemoryLimiter(),
+		policies:      ratelimit.DefaultPolicies(100, 100),
+		shutdown:      make(chan struct{}),
+		cursorKey:     []byte("test-cursor-key"),
+		egress:        guard,
+		webhookClient: guard.Client(time.Second),
+	}
+
+	return app, transport
+}
+
+// newTestKeyFile() writes a new EC private key for signing the jwt cookie
+func newTestKeyFile(t *testing.T) string {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(t.TempDir(), "id_ecdsa")
+
+	err = os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return path
+}
+
+type testServer struct {
+	*httptest.Server
+}
+
+func newTestServer(t *testing.T, h http.Handler) *testServer {
+	ts := httptest.NewServer(h)
+	t.Cleanup(ts.Close)
+
+	return &testServer{ts}
+}
+
+// do() sends a request with body encoded as JSON, authenticated with token if it isn't empty, and
+// decodes the response into dst
+func (ts *testServer) do(t *testing.T, method, path, token string, header http.Header, body, dst interface{}) int {
+	t.Helper()
+
+	var buf bytes.Buffer
+
+	if body != nil {
+		err := json.NewEncoder(&buf).Encode(body)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	req, err := http.NewRequest(method, ts.URL+path, &buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for key, values := range header {
+		req.Header[key] = values
+	}
+
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	res, err := ts.Client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+
+	if dst != nil {
+		err = json.NewDecoder(res.Body).Decode(dst)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return res.StatusCode
+}
+
+var activationTokenRX = regexp.MustCompile(`token=([A-Z0-9]{26})`)
+
+// activationToken() delivers the queued emails and returns the activation token in the last one
+func activationToken(t *testing.T, app *application, transport *mailer.CaptureTransport) string {
+	t.Helper()
+
+	err := app.deliverEmails(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	messages := transport.Messages()
+	if len(messages) == 0 {
+		t.Fatal("no email was sent")
+	}
+
+	match := activationTokenRX.FindStringSubmatch(messages[len(messages)-1].PlainBody)
+	if match == nil {
+		t.Fatal("email doesn't contain an activation token")
+	}
+
+	return match[1]
+}
@@ -3,6 +3,7 @@ package main
 import (
 	"errors"
 	"net/http"
+	"net/url"
 	"time"
 
 	"github.com/lyttonliao/StratCheck/internal/cookies"
@@ -10,8 +11,6 @@ import (
 	"github.com/lyttonliao/StratCheck/internal/validator"
 )
 
-var secretKeyData []byte
-
 func (app *application) createAuthenticationTokenHandler(w http.ResponseWriter, r *http.Request) {
 	var input struct {
 		Email    string `json:"email"`
@@ -34,7 +33,7 @@ func (app *application) createAuthenticationTokenHandler(w http.ResponseWriter,
 		return
 	}
 
-	user, err := app.models.Users.GetByEmail(input.Email)
+	user, err := app.models.Users.GetByEmail(r.Context(), input.Email)
 	if err != nil {
 		switch {
 		case errors.Is(err, data.ErrRecordNotFound):
@@ -56,13 +55,13 @@ func (app *application) createAuthenticationTokenHandler(w http.ResponseWriter,
 		return
 	}
 
-	token, err := app.models.Tokens.New(user.ID, 24*time.Hour, data.ScopeAuthentication)
+	token, err := app.models.Tokens.New(r.Context(), user.ID, 24*time.Hour, data.ScopeAuthentication)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 		return
 	}
 
-	secretKeyData, err = app.readFile("C:/Users/xlord/.ssh/id_ecdsa")
+	secretKeyData, err := app.readFile(app.config.jwt.keyFile)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 		return
@@ -105,7 +104,7 @@ func (app *application) createPasswordResetTokenHandler(w http.ResponseWriter, r
 		app.failedValidationResponse(w, r, v.Errors)
 	}
 
-	user, err := app.models.Users.GetByEmail(input.Email)
+	user, err := app.models.Users.GetByEmail(r.Context(), input.Email)
 	if err != nil {
 		switch {
 		case errors.Is(err, data.ErrRecordNotFound):
@@ -122,27 +121,103 @@ func (app *application) createPasswordResetTokenHandler(w http.ResponseWriter, r
 		return
 	}
 
-	token, err := app.models.Tokens.New(user.ID, 45*time.Minute, data.ScopePasswordReset)
+	err = app.models.WithTx(r.Context(), func(tx data.Models) error {
+		token, err := tx.Tokens.New(r.Context(), user.ID, 45*time.Minute, data.ScopePasswordReset)
+		if err != nil {
+			return err
+		}
+
+		return app.enqueueEmail(r.Context(), tx, user.Email, user.Preferences.Language, "token_password_reset.tmpl", map[string]interface{}{
+			"passwordResetToken": token.Plaintext,
+		})
+	})
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 		return
 	}
 
-	app.background(func() {
-		data := map[string]interface{}{
-			"passwordResetToken": token.Plaintext,
+	env := envelope{"message": "an email will be sent to you containing password reset instructions"}
+
+	err = app.writeJSON(w, http.StatusAccepted, env, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// Activation tokens expire after 3 days and the welcome email may never arrive, so unactivated
+// users can ask for a new one. At most 3 are sent per hour to stop this being used to spam an inbox
+func (app *application) createActivationTokenHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Email string `json:"email"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+
+	if data.ValidateEmail(v, input.Email); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	user, err := app.models.Users.GetByEmail(r.Context(), input.Email)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			v.AddError("email", "no matching email address found")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
 		}
+		return
+	}
+
+	if user.Activated {
+		v.AddError("email", "user has already been activated")
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	count, err := app.models.Tokens.CountCreatedSince(r.Context(), data.ScopeActivation, user.ID, time.Now().Add(-time.Hour))
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
 
-		err = app.mailer.Send(user.Email, "token_password_reset.tmpl", data)
+	if count >= 3 {
+		app.rateLimitExceededResponse(w, r)
+		return
+	}
+
+	err = app.models.WithTx(r.Context(), func(tx data.Models) error {
+		token, err := tx.Tokens.New(r.Context(), user.ID, 3*24*time.Hour, data.ScopeActivation)
 		if err != nil {
-			app.logger.PrintError(err, nil)
+			return err
 		}
+
+		return app.enqueueEmail(r.Context(), tx, user.Email, user.Preferences.Language, "token_activation.tmpl", map[string]interface{}{
+			"activationToken": token.Plaintext,
+			"activationURL":   app.activationURL(token.Plaintext),
+		})
 	})
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
 
-	env := envelope{"message": "an email will be sent to you containing password reset instructions"}
+	env := envelope{"message": "an email will be sent to you containing activation instructions"}
 
 	err = app.writeJSON(w, http.StatusAccepted, env, nil)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 	}
 }
+
+// activationURL() returns the link to the activation page for a token
+func (app *application) activationURL(tokenPlaintext string) string {
+	return app.config.baseURL + "/v1/users/activate?token=" + url.QueryEscape(tokenPlaintext)
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+
+	"github.com/felixge/httpsnoop"
+
+	"github.com/lyttonliao/StratCheck/internal/jsonlog"
+	"github.com/lyttonliao/StratCheck/internal/tracing"
+)
+
+// newTracer() builds the tracer selected by the -tracing-exporter flag, or returns nil when
+// tracing is turned off
+func newTracer(cfg config, logger *jsonlog.Logger) (*tracing.Tracer, error) {
+	var exporter tracing.Exporter
+
+	switch cfg.tracing.exporter {
+	case "none":
+		return nil, nil
+	case "stdout":
+		exporter = tracing.NewStdoutExporter(os.Stdout)
+	case "otlp":
+		exporter = tracing.NewOTLPExporter(cfg.tracing.endpoint, cfg.tracing.serviceName)
+	default:
+		return nil, fmt.Errorf("unknown tracing exporter %q", cfg.tracing.exporter)
+	}
+
+	onError := func(err error) {
+		logger.PrintWarn("unable to export spans: "+err.Error(), nil)
+	}
+
+	return tracing.New(exporter, cfg.tracing.sampleRatio, onError), nil
+}
+
+// trace() starts the server span every other span of a request nests under, continuing the
+// caller's trace when it sent a traceparent header
+func (app *application) trace(router *routeTable, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		route := router.pattern(r)
+
+		ctx := tracing.Extract(r.Context(), r.Header)
+		ctx, span := tracing.Start(ctx, fmt.Sprintf("%s %s", r.Method, route), tracing.KindServer)
+		defer span.End()
+
+		span.SetAttribute("http.method", r.Method)
+		span.SetAttribute("http.route", route)
+		span.SetAttribute("http.target", r.URL.String())
+		span.SetAttribute("request_id", app.contextGetRequestID(r))
+
+		metrics := httpsnoop.CaptureMetrics(next, w, r.WithContext(ctx))
+
+		span.SetAttribute("http.status_code", metrics.Code)
+		if metrics.Code >= 500 {
+			span.SetError(fmt.Errorf("%s", http.StatusText(metrics.Code)))
+		}
+	})
+}
+
+// traceMiddleware() records a span named after a middleware, covering it and the handlers after it
+func (app *application) traceMiddleware(name string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx, span := tracing.Start(r.Context(), name, tracing.KindInternal)
+		defer span.End()
+
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
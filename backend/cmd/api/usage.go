@@ -0,0 +1,157 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/lyttonliao/StratCheck/internal/data"
+	"github.com/lyttonliao/StratCheck/internal/jsonlog"
+	"github.com/lyttonliao/StratCheck/internal/ratelimit"
+)
+
+// startBacktestRun() answers a backtest.started event, which the Backtrader service sends before
+// it runs a backtest, since backtests are started there rather than through the API. If the user
+// has quota left the run is recorded and returned with 201, and its ID must come back in the
+// run_id of the completion event. Otherwise the response is 402 or 429 and the service must not
+// start the backtest
+func (app *application) startBacktestRun(w http.ResponseWriter, r *http.Request, user *data.User) {
+	// Every event comes from the Backtrader service, so submissions are limited per user rather
+	// than by the route they arrive on
+	if app.config.limiter.enabled {
+		policy := app.policies.For(ratelimit.GroupBacktestSubmit, user.Plan)
+		key := fmt.Sprintf("%s:user:%d", ratelimit.GroupBacktestSubmit, user.ID)
+
+		if !app.allowRequest(w, r, key, policy.Rate()) {
+			return
+		}
+	}
+
+	plan, err := app.models.Plans.Get(r.Context(), user.Plan)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	var run *data.BacktestRun
+
+	// Start() locks the user's row until the transaction ends, so the usage is checked without
+	// another run being reserved at the same time. Rolling back gives the slot up again
+	err = app.models.WithTx(r.Context(), func(tx data.Models) error {
+		run, err = tx.BacktestRuns.Start(r.Context(), user.ID, plan.Quota.MaxConcurrentRuns)
+		if err != nil {
+			return err
+		}
+
+		usage, err := tx.Usage.Get(r.Context(), user.ID, data.UsagePeriod(time.Now()))
+		if err != nil {
+			return err
+		}
+
+		if usage.Exceeds(plan.Quota) {
+			return data.ErrQuotaExceeded
+		}
+
+		return nil
+	})
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrTooManyRuns):
+			app.tooManyRunsResponse(w, r)
+		case errors.Is(err, data.ErrQuotaExceeded):
+			app.quotaExceededResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusCreated, envelope{"run": run}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// recordBacktestUsage() finishes the run a backtest.completed or backtest.failed event refers to
+// and charges its compute to the usage ledger. createEventHandler() has already checked that the
+// event has a run_id
+func (app *application) recordBacktestUsage(r *http.Request, e event) error {
+	runID, _ := e.Data["run_id"].(float64)
+
+	computeSeconds, _ := e.Data["compute_seconds"].(float64)
+	bars, _ := e.Data["bars_processed"].(float64)
+
+	run := &data.BacktestRun{
+		ID:             int64(runID),
+		UserID:         e.UserID,
+		Status:         data.RunCompleted,
+		ComputeSeconds: computeSeconds,
+		BarsProcessed:  int64(bars),
+	}
+
+	if e.Type == data.EventBacktestFailed {
+		run.Status = data.RunFailed
+	}
+
+	err := app.models.WithTx(r.Context(), func(tx data.Models) error {
+		err := tx.BacktestRuns.Finish(r.Context(), run)
+		if err != nil {
+			return err
+		}
+
+		return tx.Usage.Add(r.Context(), run)
+	})
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			// Already finished, or expired by the janitor, so it mustn't be charged again
+			app.requestLogger(r).PrintWarn("event for unknown or finished backtest run", jsonlog.Properties{
+				"run_id":  run.ID,
+				"user_id": run.UserID,
+			})
+			return nil
+		default:
+			return err
+		}
+	}
+
+	return nil
+}
+
+// showUsageHandler() shows the user's consumption this month against their plan's quota
+func (app *application) showUsageHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.contextGetUser(r)
+
+	plan, err := app.models.Plans.Get(r.Context(), user.Plan)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	usage, err := app.models.Usage.Get(r.Context(), user.ID, data.UsagePeriod(time.Now()))
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	running, err := app.models.BacktestRuns.CountRunning(r.Context(), user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	env := envelope{
+		"plan":             plan.Code,
+		"usage":            usage,
+		"running":          running,
+		"limits":           plan.Quota,
+		"exceeded":         usage.Exceeds(plan.Quota),
+		"period_resets_at": usage.Period.AddDate(0, 1, 0),
+	}
+
+	err = app.writeJSON(w, http.StatusOK, env, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
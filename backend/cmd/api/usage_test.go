@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"testing"
+
+	"github.com/lyttonliao/StratCheck/internal/ratelimit"
+)
+
+const testEventsSecret = "test-events-secret"
+
+// postEvent() sends an event as the Backtrader service
+func postEvent(t *testing.T, ts *testServer, input map[string]interface{}, dst interface{}) int {
+	t.Helper()
+
+	header := http.Header{"X-Events-Secret": {testEventsSecret}}
+
+	return ts.do(t, http.MethodPost, "/v1/events", "", header, input, dst)
+}
+
+func TestBacktestStartedIsRateLimitedPerUser(t *testing.T) {
+	app, transport := newTestApplication(t)
+	app.config.events.secret = testEventsSecret
+	app.policies.Groups[ratelimit.GroupBacktestSubmit] = ratelimit.Policy{PerSecond: 1.0 / 60, Burst: 1, Key: ratelimit.KeyUser}
+
+	ts := newTestServer(t, app.routes())
+
+	newActivatedUser(t, app, transport, ts, "alice@example.com")
+	newActivatedUser(t, app, transport, ts, "bob@example.com")
+
+	var ids []int64
+
+	for _, email := range []string{"alice@example.com", "bob@example.com"} {
+		user, err := app.models.Users.GetByEmail(context.Background(), email)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// The pro plan has room for more than one run, so only the rate limit refuses a second one
+		err = app.models.Plans.SetForUser(context.Background(), user.ID, "pro")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		ids = append(ids, user.ID)
+	}
+
+	started := map[string]interface{}{"type": "backtest.started", "user_id": ids[0]}
+
+	if code := postEvent(t, ts, started, nil); code != http.StatusCreated {
+		t.Fatalf("first start: got status %d; want %d", code, http.StatusCreated)
+	}
+
+	if code := postEvent(t, ts, started, nil); code != http.StatusTooManyRequests {
+		t.Errorf("second start: got status %d; want %d", code, http.StatusTooManyRequests)
+	}
+
+	// Every event comes from the same service, but each user has their own bucket
+	started["user_id"] = ids[1]
+
+	if code := postEvent(t, ts, started, nil); code != http.StatusCreated {
+		t.Errorf("start for another user: got status %d; want %d", code, http.StatusCreated)
+	}
+}
+
+func TestBacktestUsageIsChargedToReservedRuns(t *testing.T) {
+	app, transport := newTestApplication(t)
+	app.config.events.secret = testEventsSecret
+
+	ts := newTestServer(t, app.routes())
+
+	newActivatedUser(t, app, transport, ts, "alice@example.com")
+
+	user, err := app.models.Users.GetByEmail(context.Background(), "alice@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A completed backtest that was never reserved can't be charged to anything
+	completed := map[string]interface{}{
+		"type":    "backtest.completed",
+		"user_id": user.ID,
+		"data":    map[string]interface{}{"compute_seconds": 3600},
+	}
+
+	if code := postEvent(t, ts, completed, nil); code != http.StatusUnprocessableEntity {
+		t.Errorf("completed without a run: got status %d; want %d", code, http.StatusUnprocessableEntity)
+	}
+
+	var body struct {
+		Run struct {
+			ID int64 `json:"id"`
+		} `json:"run"`
+	}
+
+	started := map[string]interface{}{"type": "backtest.started", "user_id": user.ID}
+
+	if code := postEvent(t, ts, started, &body); code != http.StatusCreated {
+		t.Fatalf("start: got status %d; want %d", code, http.StatusCreated)
+	}
+
+	// The free plan's monthly compute is used up by this run
+	completed["data"] = map[string]interface{}{"run_id": body.Run.ID, "compute_seconds": 3600}
+
+	if code := postEvent(t, ts, completed, nil); code != http.StatusAccepted {
+		t.Fatalf("completed: got status %d; want %d", code, http.StatusAccepted)
+	}
+
+	if code := postEvent(t, ts, started, nil); code != http.StatusPaymentRequired {
+		t.Errorf("start over quota: got status %d; want %d", code, http.StatusPaymentRequired)
+	}
+
+	// The refused start didn't keep a slot
+	running, err := app.models.BacktestRuns.CountRunning(context.Background(), user.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if running != 0 {
+		t.Errorf("got %d running backtests; want 0", running)
+	}
+}
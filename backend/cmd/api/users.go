@@ -1,8 +1,11 @@
 package main
 
 import (
+	"context"
 	"errors"
 	"net/http"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/lyttonliao/StratCheck/internal/data"
@@ -23,11 +26,14 @@ func (app *application) registerUserHandler(w http.ResponseWriter, r *http.Reque
 	}
 
 	user := &data.User{
-		Name:      input.Name,
-		Email:     input.Email,
-		Activated: false,
+		Name:        input.Name,
+		Email:       input.Email,
+		Activated:   false,
+		Preferences: data.DefaultPreferences(),
 	}
 
+	user.Preferences.Language = app.readLanguage(r)
+
 	err = user.Password.Set(input.Password)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
@@ -35,12 +41,43 @@ func (app *application) registerUserHandler(w http.ResponseWriter, r *http.Reque
 	}
 
 	v := validator.New()
-	if data.ValidateUser(v, user); !v.Valid() {
+	data.ValidateUser(v, user)
+
+	err = app.config.password.Check(v, input.Password, user.Name, user.Email)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	if !v.Valid() {
 		app.failedValidationResponse(w, r, v.Errors)
 		return
 	}
 
-	err = app.models.Users.Insert(user)
+	// The user, their permissions, activation token and welcome email are written together, so a
+	// failure can't leave an account behind that never receives its activation email
+	err = app.models.WithTx(r.Context(), func(tx data.Models) error {
+		err := tx.Users.Insert(r.Context(), user)
+		if err != nil {
+			return err
+		}
+
+		err = tx.Permissions.AddForUser(r.Context(), user.ID, "strategies:read")
+		if err != nil {
+			return err
+		}
+
+		token, err := tx.Tokens.New(r.Context(), user.ID, 3*24*time.Hour, data.ScopeActivation)
+		if err != nil {
+			return err
+		}
+
+		return app.enqueueEmail(r.Context(), tx, user.Email, user.Preferences.Language, "user_welcome.tmpl", map[string]interface{}{
+			"activationToken": token.Plaintext,
+			"activationURL":   app.activationURL(token.Plaintext),
+			"userID":          user.ID,
+		})
+	})
 	if err != nil {
 		switch {
 		case errors.Is(err, data.ErrDuplicateEmail):
@@ -52,39 +89,84 @@ func (app *application) registerUserHandler(w http.ResponseWriter, r *http.Reque
 		return
 	}
 
-	err = app.models.Permissions.AddForUser(user.ID, "strategies:read")
+	err = app.writeJSON(w, http.StatusAccepted, envelope{"user": user}, nil)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
-		return
 	}
+}
 
-	token, err := app.models.Tokens.New(user.ID, 3*24*time.Hour, data.ScopeActivation)
+// Change user activation towards the end, page 559
+func (app *application) activateUserHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		TokenPlaintext string `json:"token"`
+	}
+
+	err := app.readJSON(w, r, &input)
 	if err != nil {
-		app.serverErrorResponse(w, r, err)
+		app.badRequestResponse(w, r, err)
 		return
 	}
 
-	app.background(func() {
-		data := map[string]interface{}{
-			"activationToken": token.Plaintext,
-			"userID":          user.ID,
+	v := validator.New()
+
+	if data.ValidateTokenPlaintext(v, input.TokenPlaintext); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	user, err := app.models.Users.GetForToken(r.Context(), data.ScopeActivation, input.TokenPlaintext)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			v.AddError("token", "invalid or expired activation token")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
 		}
+		return
+	}
 
-		err = app.mailer.Send(user.Email, "user_welcome.tmpl", data)
-		if err != nil {
-			app.logger.PrintError(err, nil)
+	err = app.activateUser(r.Context(), user)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrEditConflict):
+			app.editConflictResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
 		}
-	})
+		return
+	}
 
-	err = app.writeJSON(w, http.StatusAccepted, envelope{"user": user}, nil)
+	err = app.writeJSON(w, http.StatusOK, envelope{"user": user}, nil)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 	}
 }
 
-// Change user activation towards the end, page 559
-func (app *application) activateUserHandler(w http.ResponseWriter, r *http.Request) {
+// activateUser() is shared by the JSON endpoint and the activation page, it grants the user
+// write access and invalidates any remaining activation tokens. The steps share a transaction, so
+// an edit conflict can't leave a user with write access who isn't activated
+func (app *application) activateUser(ctx context.Context, user *data.User) error {
+	user.Activated = true
+
+	return app.models.WithTx(ctx, func(tx data.Models) error {
+		err := tx.Permissions.AddForUser(ctx, user.ID, "strategies:write")
+		if err != nil {
+			return err
+		}
+
+		err = tx.Users.Update(ctx, user)
+		if err != nil {
+			return err
+		}
+
+		return tx.Tokens.DeleteAllForUser(ctx, data.ScopeActivation, user.ID)
+	})
+}
+
+func (app *application) updateUserPasswordHandler(w http.ResponseWriter, r *http.Request) {
 	var input struct {
+		Password       string `json:"password"`
 		TokenPlaintext string `json:"token"`
 	}
 
@@ -95,17 +177,19 @@ func (app *application) activateUserHandler(w http.ResponseWriter, r *http.Reque
 	}
 
 	v := validator.New()
+	data.ValidatePasswordPlaintext(v, input.Password)
+	data.ValidateTokenPlaintext(v, input.TokenPlaintext)
 
-	if data.ValidateTokenPlaintext(v, input.TokenPlaintext); !v.Valid() {
+	if !v.Valid() {
 		app.failedValidationResponse(w, r, v.Errors)
 		return
 	}
 
-	user, err := app.models.Users.GetForToken(data.ScopeActivation, input.TokenPlaintext)
+	user, err := app.models.Users.GetForToken(r.Context(), data.ScopePasswordReset, input.TokenPlaintext)
 	if err != nil {
 		switch {
 		case errors.Is(err, data.ErrRecordNotFound):
-			v.AddError("token", "invalid or expired activation token")
+			v.AddError("token", "invalid or expired password reset token")
 			app.failedValidationResponse(w, r, v.Errors)
 		default:
 			app.serverErrorResponse(w, r, err)
@@ -113,15 +197,33 @@ func (app *application) activateUserHandler(w http.ResponseWriter, r *http.Reque
 		return
 	}
 
-	user.Activated = true
+	err = app.config.password.Check(v, input.Password, user.Name, user.Email)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
 
-	err = app.models.Permissions.AddForUser(user.ID, "strategies:write")
+	err = user.Password.Set(input.Password)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 		return
 	}
 
-	err = app.models.Users.Update(user)
+	// Changing the password and using up the reset tokens happen together, so a token can never
+	// be used twice and a failed reset never leaves the tokens deleted
+	err = app.models.WithTx(r.Context(), func(tx data.Models) error {
+		err := tx.Users.Update(r.Context(), user)
+		if err != nil {
+			return err
+		}
+
+		return tx.Tokens.DeleteAllForUser(r.Context(), data.ScopePasswordReset, user.ID)
+	})
 	if err != nil {
 		switch {
 		case errors.Is(err, data.ErrEditConflict):
@@ -132,9 +234,104 @@ func (app *application) activateUserHandler(w http.ResponseWriter, r *http.Reque
 		return
 	}
 
-	err = app.models.Tokens.DeleteAllForUser(data.ScopeActivation, user.ID)
+	env := envelope{"message": "your password was successfully reset"}
+
+	err = app.writeJSON(w, http.StatusOK, env, nil)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) showCurrentUserHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.contextGetUser(r)
+
+	err := app.writeJSON(w, http.StatusOK, envelope{"user": user}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) updateCurrentUserHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.contextGetUser(r)
+
+	if r.Header.Get("X-Expected-Version") != "" {
+		if strconv.FormatInt(int64(user.Version), 10) != r.Header.Get("X-Expected-Version") {
+			app.editConflictResponse(w, r)
+			return
+		}
+	}
+
+	var input struct {
+		Name        *string `json:"name"`
+		Preferences *struct {
+			Language      *string `json:"language"`
+			Timezone      *string `json:"timezone"`
+			Notifications *struct {
+				Email      *bool    `json:"email"`
+				Digest     *bool    `json:"digest"`
+				WebhookURL *string  `json:"webhook_url"`
+				Events     []string `json:"events"`
+			} `json:"notifications"`
+		} `json:"preferences"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	previousWebhookURL := user.Preferences.Notifications.WebhookURL
+
+	if input.Name != nil {
+		user.Name = *input.Name
+	}
+
+	if input.Preferences != nil {
+		if input.Preferences.Language != nil {
+			user.Preferences.Language = *input.Preferences.Language
+		}
+		if input.Preferences.Timezone != nil {
+			user.Preferences.Timezone = *input.Preferences.Timezone
+		}
+
+		if n := input.Preferences.Notifications; n != nil {
+			if n.Email != nil {
+				user.Preferences.Notifications.Email = *n.Email
+			}
+			if n.Digest != nil {
+				user.Preferences.Notifications.Digest = *n.Digest
+			}
+			if n.WebhookURL != nil {
+				user.Preferences.Notifications.WebhookURL = *n.WebhookURL
+			}
+			if n.Events != nil {
+				user.Preferences.Notifications.Events = n.Events
+			}
+		}
+	}
+
+	v := validator.New()
+	if data.ValidateUser(v, user); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	if url := user.Preferences.Notifications.WebhookURL; url != "" && url != previousWebhookURL {
+		if app.checkWebhookURL(r.Context(), v, "preferences.notifications.webhook_url", url); !v.Valid() {
+			app.failedValidationResponse(w, r, v.Errors)
+			return
+		}
+	}
+
+	err = app.models.Users.Update(r.Context(), user)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrEditConflict):
+			app.editConflictResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
 		return
 	}
 
@@ -144,10 +341,12 @@ func (app *application) activateUserHandler(w http.ResponseWriter, r *http.Reque
 	}
 }
 
-func (app *application) updateUserPasswordHandler(w http.ResponseWriter, r *http.Request) {
+// The new address is only stored as pending_email until the token emailed to it is confirmed,
+// so a typo cannot lock the user out of their account
+func (app *application) requestEmailChangeHandler(w http.ResponseWriter, r *http.Request) {
 	var input struct {
-		Password       string `json:"password"`
-		TokenPlaintext string `json:"token"`
+		Email    string `json:"email"`
+		Password string `json:"password"`
 	}
 
 	err := app.readJSON(w, r, &input)
@@ -157,33 +356,219 @@ func (app *application) updateUserPasswordHandler(w http.ResponseWriter, r *http
 	}
 
 	v := validator.New()
-	data.ValidatePasswordPlaintext(v, input.Password)
-	data.ValidateTokenPlaintext(v, input.TokenPlaintext)
+	data.ValidateEmail(v, input.Email)
+	v.Check(input.Password != "", "password", "must be provided")
 
 	if !v.Valid() {
 		app.failedValidationResponse(w, r, v.Errors)
 		return
 	}
 
-	user, err := app.models.Users.GetForToken(data.ScopePasswordReset, input.TokenPlaintext)
+	user := app.contextGetUser(r)
+
+	match, err := user.Password.Matches(input.Password)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	if !match {
+		app.invalidCredentialsResponse(w, r)
+		return
+	}
+
+	if strings.EqualFold(input.Email, user.Email) {
+		v.AddError("email", "must be different from your current email address")
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	_, err = app.models.Users.GetByEmail(r.Context(), input.Email)
+	switch {
+	case err == nil:
+		v.AddError("email", "a user with this email address already exists")
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	case !errors.Is(err, data.ErrRecordNotFound):
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	user.PendingEmail = input.Email
+
+	err = app.models.WithTx(r.Context(), func(tx data.Models) error {
+		err := tx.Users.Update(r.Context(), user)
+		if err != nil {
+			return err
+		}
+
+		// Only the most recent request can be confirmed, any earlier tokens point at a stale address
+		err = tx.Tokens.DeleteAllForUser(r.Context(), data.ScopeEmailChange, user.ID)
+		if err != nil {
+			return err
+		}
+
+		token, err := tx.Tokens.New(r.Context(), user.ID, 24*time.Hour, data.ScopeEmailChange)
+		if err != nil {
+			return err
+		}
+
+		return app.enqueueEmail(r.Context(), tx, user.PendingEmail, user.Preferences.Language, "user_email_change.tmpl", map[string]interface{}{
+			"emailChangeToken": token.Plaintext,
+			"newEmail":         user.PendingEmail,
+		})
+	})
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrEditConflict):
+			app.editConflictResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	env := envelope{"message": "an email will be sent to your new address containing confirmation instructions"}
+
+	err = app.writeJSON(w, http.StatusAccepted, env, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) confirmEmailChangeHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		TokenPlaintext string `json:"token"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+
+	if data.ValidateTokenPlaintext(v, input.TokenPlaintext); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	user, err := app.models.Users.GetForToken(r.Context(), data.ScopeEmailChange, input.TokenPlaintext)
 	if err != nil {
 		switch {
 		case errors.Is(err, data.ErrRecordNotFound):
-			v.AddError("token", "invalid or expired password reset token")
+			v.AddError("token", "invalid or expired email change token")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	if user.PendingEmail == "" {
+		v.AddError("token", "invalid or expired email change token")
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	user.Email = user.PendingEmail
+	user.PendingEmail = ""
+
+	err = app.models.WithTx(r.Context(), func(tx data.Models) error {
+		err := tx.Users.Update(r.Context(), user)
+		if err != nil {
+			return err
+		}
+
+		return tx.Tokens.DeleteAllForUser(r.Context(), data.ScopeEmailChange, user.ID)
+	})
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrDuplicateEmail):
+			v.AddError("email", "a user with this email address already exists")
 			app.failedValidationResponse(w, r, v.Errors)
+		case errors.Is(err, data.ErrEditConflict):
+			app.editConflictResponse(w, r)
 		default:
 			app.serverErrorResponse(w, r, err)
 		}
 		return
 	}
 
+	err = app.writeJSON(w, http.StatusOK, envelope{"user": user}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) changeCurrentUserPasswordHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		CurrentPassword string `json:"current_password"`
+		Password        string `json:"password"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+	v.Check(input.CurrentPassword != "", "current_password", "must be provided")
+	data.ValidatePasswordPlaintext(v, input.Password)
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	user := app.contextGetUser(r)
+
+	if r.Header.Get("X-Expected-Version") != "" {
+		if strconv.FormatInt(int64(user.Version), 10) != r.Header.Get("X-Expected-Version") {
+			app.editConflictResponse(w, r)
+			return
+		}
+	}
+
+	match, err := user.Password.Matches(input.CurrentPassword)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	if !match {
+		app.invalidCredentialsResponse(w, r)
+		return
+	}
+
+	err = app.config.password.Check(v, input.Password, user.Name, user.Email)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
 	err = user.Password.Set(input.Password)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 		return
 	}
 
-	err = app.models.Users.Update(user)
+	err = app.models.WithTx(r.Context(), func(tx data.Models) error {
+		err := tx.Users.Update(r.Context(), user)
+		if err != nil {
+			return err
+		}
+
+		// Outstanding reset links were issued for the old password and should no longer work
+		return tx.Tokens.DeleteAllForUser(r.Context(), data.ScopePasswordReset, user.ID)
+	})
 	if err != nil {
 		switch {
 		case errors.Is(err, data.ErrEditConflict):
@@ -194,15 +579,96 @@ func (app *application) updateUserPasswordHandler(w http.ResponseWriter, r *http
 		return
 	}
 
-	err = app.models.Tokens.DeleteAllForUser(data.ScopePasswordReset, user.ID)
+	env := envelope{"message": "your password was successfully changed"}
+
+	err = app.writeJSON(w, http.StatusOK, env, nil)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// Deletion is scheduled rather than immediate so the user can change their mind during the
+// grace period. The purge_deleted_accounts job removes the data once it has passed
+func (app *application) deleteCurrentUserHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Password string `json:"password"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
 		return
 	}
 
-	env := envelope{"message": "your password was successfully reset"}
+	v := validator.New()
 
-	err = app.writeJSON(w, http.StatusOK, env, nil)
+	if v.Check(input.Password != "", "password", "must be provided"); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	user := app.contextGetUser(r)
+
+	match, err := user.Password.Matches(input.Password)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	if !match {
+		app.invalidCredentialsResponse(w, r)
+		return
+	}
+
+	if user.DeletionScheduledAt == nil {
+		scheduledAt := time.Now().Add(app.config.accounts.deletionGrace).Truncate(time.Second)
+		user.DeletionScheduledAt = &scheduledAt
+
+		err = app.models.Users.Update(r.Context(), user)
+		if err != nil {
+			switch {
+			case errors.Is(err, data.ErrEditConflict):
+				app.editConflictResponse(w, r)
+			default:
+				app.serverErrorResponse(w, r, err)
+			}
+			return
+		}
+	}
+
+	env := envelope{
+		"message":               "your account is scheduled for deletion and can be restored until then",
+		"deletion_scheduled_at": user.DeletionScheduledAt,
+	}
+
+	err = app.writeJSON(w, http.StatusAccepted, env, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) cancelCurrentUserDeletionHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.contextGetUser(r)
+
+	if user.DeletionScheduledAt == nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	user.DeletionScheduledAt = nil
+
+	err := app.models.Users.Update(r.Context(), user)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrEditConflict):
+			app.editConflictResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"user": user}, nil)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 	}
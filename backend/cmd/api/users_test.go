@@ -0,0 +1,232 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"testing"
+
+	"github.com/lyttonliao/StratCheck/internal/data"
+	"github.com/lyttonliao/StratCheck/internal/mailer"
+)
+
+type errorBody struct {
+	Error map[string]string `json:"error"`
+}
+
+type userBody struct {
+	User struct {
+		ID        int64  `json:"id"`
+		Email     string `json:"email"`
+		Activated bool   `json:"activated"`
+		Version   int    `json:"version"`
+	} `json:"user"`
+}
+
+const testPassword = "pa55word-horse"
+
+func register(t *testing.T, ts *testServer, email string) int {
+	t.Helper()
+
+	input := map[string]string{"name": "Alice", "email": email, "password": testPassword}
+
+	return ts.do(t, http.MethodPost, "/v1/users", "", nil, input, nil)
+}
+
+func activate(t *testing.T, ts *testServer, token string, dst interface{}) int {
+	t.Helper()
+
+	return ts.do(t, http.MethodPut, "/v1/users/activated", "", nil, map[string]string{"token": token}, dst)
+}
+
+func login(t *testing.T, ts *testServer, email, password string) (string, int) {
+	t.Helper()
+
+	var body struct {
+		AuthenticationToken struct {
+			Token string `json:"token"`
+		} `json:"authentication_token"`
+	}
+
+	input := map[string]string{"email": email, "password": password}
+
+	code := ts.do(t, http.MethodPost, "/v1/tokens/authentication", "", nil, input, &body)
+
+	return body.AuthenticationToken.Token, code
+}
+
+// newActivatedUser() registers and activates a user and returns their authentication token
+func newActivatedUser(t *testing.T, app *application, transport *mailer.CaptureTransport, ts *testServer, email string) string {
+	t.Helper()
+
+	if code := register(t, ts, email); code != http.StatusAccepted {
+		t.Fatalf("register: got status %d; want %d", code, http.StatusAccepted)
+	}
+
+	if code := activate(t, ts, activationToken(t, app, transport), nil); code != http.StatusOK {
+		t.Fatalf("activate: got status %d; want %d", code, http.StatusOK)
+	}
+
+	token, code := login(t, ts, email, testPassword)
+	if code != http.StatusCreated {
+		t.Fatalf("login: got status %d; want %d", code, http.StatusCreated)
+	}
+
+	return token
+}
+
+func TestRegisterActivateLogin(t *testing.T) {
+	app, transport := newTestApplication(t)
+	ts := newTestServer(t, app.routes())
+
+	if code := register(t, ts, "alice@example.com"); code != http.StatusAccepted {
+		t.Fatalf("register: got status %d; want %d", code, http.StatusAccepted)
+	}
+
+	token := activationToken(t, app, transport)
+
+	var activated userBody
+
+	if code := activate(t, ts, token, &activated); code != http.StatusOK {
+		t.Fatalf("activate: got status %d; want %d", code, http.StatusOK)
+	}
+
+	if !activated.User.Activated {
+		t.Error("user isn't activated")
+	}
+
+	// Activation tokens are single use
+	if code := activate(t, ts, token, nil); code != http.StatusUnprocessableEntity {
+		t.Errorf("second activation: got status %d; want %d", code, http.StatusUnprocessableEntity)
+	}
+
+	authToken, code := login(t, ts, "alice@example.com", testPassword)
+	if code != http.StatusCreated {
+		t.Fatalf("login: got status %d; want %d", code, http.StatusCreated)
+	}
+
+	var me userBody
+
+	code = ts.do(t, http.MethodGet, "/v1/users/me", authToken, nil, nil, &me)
+	if code != http.StatusOK {
+		t.Fatalf("show current user: got status %d; want %d", code, http.StatusOK)
+	}
+
+	if me.User.ID != activated.User.ID || me.User.Email != "alice@example.com" {
+		t.Errorf("got user %d %q; want %d %q", me.User.ID, me.User.Email, activated.User.ID, "alice@example.com")
+	}
+
+	if _, code := login(t, ts, "alice@example.com", "wrong-password"); code != http.StatusUnauthorized {
+		t.Errorf("login with wrong password: got status %d; want %d", code, http.StatusUnauthorized)
+	}
+}
+
+func TestRegisterDuplicateEmail(t *testing.T) {
+	app, _ := newTestApplication(t)
+	ts := newTestServer(t, app.routes())
+
+	if code := register(t, ts, "alice@example.com"); code != http.StatusAccepted {
+		t.Fatalf("register: got status %d; want %d", code, http.StatusAccepted)
+	}
+
+	var body errorBody
+
+	input := map[string]string{"name": "Alice", "email": "alice@example.com", "password": testPassword}
+
+	code := ts.do(t, http.MethodPost, "/v1/users", "", nil, input, &body)
+	if code != http.StatusUnprocessableEntity {
+		t.Fatalf("got status %d; want %d", code, http.StatusUnprocessableEntity)
+	}
+
+	if body.Error["email"] != "a user with this email address already exists" {
+		t.Errorf("got error %q for email", body.Error["email"])
+	}
+}
+
+func TestRecordNotFound(t *testing.T) {
+	app, _ := newTestApplication(t)
+	ts := newTestServer(t, app.routes())
+
+	var body errorBody
+
+	if code := activate(t, ts, "Y3QMGX3PJ3WLRL2YRTQGQ6KRHU", &body); code != http.StatusUnprocessableEntity {
+		t.Errorf("activate with unknown token: got status %d; want %d", code, http.StatusUnprocessableEntity)
+	}
+
+	if body.Error["token"] != "invalid or expired activation token" {
+		t.Errorf("got error %q for token", body.Error["token"])
+	}
+
+	if _, code := login(t, ts, "nobody@example.com", testPassword); code != http.StatusUnauthorized {
+		t.Errorf("login with unknown email: got status %d; want %d", code, http.StatusUnauthorized)
+	}
+
+	if code := ts.do(t, http.MethodGet, "/v1/users/me", "Y3QMGX3PJ3WLRL2YRTQGQ6KRHU", nil, nil, nil); code != http.StatusUnauthorized {
+		t.Errorf("unknown authentication token: got status %d; want %d", code, http.StatusUnauthorized)
+	}
+}
+
+func TestUpdateCurrentUserVersionConflict(t *testing.T) {
+	app, transport := newTestApplication(t)
+	ts := newTestServer(t, app.routes())
+
+	token := newActivatedUser(t, app, transport, ts, "alice@example.com")
+
+	var me userBody
+
+	if code := ts.do(t, http.MethodGet, "/v1/users/me", token, nil, nil, &me); code != http.StatusOK {
+		t.Fatalf("show current user: got status %d; want %d", code, http.StatusOK)
+	}
+
+	// Clients read the version from the user to send it back in X-Expected-Version
+	header := http.Header{"X-Expected-Version": {strconv.Itoa(me.User.Version)}}
+
+	var updated userBody
+
+	code := ts.do(t, http.MethodPatch, "/v1/users/me", token, header, map[string]string{"name": "Alicia"}, &updated)
+	if code != http.StatusOK {
+		t.Fatalf("first update: got status %d; want %d", code, http.StatusOK)
+	}
+
+	if updated.User.Version != me.User.Version+1 {
+		t.Errorf("got version %d after the update; want %d", updated.User.Version, me.User.Version+1)
+	}
+
+	code = ts.do(t, http.MethodPatch, "/v1/users/me", token, header, map[string]string{"name": "Ali"}, nil)
+	if code != http.StatusConflict {
+		t.Errorf("stale update: got status %d; want %d", code, http.StatusConflict)
+	}
+}
+
+func TestPurgeRemovesQueuedEmails(t *testing.T) {
+	app, _ := newTestApplication(t)
+	ts := newTestServer(t, app.routes())
+
+	for _, email := range []string{"alice@example.com", "bob@example.com"} {
+		if code := register(t, ts, email); code != http.StatusAccepted {
+			t.Fatalf("register %s: got status %d; want %d", email, code, http.StatusAccepted)
+		}
+	}
+
+	user, err := app.models.Users.GetByEmail(context.Background(), "alice@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = app.models.WithTx(context.Background(), func(tx data.Models) error {
+		return tx.Users.Purge(context.Background(), user.ID)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Only the welcome email queued for bob is left
+	pending, _, err := app.models.EmailOutbox.Backlog(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if pending != 1 {
+		t.Errorf("got %d queued emails after the purge; want 1", pending)
+	}
+}
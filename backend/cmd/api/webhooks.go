@@ -0,0 +1,466 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/lyttonliao/StratCheck/internal/data"
+	"github.com/lyttonliao/StratCheck/internal/egress"
+	"github.com/lyttonliao/StratCheck/internal/jsonlog"
+	"github.com/lyttonliao/StratCheck/internal/validator"
+)
+
+// dispatchWebhookEvent() queues a delivery of the event to each of the user's active webhooks
+// subscribed to it. Pass the models bound to the transaction making the change where there is one
+func (app *application) dispatchWebhookEvent(ctx context.Context, models data.Models, userID int64, event string, eventData interface{}) error {
+	webhooks, err := models.Webhooks.GetAllForUser(ctx, userID, event)
+	if err != nil || len(webhooks) == 0 {
+		return err
+	}
+
+	payload, err := json.Marshal(envelope{
+		"event":      event,
+		"created_at": time.Now().UTC(),
+		"data":       eventData,
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, webhook := range webhooks {
+		err = models.WebhookDeliveries.Insert(ctx, &data.WebhookDelivery{
+			WebhookID: webhook.ID,
+			Event:     event,
+			Payload:   payload,
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// deliverWebhooks() sends the webhook deliveries that are due, retrying failures with the same
+// backoff as the email outbox until the configured number of attempts is reached
+func (app *application) deliverWebhooks(ctx context.Context) error {
+	deliveries, err := app.models.WebhookDeliveries.Claim(ctx, app.config.webhooks.batchSize, 5*time.Minute)
+	if err != nil {
+		return err
+	}
+
+	for _, delivery := range deliveries {
+		result := app.attemptWebhookDelivery(ctx, delivery)
+
+		// Deliveries whose webhook is gone, or whose address isn't allowed, would fail the same
+		// way on every retry
+		dead := delivery.Attempts+1 >= app.config.webhooks.maxAttempts ||
+			errors.Is(result.Err, data.ErrRecordNotFound) || errors.Is(result.Err, egress.ErrForbiddenAddress)
+
+		err = app.models.WebhookDeliveries.Record(ctx, delivery, result, time.Now().Add(retryBackoff(delivery.Attempts+1)), dead)
+		if err != nil {
+			return err
+		}
+
+		if result.Err != nil {
+			properties := jsonlog.Properties{
+				"webhook_id":  delivery.WebhookID,
+				"delivery_id": delivery.ID,
+				"attempts":    delivery.Attempts,
+			}
+
+			if dead {
+				app.contextLogger(ctx).PrintError(errors.New("webhook delivery failed permanently: "+result.Err.Error()), properties)
+			} else {
+				app.contextLogger(ctx).PrintWarn("webhook delivery failed, will retry: "+result.Err.Error(), properties)
+			}
+		}
+	}
+
+	return nil
+}
+
+// attemptWebhookDelivery() looks up where the delivery goes and sends it. A failed lookup is
+// returned as the result, so it is recorded against the delivery and the rest of the batch is
+// still sent
+func (app *application) attemptWebhookDelivery(ctx context.Context, delivery *data.WebhookDelivery) data.DeliveryResult {
+	// Notifications for the URL in the user's preferences have no webhook and go unsigned
+	if delivery.WebhookID == 0 {
+		return app.sendWebhook(delivery.URL, "", delivery)
+	}
+
+	webhook, err := app.models.Webhooks.GetByID(ctx, delivery.WebhookID)
+	if err != nil {
+		return data.DeliveryResult{Err: fmt.Errorf("looking up webhook: %w", err)}
+	}
+
+	return app.sendWebhook(webhook.URL, webhook.Secret, delivery)
+}
+
+// sendWebhook() POSTs the delivery's payload to url. With a secret the X-StratCheck-Signature
+// header holds the time of the attempt and an HMAC-SHA256 of "<time>.<body>" keyed with it, so
+// receivers can check the payload came from us and reject replayed requests
+func (app *application) sendWebhook(url, secret string, delivery *data.WebhookDelivery) data.DeliveryResult {
+	var result data.DeliveryResult
+
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(delivery.Payload))
+	if err != nil {
+		result.Err = err
+		return result
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "StratCheck-Webhooks/"+version)
+	req.Header.Set("X-StratCheck-Event", delivery.Event)
+	req.Header.Set("X-StratCheck-Delivery", strconv.FormatInt(delivery.ID, 10))
+	if secret != "" {
+		req.Header.Set("X-StratCheck-Signature", fmt.Sprintf("t=%s,v1=%s", timestamp, signWebhookPayload(secret, timestamp, delivery.Payload)))
+	}
+
+	start := time.Now()
+
+	res, err := app.webhookClient.Do(req)
+	if err != nil {
+		result.Duration = time.Since(start)
+		result.Err = err
+		return result
+	}
+	defer res.Body.Close()
+
+	// Only the start of the response is kept in the delivery log
+	body, _ := io.ReadAll(io.LimitReader(res.Body, 1024))
+
+	result.Duration = time.Since(start)
+	result.ResponseCode = res.StatusCode
+	result.ResponseBody = string(body)
+
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		result.Err = fmt.Errorf("webhook returned %s", res.Status)
+	}
+
+	return result
+}
+
+func signWebhookPayload(secret, timestamp string, payload []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(payload)
+
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// checkWebhookURL() adds a validation error for key unless the URL's host resolves to addresses
+// webhooks are allowed to reach. The client checks again when connecting, as DNS can change
+func (app *application) checkWebhookURL(ctx context.Context, v *validator.Validator, key, url string) {
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	err := app.egress.CheckURL(ctx, url)
+	if err != nil {
+		switch {
+		case errors.Is(err, egress.ErrForbiddenAddress):
+			v.AddError(key, "must not point to a private or internal address")
+		default:
+			v.AddError(key, "must have a host that can be resolved")
+		}
+	}
+}
+
+func (app *application) createWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		URL    string   `json:"url"`
+		Events []string `json:"events"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	user := app.contextGetUser(r)
+
+	webhook := &data.Webhook{
+		UserID: user.ID,
+		URL:    input.URL,
+		Events: input.Events,
+		Active: true,
+	}
+
+	v := validator.New()
+	if data.ValidateWebhook(v, webhook); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	if app.checkWebhookURL(r.Context(), v, "url", webhook.URL); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	webhook.Secret, err = data.GenerateWebhookSecret()
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.models.Webhooks.Insert(r.Context(), webhook)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	headers := make(http.Header)
+	headers.Set("Location", fmt.Sprintf("/v1/webhooks/%d", webhook.ID))
+
+	// The secret is only ever returned here, so the user has to store it now
+	env := envelope{"webhook": webhook, "secret": webhook.Secret}
+
+	err = app.writeJSON(w, http.StatusCreated, env, headers)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) listWebhooksHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.contextGetUser(r)
+
+	webhooks, err := app.models.Webhooks.GetAllForUser(r.Context(), user.ID, "")
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"webhooks": webhooks}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) showWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	webhook, ok := app.readWebhook(w, r)
+	if !ok {
+		return
+	}
+
+	err := app.writeJSON(w, http.StatusOK, envelope{"webhook": webhook}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) updateWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	webhook, ok := app.readWebhook(w, r)
+	if !ok {
+		return
+	}
+
+	if r.Header.Get("X-Expected-Version") != "" {
+		if strconv.FormatInt(int64(webhook.Version), 10) != r.Header.Get("X-Expected-Version") {
+			app.editConflictResponse(w, r)
+			return
+		}
+	}
+
+	var input struct {
+		URL    *string  `json:"url"`
+		Events []string `json:"events"`
+		Active *bool    `json:"active"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	if input.URL != nil {
+		webhook.URL = *input.URL
+	}
+	if input.Events != nil {
+		webhook.Events = input.Events
+	}
+	if input.Active != nil {
+		webhook.Active = *input.Active
+	}
+
+	v := validator.New()
+	if data.ValidateWebhook(v, webhook); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	if input.URL != nil {
+		if app.checkWebhookURL(r.Context(), v, "url", webhook.URL); !v.Valid() {
+			app.failedValidationResponse(w, r, v.Errors)
+			return
+		}
+	}
+
+	err = app.models.Webhooks.Update(r.Context(), webhook)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrEditConflict):
+			app.editConflictResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"webhook": webhook}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) deleteWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	user := app.contextGetUser(r)
+
+	err = app.models.Webhooks.Delete(r.Context(), user.ID, id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"message": "webhook successfully deleted"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) listWebhookDeliveriesHandler(w http.ResponseWriter, r *http.Request) {
+	webhook, ok := app.readWebhook(w, r)
+	if !ok {
+		return
+	}
+
+	var input struct {
+		Status string
+		data.Filters
+	}
+
+	v := validator.New()
+	qs := r.URL.Query()
+
+	input.Status = app.readString(qs, "status", "")
+	input.Filters.Page = app.readInt(qs, "page", 1, v)
+	input.Filters.PageSize = app.readInt(qs, "page_size", 20, v)
+	input.Filters.Sort = app.readString(qs, "sort", "-id")
+	input.Filters.Cursor = app.readCursor(qs, "cursor", v)
+	input.Filters.SkipTotal = app.readBool(qs, "skip_total", false, v)
+	input.Filters.SortSafelist = []string{"id", "created_at", "-id", "-created_at"}
+
+	if input.Status != "" {
+		v.Check(validator.In(input.Status, data.DeliveryPending, data.DeliverySucceeded, data.DeliveryFailed), "status", "invalid status value")
+	}
+
+	if data.ValidateFilters(v, input.Filters); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	deliveries, metadata, err := app.models.WebhookDeliveries.GetAllForWebhook(r.Context(), webhook.ID, input.Status, input.Filters)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	app.setCursorLinks(r, &metadata)
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"deliveries": deliveries, "metadata": metadata}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// pingWebhookHandler() sends a ping event to the webhook straight away and returns the outcome, so
+// users can check their receiver and signature verification. Pings are logged but never retried
+func (app *application) pingWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	webhook, ok := app.readWebhook(w, r)
+	if !ok {
+		return
+	}
+
+	payload, err := json.Marshal(envelope{
+		"event":      data.EventPing,
+		"created_at": time.Now().UTC(),
+		"data":       envelope{"webhook_id": webhook.ID},
+	})
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	delivery := &data.WebhookDelivery{
+		WebhookID: webhook.ID,
+		Event:     data.EventPing,
+		Payload:   payload,
+	}
+
+	err = app.models.WebhookDeliveries.Insert(r.Context(), delivery)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	result := app.sendWebhook(webhook.URL, webhook.Secret, delivery)
+
+	err = app.models.WebhookDeliveries.Record(r.Context(), delivery, result, time.Now(), true)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"delivery": delivery}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// readWebhook() fetches the webhook named in the URL, sending a 404 if the current user doesn't own it
+func (app *application) readWebhook(w http.ResponseWriter, r *http.Request) (*data.Webhook, bool) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return nil, false
+	}
+
+	user := app.contextGetUser(r)
+
+	webhook, err := app.models.Webhooks.Get(r.Context(), user.ID, id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return nil, false
+	}
+
+	return webhook, true
+}
@@ -0,0 +1,130 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"regexp"
+
+	"github.com/lib/pq"
+)
+
+var (
+	ErrUniqueViolation     = errors.New("unique violation")
+	ErrForeignKeyViolation = errors.New("foreign key violation")
+	ErrCheckViolation      = errors.New("check violation")
+	// ErrSerializationFailure means the transaction clashed with a concurrent one and was rolled
+	// back, so it is safe to try again
+	ErrSerializationFailure = errors.New("serialization failure")
+	// ErrQueryCanceled means Postgres cancelled the statement, usually because it ran past its
+	// context's deadline or the statement timeout
+	ErrQueryCanceled = errors.New("query canceled")
+)
+
+// ConstraintError is returned when a statement breaks one of the table constraints. It matches its
+// Kind, one of ErrUniqueViolation, ErrForeignKeyViolation or ErrCheckViolation, with errors.Is(),
+// and errors.As() gives the table, constraint and column involved
+type ConstraintError struct {
+	Kind       error
+	Table      string
+	Constraint string
+	// Column is the column, or comma separated columns, the constraint is on. It's empty for check
+	// constraints, which Postgres doesn't report the columns of
+	Column string
+	// Err is the original driver error, if any
+	Err error
+}
+
+func (e *ConstraintError) Error() string {
+	if e.Err != nil {
+		return fmt.Sprintf("%s on %q: %s", e.Kind, e.Constraint, e.Err)
+	}
+
+	return fmt.Sprintf("%s on %q", e.Kind, e.Constraint)
+}
+
+func (e *ConstraintError) Is(target error) bool {
+	return target == e.Kind
+}
+
+func (e *ConstraintError) Unwrap() error {
+	return e.Err
+}
+
+// IsConstraint() reports whether err is a violation of the named constraint
+func IsConstraint(err error, constraint string) bool {
+	var ce *ConstraintError
+	return errors.As(err, &ce) && ce.Constraint == constraint
+}
+
+// keyRX pulls the columns out of the detail of unique and foreign key violations, which reads
+// like `Key (email)=(alice@example.com) already exists.`
+var keyRX = regexp.MustCompile(`^Key \((.+?)\)=`)
+
+// translateError() turns the Postgres errors the application can act on into the errors above,
+// leaving any other error unchanged. Every statement the models run goes through it
+func translateError(err error) error {
+	var pqErr *pq.Error
+	if !errors.As(err, &pqErr) {
+		return err
+	}
+
+	var kind error
+
+	switch pqErr.Code.Name() {
+	case "unique_violation":
+		kind = ErrUniqueViolation
+	case "foreign_key_violation":
+		kind = ErrForeignKeyViolation
+	case "check_violation":
+		kind = ErrCheckViolation
+	case "serialization_failure":
+		return fmt.Errorf("%w: %w", ErrSerializationFailure, err)
+	case "query_canceled":
+		return fmt.Errorf("%w: %w", ErrQueryCanceled, err)
+	default:
+		return err
+	}
+
+	column := pqErr.Column
+	if m := keyRX.FindStringSubmatch(pqErr.Detail); m != nil {
+		column = m[1]
+	}
+
+	return &ConstraintError{
+		Kind:       kind,
+		Table:      pqErr.Table,
+		Constraint: pqErr.Constraint,
+		Column:     column,
+		Err:        err,
+	}
+}
+
+// translatingQuerier passes every error the wrapped querier returns through translateError()
+type translatingQuerier struct {
+	q querier
+}
+
+func (t translatingQuerier) ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error) {
+	result, err := t.q.ExecContext(ctx, query, args...)
+	return result, translateError(err)
+}
+
+func (t translatingQuerier) QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error) {
+	rows, err := t.q.QueryContext(ctx, query, args...)
+	return rows, translateError(err)
+}
+
+func (t translatingQuerier) QueryRowContext(ctx context.Context, query string, args ...interface{}) rowScanner {
+	return translatedRow{t.q.QueryRowContext(ctx, query, args...)}
+}
+
+// translatedRow translates the error of a single row query, which only surfaces from Scan()
+type translatedRow struct {
+	row rowScanner
+}
+
+func (r translatedRow) Scan(dest ...interface{}) error {
+	return translateError(r.row.Scan(dest...))
+}
@@ -1,7 +1,9 @@
 package data
 
 import (
+	"fmt"
 	"math"
+	"slices"
 	"strings"
 
 	"github.com/lyttonliao/StratCheck/internal/validator"
@@ -12,6 +14,11 @@ type Filters struct {
 	PageSize     int
 	Sort         string
 	SortSafelist []string
+	// Cursor continues a listing from a position returned in Metadata. Page is ignored when it's
+	// set
+	Cursor *Cursor
+	// SkipTotal leaves out the total number of records, which has to count every match
+	SkipTotal bool
 }
 
 type Metadata struct {
@@ -20,6 +27,15 @@ type Metadata struct {
 	FirstPage    int `json:"first_page,omitempty"`
 	LastPage     int `json:"last_page,omitempty"`
 	TotalRecords int `json:"total_records,omitempty"`
+	// NextCursor and PrevCursor are the encoded Next and Prev positions, and NextLink and PrevLink
+	// the URLs of those pages. Handlers fill them in since encoding needs the cursor key
+	NextCursor string `json:"next_cursor,omitempty"`
+	PrevCursor string `json:"prev_cursor,omitempty"`
+	NextLink   string `json:"next,omitempty"`
+	PrevLink   string `json:"prev,omitempty"`
+	// Next and Prev are the positions of the pages after and before this one, nil at either end
+	Next *Cursor `json:"-"`
+	Prev *Cursor `json:"-"`
 }
 
 // Check that the client-provided Sort field matches one of the entries in our safelist
@@ -43,23 +59,117 @@ func (f Filters) sortDirection() string {
 	return "ASC"
 }
 
+// SortColumn() and SortDescending() give the validated sort to stores that don't build SQL, such as
+// the memory package
+func (f Filters) SortColumn() string {
+	return f.sortColumn()
+}
+
+func (f Filters) SortDescending() bool {
+	return f.sortDirection() == "DESC"
+}
+
+// limit() fetches one row more than the page size, which tells Paginate() whether there's another
+// page
 func (f Filters) limit() int {
-	return f.PageSize
+	return f.PageSize + 1
 }
 
 func (f Filters) offset() int {
+	if f.Cursor != nil {
+		return 0
+	}
+
 	return (f.Page - 1) * f.PageSize
 }
 
+// totalColumn() is selected as the total number of records. The window function stops Postgres
+// pushing the keyset condition into the query it wraps, so the count covers every match
+func (f Filters) totalColumn() string {
+	if f.SkipTotal {
+		return "0"
+	}
+
+	return "count(*) OVER()"
+}
+
+// keyset() returns the condition selecting the records after the cursor, or before it for a
+// previous page, along with args and the cursor's values appended to them. Ties on the sort column
+// are broken by id in idDirection, which has to match the query's ORDER BY
+func (f Filters) keyset(args []interface{}, idDirection string) (string, []interface{}) {
+	if f.Cursor == nil {
+		return "true", args
+	}
+
+	columnOp, idOp := ">", ">"
+	if f.sortDirection() == "DESC" {
+		columnOp = "<"
+	}
+	if idDirection == "DESC" {
+		idOp = "<"
+	}
+
+	if f.Cursor.Before {
+		columnOp, idOp = flipComparison(columnOp), flipComparison(idOp)
+	}
+
+	column := f.sortColumn()
+	n := len(args) + 1
+
+	condition := fmt.Sprintf("(%s %s $%d OR (%s = $%d AND id %s $%d))", column, columnOp, n, column, n, idOp, n+1)
+
+	return condition, append(args, f.Cursor.Value, f.Cursor.ID)
+}
+
+// window() returns the LIMIT and OFFSET clause, along with args and their values appended to them
+func (f Filters) window(args []interface{}) (string, []interface{}) {
+	n := len(args) + 1
+
+	return fmt.Sprintf("LIMIT $%d OFFSET $%d", n, n+1), append(args, f.limit(), f.offset())
+}
+
+// orderBy() returns the ORDER BY clause, reversed when fetching the page before a cursor so the
+// rows nearest the cursor come first
+func (f Filters) orderBy(idDirection string) string {
+	direction := f.sortDirection()
+
+	if f.Cursor != nil && f.Cursor.Before {
+		direction, idDirection = flipDirection(direction), flipDirection(idDirection)
+	}
+
+	return fmt.Sprintf("%s %s, id %s", f.sortColumn(), direction, idDirection)
+}
+
+func flipComparison(op string) string {
+	if op == ">" {
+		return "<"
+	}
+
+	return ">"
+}
+
+func flipDirection(direction string) string {
+	if direction == "ASC" {
+		return "DESC"
+	}
+
+	return "ASC"
+}
+
 func ValidateFilters(v *validator.Validator, f Filters) {
 	v.Check(f.Page > 0, "page", "must be greater than zero")
 	v.Check(f.Page <= 10_000_000, "page", "must be a maximum of 10 million")
 	v.Check(f.PageSize > 0, "page_size", "must be greater than zero")
 	v.Check(f.PageSize <= 100, "page_size", "must be a maximum of 100")
 	v.Check(validator.In(f.Sort, f.SortSafelist...), "sort", "invalid sort value")
+
+	if f.Cursor != nil {
+		v.Check(f.Cursor.Sort == f.Sort, "cursor", "was issued for a different sort")
+	}
 }
 
-func calculateMetadata(totalRecords, page, pageSize int) Metadata {
+// CalculateMetadata() describes the page of results returned out of totalRecords matches
+func CalculateMetadata(totalRecords, page, pageSize int) Metadata {
 	if totalRecords == 0 {
 		return Metadata{}
 	}
@@ -72,3 +182,57 @@ func calculateMetadata(totalRecords, page, pageSize int) Metadata {
 		TotalRecords: totalRecords,
 	}
 }
+
+// Sortable is implemented by the records listed with Filters. SortKey() returns the record's id
+// and its value of a column it can be sorted by
+type Sortable interface {
+	SortKey(column string) (int64, interface{})
+}
+
+// Paginate() takes the rows a list query fetched, in the order it fetched them, and returns the
+// page in sort order along with its metadata and the cursors either side of it. A query fetches
+// one row more than the page size, whose presence means there's another page in the direction
+// it's travelling
+func Paginate[T Sortable](records []T, totalRecords int, f Filters) ([]T, Metadata) {
+	more := len(records) > f.PageSize
+	if more {
+		records = records[:f.PageSize]
+	}
+
+	backward := f.Cursor != nil && f.Cursor.Before
+	if backward {
+		slices.Reverse(records)
+	}
+
+	var metadata Metadata
+
+	switch {
+	case f.Cursor != nil:
+		metadata = Metadata{PageSize: f.PageSize, TotalRecords: totalRecords}
+	case f.SkipTotal:
+		metadata = Metadata{CurrentPage: f.Page, PageSize: f.PageSize, FirstPage: 1}
+	default:
+		metadata = CalculateMetadata(totalRecords, f.Page, f.PageSize)
+	}
+
+	if len(records) == 0 {
+		return records, metadata
+	}
+
+	hasNext := more || backward
+	hasPrev := (backward && more) || (f.Cursor != nil && !backward) || (f.Cursor == nil && f.Page > 1)
+
+	column := f.sortColumn()
+
+	if hasNext {
+		id, value := records[len(records)-1].SortKey(column)
+		metadata.Next = &Cursor{Sort: f.Sort, Value: cursorValue(value), ID: id}
+	}
+
+	if hasPrev {
+		id, value := records[0].SortKey(column)
+		metadata.Prev = &Cursor{Sort: f.Sort, Value: cursorValue(value), ID: id, Before: true}
+	}
+
+	return records, metadata
+}
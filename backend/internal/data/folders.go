@@ -0,0 +1,239 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/lyttonliao/StratCheck/internal/validator"
+)
+
+var (
+	ErrDuplicateFolder = errors.New("duplicate folder")
+	ErrFolderCycle     = errors.New("folder cycle")
+)
+
+// Folder organizes a user's strategies. Folders nest, a folder without a parent is at the top level
+type Folder struct {
+	ID        int64     `json:"id"`
+	CreatedAt time.Time `json:"created_at"`
+	UserID    int64     `json:"-"`
+	ParentID  *int64    `json:"parent_id"`
+	Name      string    `json:"name"`
+	Version   int32     `json:"version"`
+}
+
+func ValidateFolder(v *validator.Validator, folder *Folder) {
+	v.Check(strings.TrimSpace(folder.Name) != "", "name", "must be provided")
+	v.Check(len(folder.Name) <= 100, "name", "must not be more than 100 bytes long")
+	v.Check(!strings.Contains(folder.Name, "/"), "name", "must not contain a slash")
+
+	if folder.ParentID != nil {
+		v.Check(*folder.ParentID > 0, "parent_id", "must be a positive integer")
+		v.Check(*folder.ParentID != folder.ID, "parent_id", "must not be the folder itself")
+	}
+}
+
+type FolderModel struct {
+	DB querier
+}
+
+func (m FolderModel) Insert(ctx context.Context, folder *Folder) error {
+	query := `
+		INSERT INTO strategy_folders (user_id, parent_id, name)
+		VALUES ($1, $2, $3)
+		RETURNING id, created_at, version
+	`
+
+	args := []interface{}{folder.UserID, folder.ParentID, folder.Name}
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, args...).Scan(&folder.ID, &folder.CreatedAt, &folder.Version)
+	if err != nil {
+		switch {
+		case IsConstraint(err, "strategy_folders_name_key"):
+			return ErrDuplicateFolder
+		default:
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (m FolderModel) Get(ctx context.Context, userID, folderID int64) (*Folder, error) {
+	if folderID < 1 {
+		return nil, ErrRecordNotFound
+	}
+
+	query := `
+		SELECT id, created_at, user_id, parent_id, name, version
+		FROM strategy_folders
+		WHERE id = $1 AND user_id = $2
+	`
+
+	var folder Folder
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, folderID, userID).Scan(
+		&folder.ID,
+		&folder.CreatedAt,
+		&folder.UserID,
+		&folder.ParentID,
+		&folder.Name,
+		&folder.Version,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	return &folder, nil
+}
+
+// GetAllForUser() returns every folder the user has, sorted by name. Clients build the tree from
+// each folder's parent_id
+func (m FolderModel) GetAllForUser(ctx context.Context, userID int64) ([]*Folder, error) {
+	query := `
+		SELECT id, created_at, user_id, parent_id, name, version
+		FROM strategy_folders
+		WHERE user_id = $1
+		ORDER BY name, id
+	`
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	folders := []*Folder{}
+
+	for rows.Next() {
+		var folder Folder
+
+		err := rows.Scan(
+			&folder.ID,
+			&folder.CreatedAt,
+			&folder.UserID,
+			&folder.ParentID,
+			&folder.Name,
+			&folder.Version,
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		folders = append(folders, &folder)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return folders, nil
+}
+
+// Update() renames or moves a folder. Moving a folder into itself or one of its subfolders would
+// cut the branch off from the top level, so ErrFolderCycle is returned instead. Before a move the
+// user's folders are locked, which covers the folder's subtree and the new parent's ancestors, so
+// two concurrent moves can't each pass the check and form a cycle together. The lock needs a
+// transaction, so call it inside Models.WithTx()
+func (m FolderModel) Update(ctx context.Context, folder *Folder) error {
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	if folder.ParentID != nil {
+		_, err := m.DB.ExecContext(ctx, `SELECT id FROM strategy_folders WHERE user_id = $1 FOR UPDATE`, folder.UserID)
+		if err != nil {
+			return err
+		}
+
+		query := `
+			WITH RECURSIVE subtree AS (
+				SELECT id FROM strategy_folders WHERE id = $1
+				UNION ALL
+				SELECT f.id FROM strategy_folders f JOIN subtree ON f.parent_id = subtree.id
+			)
+			SELECT EXISTS (SELECT 1 FROM subtree WHERE id = $2)
+		`
+
+		var cycle bool
+
+		err = m.DB.QueryRowContext(ctx, query, folder.ID, *folder.ParentID).Scan(&cycle)
+		if err != nil {
+			return err
+		}
+
+		if cycle {
+			return ErrFolderCycle
+		}
+	}
+
+	query := `
+		UPDATE strategy_folders
+		SET parent_id = $1, name = $2, version = version + 1
+		WHERE id = $3 AND user_id = $4 AND version = $5
+		RETURNING version
+	`
+
+	args := []interface{}{folder.ParentID, folder.Name, folder.ID, folder.UserID, folder.Version}
+
+	err := m.DB.QueryRowContext(ctx, query, args...).Scan(&folder.Version)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return ErrEditConflict
+		case IsConstraint(err, "strategy_folders_name_key"):
+			return ErrDuplicateFolder
+		default:
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Delete() removes a folder along with its subfolders. Strategies filed in them move back to the
+// top level
+func (m FolderModel) Delete(ctx context.Context, userID, folderID int64) error {
+	if folderID < 1 {
+		return ErrRecordNotFound
+	}
+
+	query := `
+		DELETE FROM strategy_folders
+		WHERE id = $1 AND user_id = $2
+	`
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, folderID, userID)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return ErrRecordNotFound
+	}
+
+	return nil
+}
@@ -0,0 +1,153 @@
+package memory
+
+import (
+	"cmp"
+	"context"
+	"slices"
+	"strings"
+
+	"github.com/lyttonliao/StratCheck/internal/data"
+)
+
+func copyFolder(f *data.Folder) *data.Folder {
+	c := *f
+
+	if f.ParentID != nil {
+		parentID := *f.ParentID
+		c.ParentID = &parentID
+	}
+
+	return &c
+}
+
+type folderModel struct {
+	s *store
+}
+
+// nameTaken() reports whether one of the user's folders other than folderID already has the name
+// under the same parent, which the strategy_folders_name_key index forbids
+func (st *state) nameTaken(folder *data.Folder) bool {
+	for id, f := range st.folders {
+		if id != folder.ID && f.UserID == folder.UserID && f.Name == folder.Name && parentOf(f) == parentOf(folder) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func parentOf(f *data.Folder) int64 {
+	if f.ParentID == nil {
+		return 0
+	}
+
+	return *f.ParentID
+}
+
+func (m folderModel) Insert(ctx context.Context, folder *data.Folder) error {
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+
+	st := m.s.state
+
+	if _, ok := st.users[folder.UserID]; !ok {
+		return foreignKeyError("strategy_folders", "user_id")
+	}
+
+	if _, ok := st.folders[parentOf(folder)]; folder.ParentID != nil && !ok {
+		return foreignKeyError("strategy_folders", "parent_id")
+	}
+
+	if st.nameTaken(folder) {
+		return data.ErrDuplicateFolder
+	}
+
+	folder.ID = st.nextID("strategy_folders")
+	folder.CreatedAt = now()
+	folder.Version = 1
+
+	st.folders[folder.ID] = copyFolder(folder)
+
+	return nil
+}
+
+func (m folderModel) Get(ctx context.Context, userID, folderID int64) (*data.Folder, error) {
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+
+	folder, ok := m.s.state.folders[folderID]
+	if !ok || folder.UserID != userID {
+		return nil, data.ErrRecordNotFound
+	}
+
+	return copyFolder(folder), nil
+}
+
+func (m folderModel) GetAllForUser(ctx context.Context, userID int64) ([]*data.Folder, error) {
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+
+	folders := []*data.Folder{}
+
+	for _, f := range m.s.state.folders {
+		if f.UserID == userID {
+			folders = append(folders, copyFolder(f))
+		}
+	}
+
+	slices.SortFunc(folders, func(a, b *data.Folder) int {
+		return cmp.Or(strings.Compare(a.Name, b.Name), cmp.Compare(a.ID, b.ID))
+	})
+
+	return folders, nil
+}
+
+func (m folderModel) Update(ctx context.Context, folder *data.Folder) error {
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+
+	st := m.s.state
+
+	if folder.ParentID != nil && slices.Contains(st.subtree(folder.ID), *folder.ParentID) {
+		return data.ErrFolderCycle
+	}
+
+	stored, ok := st.folders[folder.ID]
+	if !ok || stored.UserID != folder.UserID || stored.Version != folder.Version {
+		return data.ErrEditConflict
+	}
+
+	if _, ok := st.folders[parentOf(folder)]; folder.ParentID != nil && !ok {
+		return foreignKeyError("strategy_folders", "parent_id")
+	}
+
+	if st.nameTaken(folder) {
+		return data.ErrDuplicateFolder
+	}
+
+	updated := copyFolder(stored)
+	updated.ParentID = copyFolder(folder).ParentID
+	updated.Name = folder.Name
+	updated.Version++
+
+	st.folders[folder.ID] = updated
+	folder.Version = updated.Version
+
+	return nil
+}
+
+func (m folderModel) Delete(ctx context.Context, userID, folderID int64) error {
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+
+	st := m.s.state
+
+	folder, ok := st.folders[folderID]
+	if !ok || folder.UserID != userID {
+		return data.ErrRecordNotFound
+	}
+
+	st.deleteFolder(folderID)
+
+	return nil
+}
@@ -0,0 +1,448 @@
+// Package memory keeps the models in memory instead of Postgres. Lookups, version conflicts,
+// duplicate emails and cascading deletes behave the same as the Postgres models, so handlers can
+// be exercised without a database. Nothing is persisted
+package memory
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"maps"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lib/pq"
+
+	"github.com/lyttonliao/StratCheck/internal/data"
+)
+
+// permissionCodes are the permissions seeded by the migrations, in id order
+var permissionCodes = []string{"strategies:read", "strategies:write", "admin"}
+
+type usageKey struct {
+	userID int64
+	period time.Time
+}
+
+// token is a row of the tokens table, which records when each token was issued
+type token struct {
+	data.Token
+	createdAt time.Time
+}
+
+// state holds every table. Records are never changed in place, an update stores a modified copy,
+// so a transaction only needs to copy the maps to get a snapshot it can change freely
+type state struct {
+	users           map[int64]*data.User
+	tokens          map[string]*token
+	userPermissions map[int64][]string
+	plans           map[string]*data.Plan
+	strategies      map[int64]*data.Strategy
+	folders         map[int64]*data.Folder
+	outbox          map[int64]*data.EmailMessage
+	notifications   map[int64]*data.Notification
+	webhooks        map[int64]*data.Webhook
+	deliveries      map[int64]*data.WebhookDelivery
+	runs            map[int64]*data.BacktestRun
+	usage           map[usageKey]*data.Usage
+	// lastID holds the last id handed out for each table, like a bigserial sequence
+	lastID map[string]int64
+}
+
+func newState() *state {
+	created := now()
+
+	return &state{
+		users:           make(map[int64]*data.User),
+		tokens:          make(map[string]*token),
+		userPermissions: make(map[int64][]string),
+		plans: map[string]*data.Plan{
+			data.PlanFree: {
+				Code:      data.PlanFree,
+				Name:      "Free",
+				Quota:     data.Quota{MaxConcurrentRuns: 1, MonthlyComputeSeconds: 3600, MonthlyBars: 10_000_000},
+				CreatedAt: created,
+			},
+			"pro": {
+				Code:      "pro",
+				Name:      "Pro",
+				Quota:     data.Quota{MaxConcurrentRuns: 5, MonthlyComputeSeconds: 72000, MonthlyBars: 500_000_000},
+				CreatedAt: created,
+			},
+		},
+		strategies:    make(map[int64]*data.Strategy),
+		folders:       make(map[int64]*data.Folder),
+		outbox:        make(map[int64]*data.EmailMessage),
+		notifications: make(map[int64]*data.Notification),
+		webhooks:      make(map[int64]*data.Webhook),
+		deliveries:    make(map[int64]*data.WebhookDelivery),
+		runs:          make(map[int64]*data.BacktestRun),
+		usage:         make(map[usageKey]*data.Usage),
+		lastID:        make(map[string]int64),
+	}
+}
+
+func (st *state) clone() *state {
+	return &state{
+		users:           maps.Clone(st.users),
+		tokens:          maps.Clone(st.tokens),
+		userPermissions: maps.Clone(st.userPermissions),
+		plans:           maps.Clone(st.plans),
+		strategies:      maps.Clone(st.strategies),
+		folders:         maps.Clone(st.folders),
+		outbox:          maps.Clone(st.outbox),
+		notifications:   maps.Clone(st.notifications),
+		webhooks:        maps.Clone(st.webhooks),
+		deliveries:      maps.Clone(st.deliveries),
+		runs:            maps.Clone(st.runs),
+		usage:           maps.Clone(st.usage),
+		lastID:          maps.Clone(st.lastID),
+	}
+}
+
+func (st *state) nextID(table string) int64 {
+	st.lastID[table]++
+	return st.lastID[table]
+}
+
+// foreignKeyError() is returned where Postgres would reject a row referring to a missing record.
+// The constraint is named the way Postgres names it by default
+func foreignKeyError(table, column string) error {
+	return &data.ConstraintError{
+		Kind:       data.ErrForeignKeyViolation,
+		Table:      table,
+		Constraint: table + "_" + column + "_fkey",
+		Column:     column,
+	}
+}
+
+// uniqueError() is returned where Postgres would reject a row duplicating a unique key
+func uniqueError(table, constraint, column string) error {
+	return &data.ConstraintError{
+		Kind:       data.ErrUniqueViolation,
+		Table:      table,
+		Constraint: constraint,
+		Column:     column,
+	}
+}
+
+// deleteUser() removes a user along with the rows the ON DELETE CASCADE constraints would remove
+func (st *state) deleteUser(userID int64) {
+	delete(st.users, userID)
+	delete(st.userPermissions, userID)
+
+	for hash, t := range st.tokens {
+		if t.UserID == userID {
+			delete(st.tokens, hash)
+		}
+	}
+
+	for id, n := range st.notifications {
+		if n.UserID == userID {
+			delete(st.notifications, id)
+		}
+	}
+
+	for id, w := range st.webhooks {
+		if w.UserID == userID {
+			st.deleteWebhook(id)
+		}
+	}
+
+	for id, d := range st.deliveries {
+		if d.UserID == userID {
+			delete(st.deliveries, id)
+		}
+	}
+
+	for id, f := range st.folders {
+		if f.UserID == userID {
+			st.deleteFolder(id)
+		}
+	}
+
+	for id, run := range st.runs {
+		if run.UserID == userID {
+			delete(st.runs, id)
+		}
+	}
+
+	for key := range st.usage {
+		if key.userID == userID {
+			delete(st.usage, key)
+		}
+	}
+}
+
+// deleteWebhook() removes a webhook and its deliveries
+func (st *state) deleteWebhook(webhookID int64) {
+	delete(st.webhooks, webhookID)
+
+	for id, d := range st.deliveries {
+		if d.WebhookID == webhookID {
+			delete(st.deliveries, id)
+		}
+	}
+}
+
+// deleteFolder() removes a folder and its subfolders, moving the strategies filed in them to the
+// top level like the ON DELETE SET NULL constraint
+func (st *state) deleteFolder(folderID int64) {
+	if _, ok := st.folders[folderID]; !ok {
+		return
+	}
+
+	delete(st.folders, folderID)
+
+	for id, f := range st.folders {
+		if f.ParentID != nil && *f.ParentID == folderID {
+			st.deleteFolder(id)
+		}
+	}
+
+	for id, s := range st.strategies {
+		if s.FolderID != nil && *s.FolderID == folderID {
+			c := copyStrategy(s)
+			c.FolderID = nil
+			st.strategies[id] = c
+		}
+	}
+}
+
+// subtree() returns the ids of a folder and all of its subfolders
+func (st *state) subtree(folderID int64) []int64 {
+	ids := []int64{folderID}
+
+	for i := 0; i < len(ids); i++ {
+		for id, f := range st.folders {
+			if f.ParentID != nil && *f.ParentID == ids[i] {
+				ids = append(ids, id)
+			}
+		}
+	}
+
+	return ids
+}
+
+func (st *state) ownsStrategies(userID int64) bool {
+	for _, s := range st.strategies {
+		if s.UserID == userID {
+			return true
+		}
+	}
+
+	return false
+}
+
+// store is one copy of the state guarded by a mutex. Models share the root store, while each
+// transaction gets a store of its own holding a snapshot
+type store struct {
+	mu    sync.Mutex
+	state *state
+	inTx  bool
+}
+
+// NewModels() returns empty models kept in memory, with the permissions and plans the migrations
+// seed already in place
+func NewModels() data.Models {
+	return newModels(&store{state: newState()})
+}
+
+func newModels(s *store) data.Models {
+	return data.Models{
+		Backend:       s,
+		BacktestRuns:  backtestRunModel{s},
+		EmailOutbox:   emailOutboxModel{s},
+		Folders:       folderModel{s},
+		Notifications: notificationModel{s},
+		Strategies:    strategyModel{s},
+		Permissions:   permissionModel{s},
+		Plans:         planModel{s},
+		Tokens:        tokenModel{s},
+		Usage:         usageModel{s},
+		Users:         userModel{s},
+		Webhooks:      webhookModel{s},
+
+		WebhookDeliveries: webhookDeliveryModel{s},
+	}
+}
+
+// WithTx() runs fn against a snapshot of the state and keeps its changes only if fn succeeds.
+// Other callers wait until the transaction ends, so fn must only use the models it is given
+func (s *store) WithTx(ctx context.Context, fn func(tx data.Models) error) error {
+	if s.inTx {
+		return fn(newModels(s))
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	err := ctx.Err()
+	if err != nil {
+		return err
+	}
+
+	tx := &store{state: s.state.clone(), inTx: true}
+
+	err = fn(newModels(tx))
+	if err != nil {
+		return err
+	}
+
+	// Like a Postgres transaction, nothing is committed once ctx has been cancelled
+	err = ctx.Err()
+	if err != nil {
+		return err
+	}
+
+	s.state = tx.state
+
+	return nil
+}
+
+func (s *store) Ping(ctx context.Context) error {
+	if s.inTx {
+		return errors.New("models are bound to a transaction")
+	}
+
+	return ctx.Err()
+}
+
+// now() returns the current time at the precision of the timestamp(0) columns
+func now() time.Time {
+	return time.Now().Truncate(time.Second)
+}
+
+func copyTime(t *time.Time) *time.Time {
+	if t == nil {
+		return nil
+	}
+
+	c := *t
+	return &c
+}
+
+// paginate() sorts records by the filters' sort column, breaking ties by id in the direction the
+// matching query does, and returns the requested page along with its metadata. The page is found
+// by offset or from the filters' cursor, the same as the Postgres models
+func paginate[T data.Sortable](records []T, filters data.Filters, idDesc bool) ([]T, data.Metadata, error) {
+	column := filters.SortColumn()
+	desc := filters.SortDescending()
+
+	compare := func(idA int64, a interface{}, idB int64, b interface{}) int {
+		c := compareValues(a, b)
+		if desc {
+			c = -c
+		}
+
+		if c != 0 {
+			return c
+		}
+
+		if idDesc {
+			return cmp.Compare(idB, idA)
+		}
+
+		return cmp.Compare(idA, idB)
+	}
+
+	slices.SortFunc(records, func(a, b T) int {
+		idA, valueA := a.SortKey(column)
+		idB, valueB := b.SortKey(column)
+
+		return compare(idA, valueA, idB, valueB)
+	})
+
+	totalRecords := len(records)
+	if filters.SkipTotal {
+		totalRecords = 0
+	}
+
+	limit := filters.PageSize + 1
+	var window []T
+
+	switch {
+	case filters.Cursor == nil:
+		start := min((filters.Page-1)*filters.PageSize, len(records))
+		window = slices.Clone(records[start:min(start+limit, len(records))])
+	case len(records) > 0:
+		_, example := records[0].SortKey(column)
+
+		value, err := parseCursorValue(example, filters.Cursor.Value)
+		if err != nil {
+			return nil, data.Metadata{}, err
+		}
+
+		// Find the first record after the cursor's position, the records before the position end
+		// just before it
+		i, _ := slices.BinarySearchFunc(records, filters.Cursor.ID, func(r T, id int64) int {
+			rid, v := r.SortKey(column)
+			return compare(rid, v, id, value)
+		})
+
+		if filters.Cursor.Before {
+			window = slices.Clone(records[max(i-limit, 0):i])
+			slices.Reverse(window)
+		} else {
+			if i < len(records) {
+				if id, _ := records[i].SortKey(column); id == filters.Cursor.ID {
+					i++
+				}
+			}
+
+			window = slices.Clone(records[i:min(i+limit, len(records))])
+		}
+	}
+
+	page, metadata := data.Paginate(window, totalRecords, filters)
+
+	return page, metadata, nil
+}
+
+// compareValues() compares two values of a sort column
+func compareValues(a, b interface{}) int {
+	switch a := a.(type) {
+	case time.Time:
+		return a.Compare(b.(time.Time))
+	case int64:
+		return cmp.Compare(a, b.(int64))
+	case float64:
+		return cmp.Compare(a, b.(float64))
+	case string:
+		return strings.Compare(a, b.(string))
+	case []string:
+		return slices.Compare(a, b.([]string))
+	default:
+		panic(fmt.Sprintf("unsupported sort value type %T", a))
+	}
+}
+
+// parseCursorValue() parses a cursor's value into the type of the sort column's values, which
+// Postgres infers from the column
+func parseCursorValue(example interface{}, s string) (interface{}, error) {
+	switch example.(type) {
+	case time.Time:
+		return time.Parse(time.RFC3339Nano, s)
+	case int64:
+		return strconv.ParseInt(s, 10, 64)
+	case float64:
+		return strconv.ParseFloat(s, 64)
+	case string:
+		return s, nil
+	case []string:
+		var values pq.StringArray
+
+		err := values.Scan(s)
+		if err != nil {
+			return nil, err
+		}
+
+		return []string(values), nil
+	default:
+		return nil, fmt.Errorf("unsupported sort value type %T", example)
+	}
+}
@@ -0,0 +1,107 @@
+package memory
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"slices"
+
+	"github.com/lyttonliao/StratCheck/internal/data"
+)
+
+// copyNotification() copies the event data through JSON, as storing it in the jsonb column does
+func copyNotification(n *data.Notification) (*data.Notification, error) {
+	c := *n
+	c.Data = nil
+
+	js, err := json.Marshal(n.Data)
+	if err != nil {
+		return nil, err
+	}
+
+	err = json.Unmarshal(js, &c.Data)
+	if err != nil {
+		return nil, err
+	}
+
+	return &c, nil
+}
+
+type notificationModel struct {
+	s *store
+}
+
+func (m notificationModel) Insert(ctx context.Context, notification *data.Notification) error {
+	stored, err := copyNotification(notification)
+	if err != nil {
+		return err
+	}
+
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+
+	st := m.s.state
+
+	if _, ok := st.users[notification.UserID]; !ok {
+		return foreignKeyError("notifications", "user_id")
+	}
+
+	stored.ID = st.nextID("notifications")
+	stored.CreatedAt = now()
+
+	st.notifications[stored.ID] = stored
+
+	notification.ID = stored.ID
+	notification.CreatedAt = stored.CreatedAt
+
+	return nil
+}
+
+func (m notificationModel) GetUsersWithPendingDigest(ctx context.Context) ([]int64, error) {
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+
+	var ids []int64
+
+	for _, n := range m.s.state.notifications {
+		if n.DigestPending && !slices.Contains(ids, n.UserID) {
+			ids = append(ids, n.UserID)
+		}
+	}
+
+	slices.Sort(ids)
+
+	return ids, nil
+}
+
+func (m notificationModel) TakePendingDigest(ctx context.Context, userID int64) ([]*data.Notification, error) {
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+
+	st := m.s.state
+
+	notifications := []*data.Notification{}
+
+	for id, n := range st.notifications {
+		if n.UserID != userID || !n.DigestPending {
+			continue
+		}
+
+		taken := *n
+		taken.DigestPending = false
+		st.notifications[id] = &taken
+
+		c, err := copyNotification(&taken)
+		if err != nil {
+			return nil, err
+		}
+
+		notifications = append(notifications, c)
+	}
+
+	slices.SortFunc(notifications, func(a, b *data.Notification) int {
+		return cmp.Compare(a.ID, b.ID)
+	})
+
+	return notifications, nil
+}
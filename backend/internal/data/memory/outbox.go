@@ -0,0 +1,271 @@
+package memory
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"maps"
+	"slices"
+	"time"
+
+	"github.com/lyttonliao/StratCheck/internal/data"
+)
+
+// copyEmailMessage() copies the template data through JSON, as storing it in the jsonb column does
+func copyEmailMessage(msg *data.EmailMessage) (*data.EmailMessage, error) {
+	c := *msg
+	c.SentAt = copyTime(msg.SentAt)
+	c.Data = nil
+
+	js, err := json.Marshal(msg.Data)
+	if err != nil {
+		return nil, err
+	}
+
+	err = json.Unmarshal(js, &c.Data)
+	if err != nil {
+		return nil, err
+	}
+
+	return &c, nil
+}
+
+type emailOutboxModel struct {
+	s *store
+}
+
+func (m emailOutboxModel) Insert(ctx context.Context, msg *data.EmailMessage) error {
+	stored, err := copyEmailMessage(msg)
+	if err != nil {
+		return err
+	}
+
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+
+	st := m.s.state
+
+	stored.ID = st.nextID("email_outbox")
+	stored.CreatedAt = now()
+	stored.Status = data.EmailPending
+	stored.Attempts = 0
+	stored.LastError = ""
+	stored.NextAttemptAt = stored.CreatedAt
+	stored.SentAt = nil
+
+	st.outbox[stored.ID] = stored
+
+	msg.ID = stored.ID
+	msg.CreatedAt = stored.CreatedAt
+	msg.Status = stored.Status
+	msg.Attempts = stored.Attempts
+	msg.NextAttemptAt = stored.NextAttemptAt
+
+	return nil
+}
+
+// Claim() leases due messages, oldest first, so they aren't claimed again until the lease ends
+func (m emailOutboxModel) Claim(ctx context.Context, limit int, lease time.Duration) ([]*data.EmailMessage, error) {
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+
+	st := m.s.state
+	current := now()
+
+	var due []*data.EmailMessage
+
+	for _, msg := range st.outbox {
+		if msg.Status == data.EmailPending && !msg.NextAttemptAt.After(current) {
+			due = append(due, msg)
+		}
+	}
+
+	sortByNextAttempt(due, func(msg *data.EmailMessage) (time.Time, int64) { return msg.NextAttemptAt, msg.ID })
+
+	messages := []*data.EmailMessage{}
+
+	for _, msg := range due[:min(limit, len(due))] {
+		claimed := *msg
+		claimed.NextAttemptAt = current.Add(lease)
+		st.outbox[msg.ID] = &claimed
+
+		c, err := copyEmailMessage(&claimed)
+		if err != nil {
+			return nil, err
+		}
+
+		messages = append(messages, c)
+	}
+
+	return messages, nil
+}
+
+func (m emailOutboxModel) MarkSent(ctx context.Context, id int64) error {
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+
+	st := m.s.state
+
+	stored, ok := st.outbox[id]
+	if !ok {
+		return nil
+	}
+
+	sentAt := now()
+
+	updated := *stored
+	updated.Status = data.EmailSent
+	updated.Attempts++
+	updated.LastError = ""
+	updated.Data = map[string]interface{}{}
+	updated.SentAt = &sentAt
+
+	st.outbox[id] = &updated
+
+	return nil
+}
+
+func (m emailOutboxModel) MarkFailed(ctx context.Context, id int64, sendErr error, nextAttempt time.Time, dead bool) error {
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+
+	st := m.s.state
+
+	stored, ok := st.outbox[id]
+	if !ok {
+		return nil
+	}
+
+	updated := *stored
+	updated.Status = data.EmailPending
+	if dead {
+		updated.Status = data.EmailFailed
+	}
+	updated.Attempts++
+	updated.LastError = sendErr.Error()
+	updated.NextAttemptAt = nextAttempt
+
+	if dead {
+		updated.Data = maps.Clone(stored.Data)
+		for _, key := range data.EmailSecretKeys {
+			if _, ok := updated.Data[key]; ok {
+				updated.Data[key] = data.EmailRedacted
+			}
+		}
+	}
+
+	st.outbox[id] = &updated
+
+	return nil
+}
+
+func (m emailOutboxModel) Get(ctx context.Context, id int64) (*data.EmailMessage, error) {
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+
+	msg, ok := m.s.state.outbox[id]
+	if !ok {
+		return nil, data.ErrRecordNotFound
+	}
+
+	return copyEmailMessage(msg)
+}
+
+func (m emailOutboxModel) GetAll(ctx context.Context, status string, filters data.Filters) ([]*data.EmailMessage, data.Metadata, error) {
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+
+	messages := []*data.EmailMessage{}
+
+	for _, msg := range m.s.state.outbox {
+		if status != "" && msg.Status != status {
+			continue
+		}
+
+		c, err := copyEmailMessage(msg)
+		if err != nil {
+			return nil, data.Metadata{}, err
+		}
+
+		messages = append(messages, c)
+	}
+
+	return paginate(messages, filters, false)
+}
+
+func (m emailOutboxModel) Requeue(ctx context.Context, id int64) (*data.EmailMessage, error) {
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+
+	st := m.s.state
+
+	stored, ok := st.outbox[id]
+	if !ok || stored.Status != data.EmailFailed {
+		return nil, data.ErrRecordNotFound
+	}
+
+	updated := *stored
+	updated.Status = data.EmailPending
+	updated.Attempts = 0
+	updated.NextAttemptAt = now()
+
+	st.outbox[id] = &updated
+
+	return copyEmailMessage(&updated)
+}
+
+func (m emailOutboxModel) Backlog(ctx context.Context) (int, time.Duration, error) {
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+
+	var times []time.Time
+
+	for _, msg := range m.s.state.outbox {
+		if msg.Status == data.EmailPending {
+			times = append(times, msg.NextAttemptAt)
+		}
+	}
+
+	count, wait := backlog(times)
+
+	return count, wait, nil
+}
+
+// backlog() counts the pending rows that are due and how long the oldest has been waiting
+func backlog(nextAttempts []time.Time) (int, time.Duration) {
+	current := time.Now()
+
+	var count int
+	var oldest time.Time
+
+	for _, t := range nextAttempts {
+		if t.After(current) {
+			continue
+		}
+
+		if count == 0 || t.Before(oldest) {
+			oldest = t
+		}
+		count++
+	}
+
+	if count == 0 {
+		return 0, 0
+	}
+
+	return count, current.Sub(oldest)
+}
+
+// sortByNextAttempt() orders rows waiting to be claimed, oldest first
+func sortByNextAttempt[T any](rows []T, key func(T) (time.Time, int64)) {
+	slices.SortFunc(rows, func(a, b T) int {
+		ta, ida := key(a)
+		tb, idb := key(b)
+
+		if c := ta.Compare(tb); c != 0 {
+			return c
+		}
+
+		return cmp.Compare(ida, idb)
+	})
+}
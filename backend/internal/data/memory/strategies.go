@@ -0,0 +1,302 @@
+package memory
+
+import (
+	"cmp"
+	"context"
+	"slices"
+	"strings"
+	"unicode"
+
+	"github.com/lyttonliao/StratCheck/internal/data"
+)
+
+func copyStrategy(s *data.Strategy) *data.Strategy {
+	c := *s
+	c.Fields = slices.Clone(s.Fields)
+	c.Criteria = slices.Clone(s.Criteria)
+	c.Tags = slices.Clone(s.Tags)
+
+	if s.FolderID != nil {
+		folderID := *s.FolderID
+		c.FolderID = &folderID
+	}
+
+	return &c
+}
+
+// words() splits text into lowercase words the way the 'simple' text search configuration does
+func words(text string) []string {
+	return strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+	})
+}
+
+// rank() reports whether every word of the search appears in the strategy's name or description,
+// like plainto_tsquery() matched against the search vector, and scores the match. Words found in
+// the name count for more than those in the description, as the vector's weights make ts_rank() do
+func rank(s *data.Strategy, search string) (float64, bool) {
+	nameWords := words(s.Name)
+	descriptionWords := words(s.Description)
+
+	score := 0.0
+
+	for _, word := range words(search) {
+		switch {
+		case slices.Contains(nameWords, word):
+			score += 1
+		case slices.Contains(descriptionWords, word):
+			score += 0.4
+		default:
+			return 0, false
+		}
+	}
+
+	return score / float64(len(nameWords)+len(descriptionWords)+1), true
+}
+
+// matchesFilter() reports whether a strategy visible to the user passes the filter. folders holds
+// the filter's folder and its subfolders
+func matchesFilter(s *data.Strategy, filter data.StrategyFilter, folders []int64) bool {
+	switch {
+	case len(s.Fields) > 0 && !containsAll(s.Fields, filter.Fields):
+		return false
+	case !containsAll(s.Criteria, filter.Criteria), !containsAll(s.Tags, filter.Tags):
+		return false
+	case len(filter.AnyTags) > 0 && !slices.ContainsFunc(filter.AnyTags, func(tag string) bool { return slices.Contains(s.Tags, tag) }):
+		return false
+	case filter.Public != nil && s.Public != *filter.Public:
+		return false
+	case filter.OwnerID != 0 && s.UserID != filter.OwnerID:
+		return false
+	case filter.FolderID != 0 && (s.FolderID == nil || !slices.Contains(folders, *s.FolderID)):
+		return false
+	default:
+		return filter.Created.Contains(s.CreatedAt)
+	}
+}
+
+type strategyModel struct {
+	s *store
+}
+
+func (m strategyModel) Insert(ctx context.Context, userID int64, strategy *data.Strategy) error {
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+
+	st := m.s.state
+
+	if _, ok := st.folders[folderOf(strategy)]; strategy.FolderID != nil && !ok {
+		return foreignKeyError("strategies", "folder_id")
+	}
+
+	strategy.ID = st.nextID("strategies")
+	strategy.CreatedAt = now()
+	strategy.UserID = userID
+	strategy.Version = 1
+
+	st.strategies[strategy.ID] = copyStrategy(strategy)
+
+	return nil
+}
+
+func (m strategyModel) GetAll(ctx context.Context, userID int64, filter data.StrategyFilter, filters data.Filters) ([]*data.Strategy, data.Metadata, error) {
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+
+	st := m.s.state
+
+	var folders []int64
+	if filter.FolderID != 0 {
+		folders = st.subtree(filter.FolderID)
+	}
+
+	strategies := []*data.Strategy{}
+
+	for _, s := range st.strategies {
+		if !s.Public && s.UserID != userID {
+			continue
+		}
+
+		if !matchesFilter(s, filter, folders) {
+			continue
+		}
+
+		c := copyStrategy(s)
+
+		if filter.Search != "" {
+			score, ok := rank(s, filter.Search)
+			if !ok {
+				continue
+			}
+
+			c.Rank = score
+		}
+
+		strategies = append(strategies, c)
+	}
+
+	return paginate(strategies, filters, false)
+}
+
+func (m strategyModel) GetAllForUser(ctx context.Context, userID int64) ([]*data.Strategy, error) {
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+
+	strategies := []*data.Strategy{}
+
+	for _, s := range m.s.state.strategies {
+		if s.UserID == userID {
+			strategies = append(strategies, copyStrategy(s))
+		}
+	}
+
+	slices.SortFunc(strategies, func(a, b *data.Strategy) int {
+		return cmp.Compare(a.ID, b.ID)
+	})
+
+	return strategies, nil
+}
+
+func (m strategyModel) Get(ctx context.Context, userID int64, strategyID int64) (*data.Strategy, error) {
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+
+	s, ok := m.s.state.strategies[strategyID]
+	if !ok || s.UserID != userID {
+		return nil, data.ErrRecordNotFound
+	}
+
+	return copyStrategy(s), nil
+}
+
+func (m strategyModel) Update(ctx context.Context, userID int64, strategy *data.Strategy) error {
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+
+	st := m.s.state
+
+	stored, ok := st.strategies[strategy.ID]
+	if !ok || stored.UserID != userID || stored.Version != strategy.Version {
+		return data.ErrEditConflict
+	}
+
+	if _, ok := st.folders[folderOf(strategy)]; strategy.FolderID != nil && !ok {
+		return foreignKeyError("strategies", "folder_id")
+	}
+
+	updated := copyStrategy(strategy)
+	updated.CreatedAt = stored.CreatedAt
+	updated.UserID = stored.UserID
+	updated.Version++
+
+	st.strategies[strategy.ID] = updated
+	strategy.Version = updated.Version
+
+	return nil
+}
+
+func (m strategyModel) Delete(ctx context.Context, userID int64, strategyID int64) error {
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+
+	st := m.s.state
+
+	s, ok := st.strategies[strategyID]
+	if !ok || s.UserID != userID {
+		return data.ErrRecordNotFound
+	}
+
+	delete(st.strategies, strategyID)
+
+	return nil
+}
+
+func (m strategyModel) GetTags(ctx context.Context, userID int64) ([]*data.TagCount, error) {
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+
+	counts := make(map[string]int)
+
+	for _, s := range m.s.state.strategies {
+		if s.UserID != userID {
+			continue
+		}
+
+		for _, tag := range s.Tags {
+			counts[tag]++
+		}
+	}
+
+	tags := []*data.TagCount{}
+
+	for tag, count := range counts {
+		tags = append(tags, &data.TagCount{Tag: tag, Strategies: count})
+	}
+
+	slices.SortFunc(tags, func(a, b *data.TagCount) int {
+		return strings.Compare(a.Tag, b.Tag)
+	})
+
+	return tags, nil
+}
+
+func (m strategyModel) RenameTag(ctx context.Context, userID int64, tag, newTag string) (int64, error) {
+	return m.retag(userID, tag, func(tags []string) []string {
+		if slices.Contains(tags, newTag) {
+			return slices.DeleteFunc(tags, func(t string) bool { return t == tag })
+		}
+
+		return slices.Replace(tags, slices.Index(tags, tag), slices.Index(tags, tag)+1, newTag)
+	})
+}
+
+func (m strategyModel) DeleteTag(ctx context.Context, userID int64, tag string) (int64, error) {
+	return m.retag(userID, tag, func(tags []string) []string {
+		return slices.DeleteFunc(tags, func(t string) bool { return t == tag })
+	})
+}
+
+// retag() stores the result of change on every one of the user's strategies with the tag, and
+// returns the number of strategies changed. change is given a copy of the tags
+func (m strategyModel) retag(userID int64, tag string, change func(tags []string) []string) (int64, error) {
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+
+	st := m.s.state
+
+	var changed int64
+
+	for id, s := range st.strategies {
+		if s.UserID != userID || !slices.Contains(s.Tags, tag) {
+			continue
+		}
+
+		updated := copyStrategy(s)
+		updated.Tags = change(updated.Tags)
+		updated.Version++
+
+		st.strategies[id] = updated
+		changed++
+	}
+
+	return changed, nil
+}
+
+func folderOf(s *data.Strategy) int64 {
+	if s.FolderID == nil {
+		return 0
+	}
+
+	return *s.FolderID
+}
+
+// containsAll() reports whether values holds every one of wanted, like the @> array operator
+func containsAll(values, wanted []string) bool {
+	for _, w := range wanted {
+		if !slices.Contains(values, w) {
+			return false
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,168 @@
+package memory
+
+import (
+	"context"
+	"time"
+
+	"github.com/lyttonliao/StratCheck/internal/data"
+)
+
+func copyBacktestRun(run *data.BacktestRun) *data.BacktestRun {
+	c := *run
+	c.FinishedAt = copyTime(run.FinishedAt)
+
+	return &c
+}
+
+type backtestRunModel struct {
+	s *store
+}
+
+// Start() checks and takes a slot atomically, since the store is locked throughout
+func (m backtestRunModel) Start(ctx context.Context, userID int64, maxConcurrent int) (*data.BacktestRun, error) {
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+
+	st := m.s.state
+
+	if st.countRunning(userID) >= maxConcurrent {
+		return nil, data.ErrTooManyRuns
+	}
+
+	if _, ok := st.users[userID]; !ok {
+		return nil, foreignKeyError("backtest_runs", "user_id")
+	}
+
+	run := &data.BacktestRun{
+		ID:        st.nextID("backtest_runs"),
+		UserID:    userID,
+		Status:    data.RunRunning,
+		StartedAt: now(),
+	}
+
+	st.runs[run.ID] = copyBacktestRun(run)
+
+	return run, nil
+}
+
+func (m backtestRunModel) Finish(ctx context.Context, run *data.BacktestRun) error {
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+
+	st := m.s.state
+
+	stored, ok := st.runs[run.ID]
+	if !ok || stored.UserID != run.UserID || stored.Status != data.RunRunning {
+		return data.ErrRecordNotFound
+	}
+
+	finishedAt := now()
+
+	updated := copyBacktestRun(stored)
+	updated.Status = run.Status
+	updated.FinishedAt = &finishedAt
+	updated.ComputeSeconds = run.ComputeSeconds
+	updated.BarsProcessed = run.BarsProcessed
+
+	st.runs[run.ID] = updated
+
+	run.StartedAt = updated.StartedAt
+	run.FinishedAt = copyTime(updated.FinishedAt)
+
+	return nil
+}
+
+func (m backtestRunModel) CountRunning(ctx context.Context, userID int64) (int, error) {
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+
+	return m.s.state.countRunning(userID), nil
+}
+
+func (m backtestRunModel) ExpireStartedBefore(ctx context.Context, before time.Time) (int64, error) {
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+
+	st := m.s.state
+	finishedAt := now()
+
+	var expired int64
+
+	for id, run := range st.runs {
+		if run.Status != data.RunRunning || !run.StartedAt.Before(before) {
+			continue
+		}
+
+		updated := copyBacktestRun(run)
+		updated.Status = data.RunExpired
+		updated.FinishedAt = copyTime(&finishedAt)
+
+		st.runs[id] = updated
+		expired++
+	}
+
+	return expired, nil
+}
+
+func (st *state) countRunning(userID int64) int {
+	running := 0
+
+	for _, run := range st.runs {
+		if run.UserID == userID && run.Status == data.RunRunning {
+			running++
+		}
+	}
+
+	return running
+}
+
+type usageModel struct {
+	s *store
+}
+
+func (m usageModel) Get(ctx context.Context, userID int64, period time.Time) (*data.Usage, error) {
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+
+	usage := data.Usage{Period: period}
+
+	stored, ok := m.s.state.usage[usageKey{userID, data.UsagePeriod(period)}]
+	if ok {
+		usage.Runs = stored.Runs
+		usage.ComputeSeconds = stored.ComputeSeconds
+		usage.BarsProcessed = stored.BarsProcessed
+	}
+
+	return &usage, nil
+}
+
+func (m usageModel) Add(ctx context.Context, run *data.BacktestRun) error {
+	period := data.UsagePeriod(time.Now())
+	if run.FinishedAt != nil {
+		period = data.UsagePeriod(*run.FinishedAt)
+	}
+
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+
+	st := m.s.state
+
+	if _, ok := st.users[run.UserID]; !ok {
+		return foreignKeyError("usage_ledger", "user_id")
+	}
+
+	key := usageKey{run.UserID, period}
+
+	updated := data.Usage{Period: period}
+	if stored, ok := st.usage[key]; ok {
+		updated = *stored
+	}
+
+	updated.Runs++
+	updated.ComputeSeconds += run.ComputeSeconds
+	updated.BarsProcessed += run.BarsProcessed
+
+	st.usage[key] = &updated
+
+	return nil
+}
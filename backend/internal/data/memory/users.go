@@ -0,0 +1,412 @@
+package memory
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/lyttonliao/StratCheck/internal/data"
+)
+
+func copyUser(u *data.User) *data.User {
+	c := *u
+	c.Preferences.Notifications.Events = slices.Clone(u.Preferences.Notifications.Events)
+	c.DeletionScheduledAt = copyTime(u.DeletionScheduledAt)
+
+	return &c
+}
+
+type userModel struct {
+	s *store
+}
+
+// emailTaken() compares case-insensitively, like the citext email column
+func (st *state) emailTaken(email string, exceptID int64) bool {
+	for _, u := range st.users {
+		if u.ID != exceptID && strings.EqualFold(u.Email, email) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (m userModel) Insert(ctx context.Context, user *data.User) error {
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+
+	st := m.s.state
+
+	if st.emailTaken(user.Email, 0) {
+		return data.ErrDuplicateEmail
+	}
+
+	user.ID = st.nextID("users")
+	user.CreatedAt = now()
+	user.Plan = data.PlanFree
+	user.Version = 1
+
+	st.users[user.ID] = copyUser(user)
+
+	return nil
+}
+
+func (m userModel) Get(ctx context.Context, id int64) (*data.User, error) {
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+
+	user, ok := m.s.state.users[id]
+	if !ok {
+		return nil, data.ErrRecordNotFound
+	}
+
+	return copyUser(user), nil
+}
+
+func (m userModel) GetByEmail(ctx context.Context, email string) (*data.User, error) {
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+
+	for _, user := range m.s.state.users {
+		if strings.EqualFold(user.Email, email) {
+			return copyUser(user), nil
+		}
+	}
+
+	return nil, data.ErrRecordNotFound
+}
+
+func (m userModel) Update(ctx context.Context, user *data.User) error {
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+
+	st := m.s.state
+
+	stored, ok := st.users[user.ID]
+	if !ok || stored.Version != user.Version {
+		return data.ErrEditConflict
+	}
+
+	if st.emailTaken(user.Email, user.ID) {
+		return data.ErrDuplicateEmail
+	}
+
+	// The plan is only changed through PlanModel.SetForUser()
+	updated := copyUser(user)
+	updated.CreatedAt = stored.CreatedAt
+	updated.Plan = stored.Plan
+	updated.Version++
+
+	st.users[user.ID] = updated
+	user.Version = updated.Version
+
+	return nil
+}
+
+func (m userModel) GetForToken(ctx context.Context, tokenScope, tokenPlaintext string) (*data.User, error) {
+	tokenHash := sha256.Sum256([]byte(tokenPlaintext))
+
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+
+	st := m.s.state
+
+	t, ok := st.tokens[string(tokenHash[:])]
+	if !ok || t.Scope != tokenScope || !t.Expiry.After(time.Now()) {
+		return nil, data.ErrRecordNotFound
+	}
+
+	user, ok := st.users[t.UserID]
+	if !ok {
+		return nil, data.ErrRecordNotFound
+	}
+
+	return copyUser(user), nil
+}
+
+func (m userModel) DeleteUnactivatedBefore(ctx context.Context, before time.Time) (int64, error) {
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+
+	st := m.s.state
+
+	var deleted int64
+
+	for id, user := range st.users {
+		if !user.Activated && user.CreatedAt.Before(before) && !st.ownsStrategies(id) {
+			st.deleteUser(id)
+			deleted++
+		}
+	}
+
+	return deleted, nil
+}
+
+func (m userModel) GetAllScheduledForDeletion(ctx context.Context, before time.Time) ([]int64, error) {
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+
+	var ids []int64
+
+	for id, user := range m.s.state.users {
+		if user.DeletionScheduledAt != nil && !user.DeletionScheduledAt.After(before) {
+			ids = append(ids, id)
+		}
+	}
+
+	slices.Sort(ids)
+
+	return ids, nil
+}
+
+// Purge() removes the same data as the Postgres model, anonymizing rather than deleting users who
+// still own public strategies
+func (m userModel) Purge(ctx context.Context, userID int64) error {
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+
+	st := m.s.state
+
+	for id, s := range st.strategies {
+		if s.UserID == userID && !s.Public {
+			delete(st.strategies, id)
+		}
+	}
+
+	stored, ok := st.users[userID]
+	if !ok {
+		return data.ErrRecordNotFound
+	}
+
+	// Recipients are citext in Postgres, so addresses are compared case insensitively
+	for id, msg := range st.outbox {
+		if strings.EqualFold(msg.Recipient, stored.Email) || (stored.PendingEmail != "" && strings.EqualFold(msg.Recipient, stored.PendingEmail)) {
+			delete(st.outbox, id)
+		}
+	}
+
+	if !st.ownsStrategies(userID) {
+		st.deleteUser(userID)
+		return nil
+	}
+
+	// Clear everything deleteUser() would have removed, keeping only the user row
+	st.deleteUser(userID)
+
+	// The zero password has no hash, so the anonymized account cannot be logged into
+	anonymized := &data.User{
+		ID:          stored.ID,
+		CreatedAt:   stored.CreatedAt,
+		Name:        "Deleted user",
+		Email:       fmt.Sprintf("deleted-%d@users.invalid", stored.ID),
+		Preferences: data.DefaultPreferences(),
+		Plan:        stored.Plan,
+		Version:     stored.Version + 1,
+	}
+
+	st.users[userID] = anonymized
+
+	return nil
+}
+
+type tokenModel struct {
+	s *store
+}
+
+func (m tokenModel) New(ctx context.Context, userID int64, ttl time.Duration, scope string) (*data.Token, error) {
+	token, err := data.GenerateToken(userID, ttl, scope)
+	if err != nil {
+		return nil, err
+	}
+
+	err = m.Insert(ctx, token)
+	return token, err
+}
+
+func (m tokenModel) Insert(ctx context.Context, t *data.Token) error {
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+
+	st := m.s.state
+
+	if _, ok := st.users[t.UserID]; !ok {
+		return foreignKeyError("tokens", "user_id")
+	}
+
+	key := string(t.Hash)
+
+	if _, ok := st.tokens[key]; ok {
+		return uniqueError("tokens", "tokens_pkey", "hash")
+	}
+
+	stored := &token{Token: *t, createdAt: now()}
+	stored.Hash = slices.Clone(t.Hash)
+	stored.Plaintext = ""
+
+	st.tokens[key] = stored
+
+	return nil
+}
+
+func (m tokenModel) CountCreatedSince(ctx context.Context, scope string, userID int64, since time.Time) (int, error) {
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+
+	count := 0
+
+	for _, t := range m.s.state.tokens {
+		if t.Scope == scope && t.UserID == userID && t.createdAt.After(since) {
+			count++
+		}
+	}
+
+	return count, nil
+}
+
+func (m tokenModel) DeleteAllForUser(ctx context.Context, scope string, userID int64) error {
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+
+	for key, t := range m.s.state.tokens {
+		if t.Scope == scope && t.UserID == userID {
+			delete(m.s.state.tokens, key)
+		}
+	}
+
+	return nil
+}
+
+func (m tokenModel) DeleteExpired(ctx context.Context) (int64, error) {
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+
+	var deleted int64
+	cutoff := time.Now()
+
+	for key, t := range m.s.state.tokens {
+		if t.Expiry.Before(cutoff) {
+			delete(m.s.state.tokens, key)
+			deleted++
+		}
+	}
+
+	return deleted, nil
+}
+
+type permissionModel struct {
+	s *store
+}
+
+func (m permissionModel) GetAllForUser(ctx context.Context, userID int64) (data.Permissions, error) {
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+
+	var permissions data.Permissions
+
+	granted := m.s.state.userPermissions[userID]
+
+	for _, code := range permissionCodes {
+		if slices.Contains(granted, code) {
+			permissions = append(permissions, code)
+		}
+	}
+
+	return permissions, nil
+}
+
+// AddForUser() fails without granting anything if the user already has one of the permissions,
+// as the Postgres model does
+func (m permissionModel) AddForUser(ctx context.Context, userID int64, codes ...string) error {
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+
+	st := m.s.state
+
+	if _, ok := st.users[userID]; !ok {
+		return foreignKeyError("users_permissions", "user_id")
+	}
+
+	granted := slices.Clone(st.userPermissions[userID])
+
+	for _, code := range permissionCodes {
+		if !slices.Contains(codes, code) {
+			continue
+		}
+
+		if slices.Contains(granted, code) {
+			return uniqueError("users_permissions", "users_permissions_pkey", "user_id, permission_id")
+		}
+
+		granted = append(granted, code)
+	}
+
+	st.userPermissions[userID] = granted
+
+	return nil
+}
+
+type planModel struct {
+	s *store
+}
+
+func (m planModel) Get(ctx context.Context, code string) (*data.Plan, error) {
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+
+	plan, ok := m.s.state.plans[code]
+	if !ok {
+		return nil, data.ErrRecordNotFound
+	}
+
+	c := *plan
+	return &c, nil
+}
+
+func (m planModel) GetAll(ctx context.Context) ([]*data.Plan, error) {
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+
+	plans := []*data.Plan{}
+
+	for _, plan := range m.s.state.plans {
+		c := *plan
+		plans = append(plans, &c)
+	}
+
+	slices.SortFunc(plans, func(a, b *data.Plan) int {
+		if c := a.CreatedAt.Compare(b.CreatedAt); c != 0 {
+			return c
+		}
+
+		return strings.Compare(a.Code, b.Code)
+	})
+
+	return plans, nil
+}
+
+func (m planModel) SetForUser(ctx context.Context, userID int64, code string) error {
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+
+	st := m.s.state
+
+	stored, ok := st.users[userID]
+	if !ok {
+		return data.ErrRecordNotFound
+	}
+
+	if _, ok := st.plans[code]; !ok {
+		return foreignKeyError("users", "plan")
+	}
+
+	updated := copyUser(stored)
+	updated.Plan = code
+	updated.Version++
+
+	st.users[userID] = updated
+
+	return nil
+}
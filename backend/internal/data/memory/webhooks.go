@@ -0,0 +1,288 @@
+package memory
+
+import (
+	"cmp"
+	"context"
+	"slices"
+	"time"
+
+	"github.com/lyttonliao/StratCheck/internal/data"
+)
+
+func copyWebhook(w *data.Webhook) *data.Webhook {
+	c := *w
+	c.Events = slices.Clone(w.Events)
+
+	return &c
+}
+
+type webhookModel struct {
+	s *store
+}
+
+func (m webhookModel) Insert(ctx context.Context, webhook *data.Webhook) error {
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+
+	st := m.s.state
+
+	if _, ok := st.users[webhook.UserID]; !ok {
+		return foreignKeyError("webhooks", "user_id")
+	}
+
+	webhook.ID = st.nextID("webhooks")
+	webhook.CreatedAt = now()
+	webhook.Version = 1
+
+	st.webhooks[webhook.ID] = copyWebhook(webhook)
+
+	return nil
+}
+
+func (m webhookModel) Get(ctx context.Context, userID, webhookID int64) (*data.Webhook, error) {
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+
+	webhook, ok := m.s.state.webhooks[webhookID]
+	if !ok || webhook.UserID != userID {
+		return nil, data.ErrRecordNotFound
+	}
+
+	return copyWebhook(webhook), nil
+}
+
+func (m webhookModel) GetByID(ctx context.Context, webhookID int64) (*data.Webhook, error) {
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+
+	webhook, ok := m.s.state.webhooks[webhookID]
+	if !ok {
+		return nil, data.ErrRecordNotFound
+	}
+
+	return copyWebhook(webhook), nil
+}
+
+func (m webhookModel) GetAllForUser(ctx context.Context, userID int64, event string) ([]*data.Webhook, error) {
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+
+	webhooks := []*data.Webhook{}
+
+	for _, webhook := range m.s.state.webhooks {
+		if webhook.UserID != userID {
+			continue
+		}
+
+		if event != "" && (!webhook.Active || !slices.Contains(webhook.Events, event)) {
+			continue
+		}
+
+		webhooks = append(webhooks, copyWebhook(webhook))
+	}
+
+	slices.SortFunc(webhooks, func(a, b *data.Webhook) int {
+		return cmp.Compare(a.ID, b.ID)
+	})
+
+	return webhooks, nil
+}
+
+func (m webhookModel) Update(ctx context.Context, webhook *data.Webhook) error {
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+
+	st := m.s.state
+
+	stored, ok := st.webhooks[webhook.ID]
+	if !ok || stored.UserID != webhook.UserID || stored.Version != webhook.Version {
+		return data.ErrEditConflict
+	}
+
+	// Only the URL, events and active flag can be changed
+	updated := copyWebhook(stored)
+	updated.URL = webhook.URL
+	updated.Events = slices.Clone(webhook.Events)
+	updated.Active = webhook.Active
+	updated.Version++
+
+	st.webhooks[webhook.ID] = updated
+	webhook.Version = updated.Version
+
+	return nil
+}
+
+func (m webhookModel) Delete(ctx context.Context, userID, webhookID int64) error {
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+
+	st := m.s.state
+
+	webhook, ok := st.webhooks[webhookID]
+	if !ok || webhook.UserID != userID {
+		return data.ErrRecordNotFound
+	}
+
+	st.deleteWebhook(webhookID)
+
+	return nil
+}
+
+func copyWebhookDelivery(d *data.WebhookDelivery) *data.WebhookDelivery {
+	c := *d
+	c.Payload = slices.Clone(d.Payload)
+	c.DeliveredAt = copyTime(d.DeliveredAt)
+
+	return &c
+}
+
+type webhookDeliveryModel struct {
+	s *store
+}
+
+func (m webhookDeliveryModel) Insert(ctx context.Context, delivery *data.WebhookDelivery) error {
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+
+	st := m.s.state
+
+	if _, ok := st.webhooks[delivery.WebhookID]; !ok && delivery.WebhookID != 0 {
+		return foreignKeyError("webhook_deliveries", "webhook_id")
+	}
+
+	if _, ok := st.users[delivery.UserID]; !ok && delivery.UserID != 0 {
+		return foreignKeyError("webhook_deliveries", "user_id")
+	}
+
+	stored := &data.WebhookDelivery{
+		ID:        st.nextID("webhook_deliveries"),
+		CreatedAt: now(),
+		WebhookID: delivery.WebhookID,
+		UserID:    delivery.UserID,
+		URL:       delivery.URL,
+		Event:     delivery.Event,
+		Payload:   slices.Clone(delivery.Payload),
+		Status:    data.DeliveryPending,
+	}
+	stored.NextAttemptAt = stored.CreatedAt
+
+	st.deliveries[stored.ID] = stored
+
+	delivery.ID = stored.ID
+	delivery.CreatedAt = stored.CreatedAt
+	delivery.Status = stored.Status
+	delivery.Attempts = stored.Attempts
+	delivery.NextAttemptAt = stored.NextAttemptAt
+
+	return nil
+}
+
+// Claim() leases due deliveries of active webhooks, and those without a webhook, oldest first
+func (m webhookDeliveryModel) Claim(ctx context.Context, limit int, lease time.Duration) ([]*data.WebhookDelivery, error) {
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+
+	st := m.s.state
+	current := now()
+
+	var due []*data.WebhookDelivery
+
+	for _, d := range st.deliveries {
+		webhook, ok := st.webhooks[d.WebhookID]
+		active := d.WebhookID == 0 || (ok && webhook.Active)
+
+		if active && d.Status == data.DeliveryPending && !d.NextAttemptAt.After(current) {
+			due = append(due, d)
+		}
+	}
+
+	sortByNextAttempt(due, func(d *data.WebhookDelivery) (time.Time, int64) { return d.NextAttemptAt, d.ID })
+
+	deliveries := []*data.WebhookDelivery{}
+
+	for _, d := range due[:min(limit, len(due))] {
+		claimed := copyWebhookDelivery(d)
+		claimed.NextAttemptAt = current.Add(lease)
+		st.deliveries[d.ID] = claimed
+
+		deliveries = append(deliveries, copyWebhookDelivery(claimed))
+	}
+
+	return deliveries, nil
+}
+
+func (m webhookDeliveryModel) Record(ctx context.Context, delivery *data.WebhookDelivery, result data.DeliveryResult, nextAttempt time.Time, dead bool) error {
+	delivery.Attempts++
+	delivery.ResponseCode = result.ResponseCode
+	delivery.ResponseBody = result.ResponseBody
+	delivery.DurationMS = result.Duration.Milliseconds()
+	delivery.LastError = ""
+	delivery.NextAttemptAt = nextAttempt
+
+	switch {
+	case result.Err == nil:
+		deliveredAt := time.Now()
+		delivery.Status = data.DeliverySucceeded
+		delivery.DeliveredAt = &deliveredAt
+	case dead:
+		delivery.Status = data.DeliveryFailed
+		delivery.LastError = result.Err.Error()
+	default:
+		delivery.Status = data.DeliveryPending
+		delivery.LastError = result.Err.Error()
+	}
+
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+
+	st := m.s.state
+
+	stored, ok := st.deliveries[delivery.ID]
+	if !ok {
+		return nil
+	}
+
+	updated := copyWebhookDelivery(delivery)
+	updated.CreatedAt = stored.CreatedAt
+	updated.WebhookID = stored.WebhookID
+	updated.UserID = stored.UserID
+	updated.URL = stored.URL
+	updated.Event = stored.Event
+	updated.Payload = stored.Payload
+
+	st.deliveries[delivery.ID] = updated
+
+	return nil
+}
+
+func (m webhookDeliveryModel) GetAllForWebhook(ctx context.Context, webhookID int64, status string, filters data.Filters) ([]*data.WebhookDelivery, data.Metadata, error) {
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+
+	deliveries := []*data.WebhookDelivery{}
+
+	for _, d := range m.s.state.deliveries {
+		if d.WebhookID == webhookID && (status == "" || d.Status == status) {
+			deliveries = append(deliveries, copyWebhookDelivery(d))
+		}
+	}
+
+	return paginate(deliveries, filters, true)
+}
+
+func (m webhookDeliveryModel) Backlog(ctx context.Context) (int, time.Duration, error) {
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+
+	var times []time.Time
+
+	for _, d := range m.s.state.deliveries {
+		if d.Status == data.DeliveryPending {
+			times = append(times, d.NextAttemptAt)
+		}
+	}
+
+	count, wait := backlog(times)
+
+	return count, wait, nil
+}
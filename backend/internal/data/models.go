@@ -1,8 +1,10 @@
 package data
 
 import (
+	"context"
 	"database/sql"
 	"errors"
+	"time"
 )
 
 var (
@@ -10,18 +12,222 @@ var (
 	ErrEditConflict   = errors.New("edit conflict")
 )
 
+// sqlQuerier is satisfied by both *sql.DB and *sql.Tx, so every model can run its queries either
+// directly against the pool or as part of a transaction
+type sqlQuerier interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
+
+// querier is what the models run their queries through. The models get a translatingQuerier,
+// translating errors with translateError(), around a tracedQuerier wrapping the sqlQuerier
+type querier interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) rowScanner
+}
+
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+// Models holds a repository for each kind of record. Handlers only depend on these interfaces, so
+// they can run against the Postgres models returned by NewModels() or the in-memory ones in the
+// memory package
 type Models struct {
-	Strategies  StrategyModel
-	Permissions PermissionModel
-	Tokens      TokenModel
-	Users       UserModel
+	// Backend runs transactions and health checks for whatever stores the records
+	Backend       Backend
+	BacktestRuns  BacktestRunRepository
+	EmailOutbox   EmailOutboxRepository
+	Folders       FolderRepository
+	Notifications NotificationRepository
+	Strategies    StrategyRepository
+	Permissions   PermissionRepository
+	Plans         PlanRepository
+	Tokens        TokenRepository
+	Usage         UsageRepository
+	Users         UserRepository
+	Webhooks      WebhookRepository
+	// WebhookDeliveries is the queue and log of events sent to webhooks
+	WebhookDeliveries WebhookDeliveryRepository
+}
+
+// Backend is implemented by each store the models can be kept in
+type Backend interface {
+	// WithTx() runs fn with a copy of the models bound to a single transaction. See Models.WithTx()
+	WithTx(ctx context.Context, fn func(tx Models) error) error
+	Ping(ctx context.Context) error
+}
+
+type BacktestRunRepository interface {
+	Start(ctx context.Context, userID int64, maxConcurrent int) (*BacktestRun, error)
+	Finish(ctx context.Context, run *BacktestRun) error
+	CountRunning(ctx context.Context, userID int64) (int, error)
+	ExpireStartedBefore(ctx context.Context, before time.Time) (int64, error)
+}
+
+type EmailOutboxRepository interface {
+	Insert(ctx context.Context, msg *EmailMessage) error
+	Claim(ctx context.Context, limit int, lease time.Duration) ([]*EmailMessage, error)
+	MarkSent(ctx context.Context, id int64) error
+	MarkFailed(ctx context.Context, id int64, sendErr error, nextAttempt time.Time, dead bool) error
+	Get(ctx context.Context, id int64) (*EmailMessage, error)
+	GetAll(ctx context.Context, status string, filters Filters) ([]*EmailMessage, Metadata, error)
+	Requeue(ctx context.Context, id int64) (*EmailMessage, error)
+	Backlog(ctx context.Context) (int, time.Duration, error)
+}
+
+type FolderRepository interface {
+	Insert(ctx context.Context, folder *Folder) error
+	Get(ctx context.Context, userID, folderID int64) (*Folder, error)
+	GetAllForUser(ctx context.Context, userID int64) ([]*Folder, error)
+	Update(ctx context.Context, folder *Folder) error
+	Delete(ctx context.Context, userID, folderID int64) error
+}
+
+type NotificationRepository interface {
+	Insert(ctx context.Context, notification *Notification) error
+	GetUsersWithPendingDigest(ctx context.Context) ([]int64, error)
+	TakePendingDigest(ctx context.Context, userID int64) ([]*Notification, error)
+}
+
+type StrategyRepository interface {
+	Insert(ctx context.Context, userID int64, strategy *Strategy) error
+	GetAll(ctx context.Context, userID int64, filter StrategyFilter, filters Filters) ([]*Strategy, Metadata, error)
+	GetAllForUser(ctx context.Context, userID int64) ([]*Strategy, error)
+	Get(ctx context.Context, userID int64, strategyID int64) (*Strategy, error)
+	Update(ctx context.Context, userID int64, strategy *Strategy) error
+	Delete(ctx context.Context, userID int64, strategyID int64) error
+	GetTags(ctx context.Context, userID int64) ([]*TagCount, error)
+	RenameTag(ctx context.Context, userID int64, tag, newTag string) (int64, error)
+	DeleteTag(ctx context.Context, userID int64, tag string) (int64, error)
+}
+
+type PermissionRepository interface {
+	GetAllForUser(ctx context.Context, userID int64) (Permissions, error)
+	AddForUser(ctx context.Context, userID int64, codes ...string) error
+}
+
+type PlanRepository interface {
+	Get(ctx context.Context, code string) (*Plan, error)
+	GetAll(ctx context.Context) ([]*Plan, error)
+	SetForUser(ctx context.Context, userID int64, code string) error
+}
+
+type TokenRepository interface {
+	New(ctx context.Context, userID int64, ttl time.Duration, scope string) (*Token, error)
+	Insert(ctx context.Context, token *Token) error
+	CountCreatedSince(ctx context.Context, scope string, userID int64, since time.Time) (int, error)
+	DeleteAllForUser(ctx context.Context, scope string, userID int64) error
+	DeleteExpired(ctx context.Context) (int64, error)
+}
+
+type UsageRepository interface {
+	Get(ctx context.Context, userID int64, period time.Time) (*Usage, error)
+	Add(ctx context.Context, run *BacktestRun) error
+}
+
+type UserRepository interface {
+	Insert(ctx context.Context, user *User) error
+	Get(ctx context.Context, id int64) (*User, error)
+	GetByEmail(ctx context.Context, email string) (*User, error)
+	Update(ctx context.Context, user *User) error
+	GetForToken(ctx context.Context, tokenScope, tokenPlaintext string) (*User, error)
+	DeleteUnactivatedBefore(ctx context.Context, before time.Time) (int64, error)
+	GetAllScheduledForDeletion(ctx context.Context, before time.Time) ([]int64, error)
+	Purge(ctx context.Context, userID int64) error
 }
 
+type WebhookRepository interface {
+	Insert(ctx context.Context, webhook *Webhook) error
+	Get(ctx context.Context, userID, webhookID int64) (*Webhook, error)
+	GetByID(ctx context.Context, webhookID int64) (*Webhook, error)
+	GetAllForUser(ctx context.Context, userID int64, event string) ([]*Webhook, error)
+	Update(ctx context.Context, webhook *Webhook) error
+	Delete(ctx context.Context, userID, webhookID int64) error
+}
+
+type WebhookDeliveryRepository interface {
+	Insert(ctx context.Context, delivery *WebhookDelivery) error
+	Claim(ctx context.Context, limit int, lease time.Duration) ([]*WebhookDelivery, error)
+	Record(ctx context.Context, delivery *WebhookDelivery, result DeliveryResult, nextAttempt time.Time, dead bool) error
+	GetAllForWebhook(ctx context.Context, webhookID int64, status string, filters Filters) ([]*WebhookDelivery, Metadata, error)
+	Backlog(ctx context.Context) (int, time.Duration, error)
+}
+
+// NewModels() returns models backed by Postgres
 func NewModels(db *sql.DB) Models {
+	return newModels(db, dbBackend{db: db})
+}
+
+func newModels(db sqlQuerier, backend Backend) Models {
+	q := translatingQuerier{tracedQuerier{db}}
+
 	return Models{
-		Strategies:  StrategyModel{DB: db},
-		Permissions: PermissionModel{DB: db},
-		Tokens:      TokenModel{DB: db},
-		Users:       UserModel{DB: db},
+		Backend:       backend,
+		BacktestRuns:  BacktestRunModel{DB: q},
+		EmailOutbox:   EmailOutboxModel{DB: q},
+		Folders:       FolderModel{DB: q},
+		Notifications: NotificationModel{DB: q},
+		Strategies:    StrategyModel{DB: q},
+		Permissions:   PermissionModel{DB: q},
+		Plans:         PlanModel{DB: q},
+		Tokens:        TokenModel{DB: q},
+		Usage:         UsageModel{DB: q},
+		Users:         UserModel{DB: q},
+		Webhooks:      WebhookModel{DB: q},
+
+		WebhookDeliveries: WebhookDeliveryModel{DB: q},
+	}
+}
+
+// WithTx() runs fn with a copy of the models bound to a single transaction. The transaction is
+// committed if fn returns nil and rolled back otherwise, with fn's error returned unchanged, and
+// is rolled back if ctx is cancelled first. Calling WithTx() on models that are already bound to a
+// transaction just runs fn with them. fn should only use the models it is given
+func (m Models) WithTx(ctx context.Context, fn func(tx Models) error) error {
+	return m.Backend.WithTx(ctx, fn)
+}
+
+// Ping() checks the store can be reached, for the readiness check
+func (m Models) Ping(ctx context.Context) error {
+	return m.Backend.Ping(ctx)
+}
+
+// dbBackend runs transactions on the connection pool
+type dbBackend struct {
+	db *sql.DB
+}
+
+func (b dbBackend) WithTx(ctx context.Context, fn func(tx Models) error) error {
+	tx, err := b.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
 	}
+	defer tx.Rollback()
+
+	err = fn(newModels(tx, txBackend{tx: tx}))
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (b dbBackend) Ping(ctx context.Context) error {
+	return b.db.PingContext(ctx)
+}
+
+// txBackend belongs to models already bound to a transaction, which nested calls to WithTx() join
+type txBackend struct {
+	tx *sql.Tx
+}
+
+func (b txBackend) WithTx(ctx context.Context, fn func(tx Models) error) error {
+	return fn(newModels(b.tx, b))
+}
+
+func (b txBackend) Ping(ctx context.Context) error {
+	return errors.New("models are bound to a transaction")
 }
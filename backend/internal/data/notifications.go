@@ -0,0 +1,194 @@
+package data
+
+import (
+	"context"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"net/url"
+	"sort"
+	"time"
+
+	"github.com/lyttonliao/StratCheck/internal/validator"
+)
+
+const (
+	EventBacktestStarted   = "backtest.started"
+	EventBacktestCompleted = "backtest.completed"
+	EventBacktestFailed    = "backtest.failed"
+	EventStrategyShared    = "strategy.shared"
+)
+
+// NotificationEvents lists the event types users can be notified about
+var NotificationEvents = []string{EventBacktestCompleted, EventBacktestFailed, EventStrategyShared}
+
+// NotificationPreferences controls how a user hears about events. With Digest set, emails are
+// held back and sent together once a day instead of one per event
+type NotificationPreferences struct {
+	Email      bool     `json:"email"`
+	Digest     bool     `json:"digest"`
+	WebhookURL string   `json:"webhook_url,omitempty"`
+	Events     []string `json:"events"`
+}
+
+func DefaultNotificationPreferences() NotificationPreferences {
+	return NotificationPreferences{
+		Email:  true,
+		Events: append([]string{}, NotificationEvents...),
+	}
+}
+
+// Wants() returns true if the user is subscribed to the event type
+func (p NotificationPreferences) Wants(eventType string) bool {
+	return validator.In(eventType, p.Events...)
+}
+
+func ValidateNotificationPreferences(v *validator.Validator, p NotificationPreferences) {
+	for _, event := range p.Events {
+		v.Check(validator.In(event, NotificationEvents...), "preferences.notifications.events", "must only contain known event types")
+	}
+
+	v.Check(validator.Unique(p.Events), "preferences.notifications.events", "must not contain duplicate values")
+
+	if p.WebhookURL != "" {
+		u, err := url.Parse(p.WebhookURL)
+		v.Check(err == nil && (u.Scheme == "https" || u.Scheme == "http") && u.Host != "", "preferences.notifications.webhook_url", "must be an absolute http or https URL")
+	}
+}
+
+// NotificationData holds the event details, which differ between event types
+type NotificationData map[string]interface{}
+
+func (d NotificationData) Value() (driver.Value, error) {
+	return json.Marshal(d)
+}
+
+func (d *NotificationData) Scan(src interface{}) error {
+	switch src := src.(type) {
+	case []byte:
+		return json.Unmarshal(src, d)
+	case string:
+		return json.Unmarshal([]byte(src), d)
+	case nil:
+		*d = nil
+		return nil
+	default:
+		return errors.New("incompatible type for notification data")
+	}
+}
+
+type Notification struct {
+	ID            int64            `json:"id"`
+	CreatedAt     time.Time        `json:"created_at"`
+	UserID        int64            `json:"-"`
+	Type          string           `json:"type"`
+	Data          NotificationData `json:"data"`
+	DigestPending bool             `json:"-"`
+}
+
+type NotificationModel struct {
+	DB querier
+}
+
+func (m NotificationModel) Insert(ctx context.Context, notification *Notification) error {
+	query := `
+		INSERT INTO notifications (user_id, type, data, digest_pending)
+		VALUES ($1, $2, $3, $4)
+		RETURNING id, created_at
+	`
+
+	args := []interface{}{notification.UserID, notification.Type, notification.Data, notification.DigestPending}
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	return m.DB.QueryRowContext(ctx, query, args...).Scan(&notification.ID, &notification.CreatedAt)
+}
+
+// GetUsersWithPendingDigest() returns the IDs of users who have notifications waiting for their
+// next digest email
+func (m NotificationModel) GetUsersWithPendingDigest(ctx context.Context) ([]int64, error) {
+	query := `
+		SELECT DISTINCT user_id
+		FROM notifications
+		WHERE digest_pending = true
+		ORDER BY user_id
+	`
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var ids []int64
+
+	for rows.Next() {
+		var id int64
+
+		err := rows.Scan(&id)
+		if err != nil {
+			return nil, err
+		}
+
+		ids = append(ids, id)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return ids, nil
+}
+
+// TakePendingDigest() returns the user's notifications waiting for a digest, oldest first, and
+// marks them as no longer pending. Run it in the same transaction that queues the digest email
+func (m NotificationModel) TakePendingDigest(ctx context.Context, userID int64) ([]*Notification, error) {
+	query := `
+		UPDATE notifications
+		SET digest_pending = false
+		WHERE user_id = $1 AND digest_pending = true
+		RETURNING id, created_at, user_id, type, data, digest_pending
+	`
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	notifications := []*Notification{}
+
+	for rows.Next() {
+		var notification Notification
+
+		err := rows.Scan(
+			&notification.ID,
+			&notification.CreatedAt,
+			&notification.UserID,
+			&notification.Type,
+			&notification.Data,
+			&notification.DigestPending,
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		notifications = append(notifications, &notification)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	// RETURNING doesn't guarantee an order
+	sort.Slice(notifications, func(i, j int) bool {
+		return notifications[i].ID < notifications[j].ID
+	})
+
+	return notifications, nil
+}
@@ -0,0 +1,356 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+const (
+	EmailPending = "pending"
+	EmailSent    = "sent"
+	EmailFailed  = "failed"
+)
+
+// EmailRedacted replaces the values of EmailSecretKeys once a message is dead-lettered
+const EmailRedacted = "[redacted]"
+
+// EmailSecretKeys are the template data keys holding one-time tokens, or links carrying them
+var EmailSecretKeys = []string{"activationToken", "activationURL", "passwordResetToken", "emailChangeToken"}
+
+// EmailMessage is a row in the email_outbox table. Messages are written in the same transaction
+// as the change that triggers them and delivered later by the outbox worker, so an email is never
+// lost because the SMTP server was unavailable when the request was handled
+type EmailMessage struct {
+	ID            int64                  `json:"id"`
+	CreatedAt     time.Time              `json:"created_at"`
+	Recipient     string                 `json:"recipient"`
+	Template      string                 `json:"template"`
+	Locale        string                 `json:"locale,omitempty"`
+	Data          map[string]interface{} `json:"-"`
+	Status        string                 `json:"status"`
+	Attempts      int                    `json:"attempts"`
+	LastError     string                 `json:"last_error,omitempty"`
+	NextAttemptAt time.Time              `json:"next_attempt_at"`
+	SentAt        *time.Time             `json:"sent_at,omitempty"`
+}
+
+func (msg *EmailMessage) SortKey(column string) (int64, interface{}) {
+	switch column {
+	case "created_at":
+		return msg.ID, msg.CreatedAt
+	case "next_attempt_at":
+		return msg.ID, msg.NextAttemptAt
+	default:
+		return msg.ID, msg.ID
+	}
+}
+
+// Redacted() reports whether the message's tokens were cleared when it was dead-lettered, in which
+// case sending it again would deliver an email without them
+func (msg *EmailMessage) Redacted() bool {
+	for _, key := range EmailSecretKeys {
+		if msg.Data[key] == EmailRedacted {
+			return true
+		}
+	}
+
+	return false
+}
+
+type EmailOutboxModel struct {
+	DB querier
+}
+
+func (m EmailOutboxModel) Insert(ctx context.Context, msg *EmailMessage) error {
+	data, err := json.Marshal(msg.Data)
+	if err != nil {
+		return err
+	}
+
+	query := `
+		INSERT INTO email_outbox (recipient, template, locale, data)
+		VALUES ($1, $2, $3, $4)
+		RETURNING id, created_at, status, attempts, next_attempt_at
+	`
+
+	args := []interface{}{msg.Recipient, msg.Template, msg.Locale, data}
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	return m.DB.QueryRowContext(ctx, query, args...).Scan(
+		&msg.ID,
+		&msg.CreatedAt,
+		&msg.Status,
+		&msg.Attempts,
+		&msg.NextAttemptAt,
+	)
+}
+
+// Claim() returns up to limit pending messages that are due and pushes their next attempt back by
+// the lease, so another api instance polling at the same time skips them. FOR UPDATE SKIP LOCKED
+// stops two instances claiming the same row inside the statement itself
+func (m EmailOutboxModel) Claim(ctx context.Context, limit int, lease time.Duration) ([]*EmailMessage, error) {
+	query := `
+		UPDATE email_outbox
+		SET next_attempt_at = NOW() + $2 * interval '1 second'
+		WHERE id IN (
+			SELECT id FROM email_outbox
+			WHERE status = 'pending' AND next_attempt_at <= NOW()
+			ORDER BY next_attempt_at
+			LIMIT $1
+			FOR UPDATE SKIP LOCKED
+		)
+		RETURNING id, created_at, recipient, template, locale, data, status, attempts, last_error, next_attempt_at, sent_at
+	`
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, limit, lease.Seconds())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	messages := []*EmailMessage{}
+
+	for rows.Next() {
+		msg, err := scanEmailMessage(rows)
+		if err != nil {
+			return nil, err
+		}
+
+		messages = append(messages, msg)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return messages, nil
+}
+
+// MarkSent() records a successful delivery. The template data is cleared because it can hold
+// one-time tokens which shouldn't outlive the email
+func (m EmailOutboxModel) MarkSent(ctx context.Context, id int64) error {
+	query := `
+		UPDATE email_outbox
+		SET status = 'sent', attempts = attempts + 1, last_error = '', data = '{}', sent_at = NOW()
+		WHERE id = $1
+	`
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, id)
+	return err
+}
+
+// MarkFailed() records a failed attempt. The message is retried at nextAttempt unless dead is
+// true, in which case it is moved to the failed status and waits for an admin to requeue it. A
+// dead message's tokens are redacted, like MarkSent() they shouldn't outlive the email
+func (m EmailOutboxModel) MarkFailed(ctx context.Context, id int64, sendErr error, nextAttempt time.Time, dead bool) error {
+	status := EmailPending
+	if dead {
+		status = EmailFailed
+	}
+
+	query := `
+		UPDATE email_outbox
+		SET status = $1, attempts = attempts + 1, last_error = $2, next_attempt_at = $3,
+			data = CASE WHEN NOT $5 THEN data ELSE (
+				SELECT COALESCE(jsonb_object_agg(key, CASE WHEN key = ANY($6) THEN to_jsonb($7::text) ELSE value END), '{}')
+				FROM jsonb_each(data)
+			) END
+		WHERE id = $4
+	`
+
+	args := []interface{}{status, sendErr.Error(), nextAttempt, id, dead, pq.Array(EmailSecretKeys), EmailRedacted}
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, args...)
+	return err
+}
+
+func (m EmailOutboxModel) Get(ctx context.Context, id int64) (*EmailMessage, error) {
+	if id < 1 {
+		return nil, ErrRecordNotFound
+	}
+
+	query := `
+		SELECT id, created_at, recipient, template, locale, data, status, attempts, last_error, next_attempt_at, sent_at
+		FROM email_outbox
+		WHERE id = $1
+	`
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	msg, err := scanEmailMessage(m.DB.QueryRowContext(ctx, query, id))
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	return msg, nil
+}
+
+// GetAll() lists messages, optionally restricted to a single status
+func (m EmailOutboxModel) GetAll(ctx context.Context, status string, filters Filters) ([]*EmailMessage, Metadata, error) {
+	keyset, args := filters.keyset([]interface{}{status}, "ASC")
+	window, args := filters.window(args)
+
+	query := fmt.Sprintf(`
+		SELECT * FROM (
+			SELECT %s, id, created_at, recipient, template, locale, data, status, attempts, last_error,
+			next_attempt_at, sent_at
+			FROM email_outbox
+			WHERE (status = $1 OR $1 = '')
+		) AS matches
+		WHERE %s
+		ORDER BY %s
+		%s`, filters.totalColumn(), keyset, filters.orderBy("ASC"), window)
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+	defer rows.Close()
+
+	totalRecords := 0
+	messages := []*EmailMessage{}
+
+	for rows.Next() {
+		var msg EmailMessage
+		var data []byte
+
+		err := rows.Scan(
+			&totalRecords,
+			&msg.ID,
+			&msg.CreatedAt,
+			&msg.Recipient,
+			&msg.Template,
+			&msg.Locale,
+			&data,
+			&msg.Status,
+			&msg.Attempts,
+			&msg.LastError,
+			&msg.NextAttemptAt,
+			&msg.SentAt,
+		)
+		if err != nil {
+			return nil, Metadata{}, err
+		}
+
+		err = json.Unmarshal(data, &msg.Data)
+		if err != nil {
+			return nil, Metadata{}, err
+		}
+
+		messages = append(messages, &msg)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, Metadata{}, err
+	}
+
+	messages, metadata := Paginate(messages, totalRecords, filters)
+
+	return messages, metadata, nil
+}
+
+// Requeue() moves a dead-lettered message back to pending with a fresh attempt count
+func (m EmailOutboxModel) Requeue(ctx context.Context, id int64) (*EmailMessage, error) {
+	if id < 1 {
+		return nil, ErrRecordNotFound
+	}
+
+	query := `
+		UPDATE email_outbox
+		SET status = 'pending', attempts = 0, next_attempt_at = NOW()
+		WHERE id = $1 AND status = 'failed'
+		RETURNING id, created_at, recipient, template, locale, data, status, attempts, last_error, next_attempt_at, sent_at
+	`
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	msg, err := scanEmailMessage(m.DB.QueryRowContext(ctx, query, id))
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	return msg, nil
+}
+
+// Backlog() returns the number of emails that are due but not yet claimed by a worker, and
+// how long the oldest of them has been waiting. A growing backlog means the worker is stuck or
+// falling behind
+func (m EmailOutboxModel) Backlog(ctx context.Context) (int, time.Duration, error) {
+	query := `
+		SELECT count(*), COALESCE(EXTRACT(EPOCH FROM NOW() - MIN(next_attempt_at)), 0)
+		FROM email_outbox
+		WHERE status = 'pending' AND next_attempt_at <= NOW()
+	`
+
+	var count int
+	var seconds float64
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query).Scan(&count, &seconds)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	return count, time.Duration(seconds * float64(time.Second)), nil
+}
+
+func scanEmailMessage(row rowScanner) (*EmailMessage, error) {
+	var msg EmailMessage
+	var data []byte
+
+	err := row.Scan(
+		&msg.ID,
+		&msg.CreatedAt,
+		&msg.Recipient,
+		&msg.Template,
+		&msg.Locale,
+		&data,
+		&msg.Status,
+		&msg.Attempts,
+		&msg.LastError,
+		&msg.NextAttemptAt,
+		&msg.SentAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	err = json.Unmarshal(data, &msg.Data)
+	if err != nil {
+		return nil, err
+	}
+
+	return &msg, nil
+}
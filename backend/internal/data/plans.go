@@ -0,0 +1,135 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+)
+
+// PlanFree is the plan every new user starts on
+const PlanFree = "free"
+
+// Plan is a tier users can be assigned to. The rate limits of each plan are described in the rate
+// limit policy file, keyed by the plan's code, while its backtest quota is stored with it
+type Plan struct {
+	Code      string    `json:"code"`
+	Name      string    `json:"name"`
+	Quota     Quota     `json:"quota"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// Quota limits how much backtesting compute a user on the plan can use. A monthly limit of 0
+// means unlimited
+type Quota struct {
+	MaxConcurrentRuns     int   `json:"max_concurrent_runs"`
+	MonthlyComputeSeconds int64 `json:"monthly_compute_seconds"`
+	MonthlyBars           int64 `json:"monthly_bars"`
+}
+
+type PlanModel struct {
+	DB querier
+}
+
+func (m PlanModel) Get(ctx context.Context, code string) (*Plan, error) {
+	query := `
+		SELECT code, name, max_concurrent_runs, monthly_compute_seconds, monthly_bars, created_at
+		FROM plans
+		WHERE code = $1
+	`
+
+	var plan Plan
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, code).Scan(
+		&plan.Code,
+		&plan.Name,
+		&plan.Quota.MaxConcurrentRuns,
+		&plan.Quota.MonthlyComputeSeconds,
+		&plan.Quota.MonthlyBars,
+		&plan.CreatedAt,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	return &plan, nil
+}
+
+func (m PlanModel) GetAll(ctx context.Context) ([]*Plan, error) {
+	query := `
+		SELECT code, name, max_concurrent_runs, monthly_compute_seconds, monthly_bars, created_at
+		FROM plans
+		ORDER BY created_at, code
+	`
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	plans := []*Plan{}
+
+	for rows.Next() {
+		var plan Plan
+
+		err := rows.Scan(
+			&plan.Code,
+			&plan.Name,
+			&plan.Quota.MaxConcurrentRuns,
+			&plan.Quota.MonthlyComputeSeconds,
+			&plan.Quota.MonthlyBars,
+			&plan.CreatedAt,
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		plans = append(plans, &plan)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return plans, nil
+}
+
+// SetForUser() moves a user to another plan. It's separate from UserModel.Update() so that a user
+// editing their own profile can never change their plan
+func (m PlanModel) SetForUser(ctx context.Context, userID int64, code string) error {
+	query := `
+		UPDATE users
+		SET plan = $1, version = version + 1
+		WHERE id = $2
+	`
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, code, userID)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return ErrRecordNotFound
+	}
+
+	return nil
+}
@@ -5,6 +5,8 @@ import (
 	"database/sql"
 	"errors"
 	"fmt"
+	"regexp"
+	"strings"
 	"time"
 
 	"github.com/lib/pq"
@@ -22,11 +24,95 @@ type Strategy struct {
 	ID        int64     `json:"id"`
 	CreatedAt time.Time `json:"-"`
 	Name      string    `json:"name"`
-	Public    bool      `json:"public"`
-	Fields    []string  `json:"fields,omitempty"`
-	Criteria  []string  `json:"criteria,omitempty"`
-	UserID    int64     `json:"user_id"`
-	Version   int32     `json:"version"`
+	// Description is free-form markdown, stored as written and rendered by clients
+	Description string   `json:"description,omitempty"`
+	Public      bool     `json:"public"`
+	Fields      []string `json:"fields,omitempty"`
+	Criteria    []string `json:"criteria,omitempty"`
+	Tags        []string `json:"tags,omitempty"`
+	// FolderID is the owner's folder the strategy is filed in, nil at the top level
+	FolderID *int64 `json:"folder_id,omitempty"`
+	UserID   int64  `json:"user_id"`
+	Version  int32  `json:"version"`
+	// Rank is how well the strategy matched a search, set by GetAll()
+	Rank float64 `json:"rank,omitempty"`
+}
+
+// TagRX matches tags, which NormalizeTags() lowercases before they're validated
+var TagRX = regexp.MustCompile("^[a-z0-9][a-z0-9_-]{0,49}$")
+
+// NormalizeTags() trims and lowercases tags so "FX " and "fx" are the same tag
+func NormalizeTags(tags []string) []string {
+	normalized := make([]string, len(tags))
+
+	for i, tag := range tags {
+		normalized[i] = strings.ToLower(strings.TrimSpace(tag))
+	}
+
+	return normalized
+}
+
+// ValidateTag() checks a single tag, recording any error under key
+func ValidateTag(v *validator.Validator, key, tag string) {
+	v.Check(validator.Matches(tag, TagRX), key, "must only contain lowercase letters, digits, hyphens and underscores, and be at most 50 characters")
+}
+
+func (s *Strategy) SortKey(column string) (int64, interface{}) {
+	switch column {
+	case "name":
+		return s.ID, s.Name
+	case "fields":
+		return s.ID, s.Fields
+	case "created_at":
+		return s.ID, s.CreatedAt
+	case "rank":
+		return s.ID, s.Rank
+	default:
+		return s.ID, s.ID
+	}
+}
+
+// StrategyFilter narrows the strategies listed by GetAll(), zero values don't filter
+type StrategyFilter struct {
+	// Search is matched against the name and description, and results are ranked with name
+	// matches above description matches
+	Search string
+	// Fields matches strategies using every one of the fields, or declaring none
+	Fields []string
+	// Criteria and Tags match strategies with every one of the values, AnyTags those with at
+	// least one
+	Criteria []string
+	Tags     []string
+	AnyTags  []string
+	Public   *bool
+	OwnerID  int64
+	// FolderID matches strategies filed in the folder or any of its subfolders
+	FolderID int64
+	Created  TimeRange
+}
+
+// TimeRange bounds a timestamp column by the gt, gte, lt and lte operators of the query string
+// filter grammar, nil bounds are left open
+type TimeRange struct {
+	GT  *time.Time
+	GTE *time.Time
+	LT  *time.Time
+	LTE *time.Time
+}
+
+// Contains() reports whether t is within the range
+func (r TimeRange) Contains(t time.Time) bool {
+	return (r.GT == nil || t.After(*r.GT)) &&
+		(r.GTE == nil || !t.Before(*r.GTE)) &&
+		(r.LT == nil || t.Before(*r.LT)) &&
+		(r.LTE == nil || !t.After(*r.LTE))
+}
+
+func ValidateStrategyFilter(v *validator.Validator, filter StrategyFilter) {
+	v.Check(len(filter.Search) <= 500, "search", "must not be more than 500 bytes long")
+	v.Check(filter.OwnerID >= 0, "owner", "must be a positive integer or me")
+	v.Check(filter.FolderID >= 0, "folder", "must be a positive integer")
+	v.Check(len(filter.Tags)+len(filter.AnyTags) <= 20, "tags", "must not filter by more than 20 tags")
 }
 
 func ValidateStrategy(v *validator.Validator, strategy *Strategy) {
@@ -36,6 +122,24 @@ func ValidateStrategy(v *validator.Validator, strategy *Strategy) {
 	v.Check(len(strategy.Criteria) >= 1, "criteria", "must contain at least 1 criterium")
 	v.Check(validator.Unique(strategy.Fields), "fields", "must not contain duplicate values")
 	v.Check(validator.Unique(strategy.Criteria), "criteria", "must not contain duplicate values")
+
+	ValidateStrategyDetails(v, strategy)
+}
+
+// ValidateStrategyDetails() checks the description, tags and folder, the parts of a strategy the
+// API manages. The rest is owned by the Backtrader service, which validates it itself
+func ValidateStrategyDetails(v *validator.Validator, strategy *Strategy) {
+	v.Check(len(strategy.Description) <= 10_000, "description", "must not be more than 10000 bytes long")
+	v.Check(len(strategy.Tags) <= 20, "tags", "must not contain more than 20 tags")
+	v.Check(validator.Unique(strategy.Tags), "tags", "must not contain duplicate values")
+
+	for _, tag := range strategy.Tags {
+		ValidateTag(v, "tags", tag)
+	}
+
+	if strategy.FolderID != nil {
+		v.Check(*strategy.FolderID > 0, "folder_id", "must be a positive integer")
+	}
 }
 
 func IsOwner(userID int64, strategy *Strategy) bool {
@@ -43,48 +147,90 @@ func IsOwner(userID int64, strategy *Strategy) bool {
 }
 
 type StrategyModel struct {
-	DB *sql.DB
+	DB querier
 }
 
-func (s StrategyModel) Insert(userID int64, strategy *Strategy) error {
+func (s StrategyModel) Insert(ctx context.Context, userID int64, strategy *Strategy) error {
 	query := `
-		INSERT INTO strategies (name, fields, criteria, public, user_id)
-		VALUES ($1, $2, $3, $4, $5)
+		INSERT INTO strategies (name, description, fields, criteria, tags, folder_id, public, user_id)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
 		RETURNING id, created_at, version
 	`
 
 	args := []interface{}{
 		strategy.Name,
+		strategy.Description,
 		pq.Array(strategy.Fields),
 		pq.Array(strategy.Criteria),
+		pq.Array(nonNil(strategy.Tags)),
+		strategy.FolderID,
 		strategy.Public,
 		userID,
 	}
 
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
 	defer cancel()
 
 	return s.DB.QueryRowContext(ctx, query, args...).Scan(&strategy.ID, &strategy.CreatedAt, &strategy.Version)
 }
 
-func (s StrategyModel) GetAll(userID int64, name string, fields []string, filters Filters) ([]*Strategy, Metadata, error) {
+// strategySearchVector holds the name and description's lexemes, weighted for ts_rank(). It's the
+// expression strategies_search_idx is built on in migrations/000019_add_strategies_search_index.up.sql,
+// so the two have to stay the same
+const strategySearchVector = `(setweight(to_tsvector('simple', name), 'A') || setweight(to_tsvector('simple', description), 'B'))`
+
+func (s StrategyModel) GetAll(ctx context.Context, userID int64, filter StrategyFilter, filters Filters) ([]*Strategy, Metadata, error) {
 	// to_tsvector('simple', s) takes a string and splits it into lexemes, which is a basic lexical unit of words
 	// planto_tsquery('simple', s) takes a string and converts it to a formatted query term by
 	// stripping special characters and inserts the & operator between words
 	// @@ operator is the matching operator, checks if the query terms match the lexemes
-	// @> operator is the contains operator
-	query := fmt.Sprintf(
-		`SELECT count(*) OVER(), id, created_at, name, fields, criteria, public, version
-		FROM strategies
-		WHERE (to_tsvector('simple', name) @@ plainto_tsquery('simple', $1) OR $1 = '')
-		AND (fields @> $2 OR fields = '{}') AND (public = true OR user_id = $3)
-		ORDER BY %s %s, id ASC
-		LIMIT $4 OFFSET $5`, filters.sortColumn(), filters.sortDirection())
+	// @> operator is the contains operator, && is the overlaps operator
+	args := []interface{}{
+		filter.Search,
+		pq.Array(nonNil(filter.Fields)),
+		pq.Array(nonNil(filter.Criteria)),
+		pq.Array(nonNil(filter.Tags)),
+		pq.Array(nonNil(filter.AnyTags)),
+		filter.Public,
+		filter.OwnerID,
+		filter.Created.GT,
+		filter.Created.GTE,
+		filter.Created.LT,
+		filter.Created.LTE,
+		userID,
+		filter.FolderID,
+	}
 
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
-	defer cancel()
+	keyset, args := filters.keyset(args, "ASC")
+	window, args := filters.window(args)
 
-	args := []interface{}{name, pq.Array(fields), userID, filters.limit(), filters.offset()}
+	query := fmt.Sprintf(
+		`SELECT * FROM (
+			SELECT %s, id, created_at, name, description, fields, criteria, tags, folder_id, public, user_id, version,
+			CASE WHEN $1 = '' THEN 0 ELSE ts_rank(%s, plainto_tsquery('simple', $1)) END::double precision AS rank
+			FROM strategies
+			WHERE (%s @@ plainto_tsquery('simple', $1) OR $1 = '')
+			AND (fields @> $2 OR fields = '{}') AND criteria @> $3
+			AND tags @> $4 AND (tags && $5 OR $5 = '{}')
+			AND (public = $6 OR $6 IS NULL) AND (user_id = $7 OR $7 = 0)
+			AND (created_at > $8 OR $8 IS NULL) AND (created_at >= $9 OR $9 IS NULL)
+			AND (created_at < $10 OR $10 IS NULL) AND (created_at <= $11 OR $11 IS NULL)
+			AND (public = true OR user_id = $12)
+			AND ($13 = 0 OR folder_id IN (
+				WITH RECURSIVE subtree AS (
+					SELECT id FROM strategy_folders WHERE id = $13
+					UNION ALL
+					SELECT f.id FROM strategy_folders f JOIN subtree ON f.parent_id = subtree.id
+				)
+				SELECT id FROM subtree
+			))
+		) AS matches
+		WHERE %s
+		ORDER BY %s
+		%s`, filters.totalColumn(), strategySearchVector, strategySearchVector, keyset, filters.orderBy("ASC"), window)
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
 
 	rows, err := s.DB.QueryContext(ctx, query, args...)
 	if err != nil {
@@ -104,10 +250,15 @@ func (s StrategyModel) GetAll(userID int64, name string, fields []string, filter
 			&strategy.ID,
 			&strategy.CreatedAt,
 			&strategy.Name,
+			&strategy.Description,
 			pq.Array(&strategy.Fields),
 			pq.Array(&strategy.Criteria),
+			pq.Array(&strategy.Tags),
+			&strategy.FolderID,
 			&strategy.Public,
+			&strategy.UserID,
 			&strategy.Version,
+			&strategy.Rank,
 		)
 		if err != nil {
 			return nil, Metadata{}, err
@@ -120,34 +271,88 @@ func (s StrategyModel) GetAll(userID int64, name string, fields []string, filter
 		return nil, Metadata{}, err
 	}
 
-	metadata := calculateMetadata(totalRecords, filters.Page, filters.PageSize)
+	strategies, metadata := Paginate(strategies, totalRecords, filters)
 
 	return strategies, metadata, nil
 }
 
-func (s StrategyModel) Get(userID int64, strategyID int64) (*Strategy, error) {
+// GetAllForUser() returns every strategy owned by the user, public or not
+func (s StrategyModel) GetAllForUser(ctx context.Context, userID int64) ([]*Strategy, error) {
+	query := `
+		SELECT id, created_at, name, description, fields, criteria, tags, folder_id, public, user_id, version
+		FROM strategies
+		WHERE user_id = $1
+		ORDER BY id
+	`
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	rows, err := s.DB.QueryContext(ctx, query, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	strategies := []*Strategy{}
+
+	for rows.Next() {
+		var strategy Strategy
+
+		err := rows.Scan(
+			&strategy.ID,
+			&strategy.CreatedAt,
+			&strategy.Name,
+			&strategy.Description,
+			pq.Array(&strategy.Fields),
+			pq.Array(&strategy.Criteria),
+			pq.Array(&strategy.Tags),
+			&strategy.FolderID,
+			&strategy.Public,
+			&strategy.UserID,
+			&strategy.Version,
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		strategies = append(strategies, &strategy)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return strategies, nil
+}
+
+func (s StrategyModel) Get(ctx context.Context, userID int64, strategyID int64) (*Strategy, error) {
 	if strategyID < 1 {
 		return nil, ErrRecordNotFound
 	}
 
 	query := `
-		SELECT id, name, created_at, public, fields, criteria, user_id, version
+		SELECT id, name, description, created_at, public, fields, criteria, tags, folder_id, user_id, version
 		FROM strategies
 		WHERE id = $1 AND user_id = $2
 	`
 
 	var strategy Strategy
 
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
 	defer cancel()
 
 	err := s.DB.QueryRowContext(ctx, query, strategyID, userID).Scan(
 		&strategy.ID,
 		&strategy.Name,
+		&strategy.Description,
 		&strategy.CreatedAt,
 		&strategy.Public,
 		pq.Array(&strategy.Fields),
 		pq.Array(&strategy.Criteria),
+		pq.Array(&strategy.Tags),
+		&strategy.FolderID,
 		&strategy.UserID,
 		&strategy.Version,
 	)
@@ -164,25 +369,29 @@ func (s StrategyModel) Get(userID int64, strategyID int64) (*Strategy, error) {
 	return &strategy, nil
 }
 
-func (s StrategyModel) Update(userID int64, strategy *Strategy) error {
+func (s StrategyModel) Update(ctx context.Context, userID int64, strategy *Strategy) error {
 	query := `
 		UPDATE strategies
-		SET name = $1, public = $2, fields = $3, criteria = $4, version = version + 1
-		WHERE id = $5 AND user_id = $6 AND version = $7
+		SET name = $1, description = $2, public = $3, fields = $4, criteria = $5, tags = $6, folder_id = $7,
+		version = version + 1
+		WHERE id = $8 AND user_id = $9 AND version = $10
 		RETURNING version
 	`
 
 	args := []interface{}{
 		strategy.Name,
+		strategy.Description,
 		strategy.Public,
 		pq.Array(strategy.Fields),
 		pq.Array(strategy.Criteria),
+		pq.Array(nonNil(strategy.Tags)),
+		strategy.FolderID,
 		strategy.ID,
 		userID,
 		strategy.Version,
 	}
 
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
 	defer cancel()
 
 	err := s.DB.QueryRowContext(ctx, query, args...).Scan(&strategy.Version)
@@ -198,7 +407,7 @@ func (s StrategyModel) Update(userID int64, strategy *Strategy) error {
 	return nil
 }
 
-func (s StrategyModel) Delete(userID int64, strategyID int64) error {
+func (s StrategyModel) Delete(ctx context.Context, userID int64, strategyID int64) error {
 	if strategyID < 1 {
 		return ErrRecordNotFound
 	}
@@ -208,7 +417,7 @@ func (s StrategyModel) Delete(userID int64, strategyID int64) error {
 		WHERE id = $1 AND user_id = $2
 	`
 
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
 	defer cancel()
 
 	result, err := s.DB.ExecContext(ctx, query, strategyID, userID)
@@ -227,3 +436,97 @@ func (s StrategyModel) Delete(userID int64, strategyID int64) error {
 
 	return nil
 }
+
+// TagCount is a tag and how many of the user's strategies have it
+type TagCount struct {
+	Tag        string `json:"tag"`
+	Strategies int    `json:"strategies"`
+}
+
+// GetTags() returns the tags on the user's strategies, sorted by tag
+func (s StrategyModel) GetTags(ctx context.Context, userID int64) ([]*TagCount, error) {
+	query := `
+		SELECT tag, count(*)
+		FROM strategies, unnest(tags) AS tag
+		WHERE user_id = $1
+		GROUP BY tag
+		ORDER BY tag
+	`
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	rows, err := s.DB.QueryContext(ctx, query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	tags := []*TagCount{}
+
+	for rows.Next() {
+		var tag TagCount
+
+		err := rows.Scan(&tag.Tag, &tag.Strategies)
+		if err != nil {
+			return nil, err
+		}
+
+		tags = append(tags, &tag)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return tags, nil
+}
+
+// RenameTag() replaces a tag on every one of the user's strategies, merging it into newTag where a
+// strategy already has both. It returns the number of strategies changed
+func (s StrategyModel) RenameTag(ctx context.Context, userID int64, tag, newTag string) (int64, error) {
+	query := `
+		UPDATE strategies
+		SET tags = CASE WHEN $3 = ANY(tags) THEN array_remove(tags, $2) ELSE array_replace(tags, $2, $3) END,
+		version = version + 1
+		WHERE user_id = $1 AND $2 = ANY(tags)
+	`
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	result, err := s.DB.ExecContext(ctx, query, userID, tag, newTag)
+	if err != nil {
+		return 0, err
+	}
+
+	return result.RowsAffected()
+}
+
+// DeleteTag() removes a tag from every one of the user's strategies, returning the number changed
+func (s StrategyModel) DeleteTag(ctx context.Context, userID int64, tag string) (int64, error) {
+	query := `
+		UPDATE strategies
+		SET tags = array_remove(tags, $2), version = version + 1
+		WHERE user_id = $1 AND $2 = ANY(tags)
+	`
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	result, err := s.DB.ExecContext(ctx, query, userID, tag)
+	if err != nil {
+		return 0, err
+	}
+
+	return result.RowsAffected()
+}
+
+// nonNil() returns an empty slice in place of nil, which pq.Array() would send as NULL rather than
+// an empty array
+func nonNil(values []string) []string {
+	if values == nil {
+		return []string{}
+	}
+
+	return values
+}
@@ -0,0 +1,82 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"regexp"
+	"strings"
+
+	"github.com/lyttonliao/StratCheck/internal/tracing"
+)
+
+// tracedQuerier starts a span for every statement run through it. Spans only nest under a request
+// when the context passed to the query carries the request's span
+type tracedQuerier struct {
+	q sqlQuerier
+}
+
+func (t tracedQuerier) ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error) {
+	ctx, span := startQuerySpan(ctx, query)
+	defer span.End()
+
+	result, err := t.q.ExecContext(ctx, query, args...)
+	span.SetError(err)
+
+	return result, err
+}
+
+func (t tracedQuerier) QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error) {
+	ctx, span := startQuerySpan(ctx, query)
+	defer span.End()
+
+	rows, err := t.q.QueryContext(ctx, query, args...)
+	span.SetError(err)
+
+	return rows, err
+}
+
+func (t tracedQuerier) QueryRowContext(ctx context.Context, query string, args ...interface{}) rowScanner {
+	ctx, span := startQuerySpan(ctx, query)
+	defer span.End()
+
+	row := t.q.QueryRowContext(ctx, query, args...)
+
+	// A missing row is an expected outcome rather than a failed query
+	if err := row.Err(); !errors.Is(err, sql.ErrNoRows) {
+		span.SetError(err)
+	}
+
+	return row
+}
+
+var tableRX = regexp.MustCompile(`(?i)\b(?:FROM|INTO|UPDATE|JOIN)\s+([a-z_][a-z0-9_]*)`)
+
+// startQuerySpan() names the span after the statement's operation and first table, such as
+// "SELECT users", following the OpenTelemetry database conventions
+func startQuerySpan(ctx context.Context, query string) (context.Context, *tracing.Span) {
+	statement := strings.Join(strings.Fields(query), " ")
+
+	operation := statement
+	if i := strings.IndexByte(statement, ' '); i > 0 {
+		operation = statement[:i]
+	}
+	operation = strings.ToUpper(operation)
+
+	name := operation
+	table := ""
+	if m := tableRX.FindStringSubmatch(statement); m != nil {
+		table = m[1]
+		name += " " + table
+	}
+
+	ctx, span := tracing.Start(ctx, name, tracing.KindClient)
+	span.SetAttribute("db.system", "postgresql")
+	span.SetAttribute("db.operation", operation)
+	span.SetAttribute("db.statement", statement)
+	if table != "" {
+		span.SetAttribute("db.sql.table", table)
+	}
+
+	return ctx, span
+}
@@ -0,0 +1,220 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+)
+
+var (
+	// ErrTooManyRuns is returned when starting a run would exceed the plan's concurrent runs
+	ErrTooManyRuns = errors.New("too many concurrent runs")
+	// ErrQuotaExceeded is returned when the user has used up their plan's monthly quota
+	ErrQuotaExceeded = errors.New("monthly quota exceeded")
+)
+
+const (
+	RunRunning   = "running"
+	RunCompleted = "completed"
+	RunFailed    = "failed"
+	// RunExpired runs never reported back and were given up on by the janitor
+	RunExpired = "expired"
+)
+
+// BacktestRun is a backtest the Backtrader service reserved with a backtest.started event. It
+// holds one of the user's concurrent run slots while running, and its compute is added to the
+// usage ledger once it finishes
+type BacktestRun struct {
+	ID             int64      `json:"id"`
+	UserID         int64      `json:"-"`
+	Status         string     `json:"status"`
+	StartedAt      time.Time  `json:"started_at"`
+	FinishedAt     *time.Time `json:"finished_at,omitempty"`
+	ComputeSeconds float64    `json:"compute_seconds"`
+	BarsProcessed  int64      `json:"bars_processed"`
+}
+
+type BacktestRunModel struct {
+	DB querier
+}
+
+// Start() records a new running backtest unless the user already has maxConcurrent running. The
+// user's row is locked while counting so concurrent submissions can't both take the last slot,
+// which needs a transaction, so call it inside Models.WithTx()
+func (m BacktestRunModel) Start(ctx context.Context, userID int64, maxConcurrent int) (*BacktestRun, error) {
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, `SELECT id FROM users WHERE id = $1 FOR UPDATE`, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	var running int
+
+	query := `SELECT count(*) FROM backtest_runs WHERE user_id = $1 AND status = 'running'`
+
+	err = m.DB.QueryRowContext(ctx, query, userID).Scan(&running)
+	if err != nil {
+		return nil, err
+	}
+
+	if running >= maxConcurrent {
+		return nil, ErrTooManyRuns
+	}
+
+	run := &BacktestRun{UserID: userID, Status: RunRunning}
+
+	query = `
+		INSERT INTO backtest_runs (user_id)
+		VALUES ($1)
+		RETURNING id, started_at
+	`
+
+	err = m.DB.QueryRowContext(ctx, query, userID).Scan(&run.ID, &run.StartedAt)
+	if err != nil {
+		return nil, err
+	}
+
+	return run, nil
+}
+
+// Finish() marks one of the user's running backtests as finished with the compute it used. It
+// returns ErrRecordNotFound if there's no such running backtest, so a run is only charged once
+func (m BacktestRunModel) Finish(ctx context.Context, run *BacktestRun) error {
+	query := `
+		UPDATE backtest_runs
+		SET status = $1, finished_at = NOW(), compute_seconds = $2, bars_processed = $3
+		WHERE id = $4 AND user_id = $5 AND status = 'running'
+		RETURNING started_at, finished_at
+	`
+
+	args := []interface{}{run.Status, run.ComputeSeconds, run.BarsProcessed, run.ID, run.UserID}
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, args...).Scan(&run.StartedAt, &run.FinishedAt)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return ErrRecordNotFound
+		default:
+			return err
+		}
+	}
+
+	return nil
+}
+
+// CountRunning() returns how many backtests the user has running
+func (m BacktestRunModel) CountRunning(ctx context.Context, userID int64) (int, error) {
+	query := `SELECT count(*) FROM backtest_runs WHERE user_id = $1 AND status = 'running'`
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	var running int
+
+	err := m.DB.QueryRowContext(ctx, query, userID).Scan(&running)
+	if err != nil {
+		return 0, err
+	}
+
+	return running, nil
+}
+
+// ExpireStartedBefore() gives up on runs that have been running since before the given time,
+// freeing their slots. The Backtrader service never reported their compute, so none is charged
+func (m BacktestRunModel) ExpireStartedBefore(ctx context.Context, before time.Time) (int64, error) {
+	query := `
+		UPDATE backtest_runs
+		SET status = 'expired', finished_at = NOW()
+		WHERE status = 'running' AND started_at < $1
+	`
+
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, before)
+	if err != nil {
+		return 0, err
+	}
+
+	return result.RowsAffected()
+}
+
+// Usage is a user's backtesting consumption over one calendar month (UTC)
+type Usage struct {
+	Period         time.Time `json:"period"`
+	Runs           int64     `json:"runs"`
+	ComputeSeconds float64   `json:"compute_seconds"`
+	BarsProcessed  int64     `json:"bars_processed"`
+}
+
+// UsagePeriod() returns the start of the month t falls in, which is the key of the usage ledger
+func UsagePeriod(t time.Time) time.Time {
+	t = t.UTC()
+	return time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, time.UTC)
+}
+
+// Exceeds() reports whether the usage has reached either monthly limit of the quota
+func (u Usage) Exceeds(q Quota) bool {
+	return (q.MonthlyComputeSeconds > 0 && u.ComputeSeconds >= float64(q.MonthlyComputeSeconds)) ||
+		(q.MonthlyBars > 0 && u.BarsProcessed >= q.MonthlyBars)
+}
+
+// UsageModel is the usage ledger, holding one row per user per month
+type UsageModel struct {
+	DB querier
+}
+
+// Get() returns the user's usage for the month starting at period, which is zero if nothing has
+// been recorded yet
+func (m UsageModel) Get(ctx context.Context, userID int64, period time.Time) (*Usage, error) {
+	query := `
+		SELECT runs, compute_seconds, bars_processed
+		FROM usage_ledger
+		WHERE user_id = $1 AND period = $2
+	`
+
+	usage := Usage{Period: period}
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, userID, period).Scan(&usage.Runs, &usage.ComputeSeconds, &usage.BarsProcessed)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return nil, err
+	}
+
+	return &usage, nil
+}
+
+// Add() charges a finished run to the ledger for the month it finished in. Call it in the same
+// transaction as BacktestRunModel.Finish() so a run is charged exactly once
+func (m UsageModel) Add(ctx context.Context, run *BacktestRun) error {
+	query := `
+		INSERT INTO usage_ledger (user_id, period, runs, compute_seconds, bars_processed)
+		VALUES ($1, $2, 1, $3, $4)
+		ON CONFLICT (user_id, period) DO UPDATE
+		SET runs = usage_ledger.runs + 1,
+		compute_seconds = usage_ledger.compute_seconds + EXCLUDED.compute_seconds,
+		bars_processed = usage_ledger.bars_processed + EXCLUDED.bars_processed,
+		updated_at = NOW()
+	`
+
+	period := UsagePeriod(time.Now())
+	if run.FinishedAt != nil {
+		period = UsagePeriod(*run.FinishedAt)
+	}
+
+	args := []interface{}{run.UserID, period, run.ComputeSeconds, run.BarsProcessed}
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, args...)
+	return err
+}
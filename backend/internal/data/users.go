@@ -4,7 +4,10 @@ import (
 	"context"
 	"crypto/sha256"
 	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
 	"errors"
+	"regexp"
 	"time"
 
 	"golang.org/x/crypto/bcrypt"
@@ -19,13 +22,72 @@ var (
 var AnonymousUser = &User{}
 
 type User struct {
-	ID        int64     `json:"id"`
-	CreatedAt time.Time `json:"created_at"`
-	Name      string    `json:"name"`
-	Email     string    `json:"email"`
-	Password  password  `json:"-"`
-	Activated bool      `json:"activated"`
-	Version   int       `json:"-"`
+	ID           int64       `json:"id"`
+	CreatedAt    time.Time   `json:"created_at"`
+	Name         string      `json:"name"`
+	Email        string      `json:"email"`
+	PendingEmail string      `json:"pending_email,omitempty"`
+	Password     password    `json:"-"`
+	Activated    bool        `json:"activated"`
+	Preferences  Preferences `json:"preferences"`
+	// DeletionScheduledAt is set when the user has asked for their account to be deleted and
+	// holds the time after which it will be purged, nil otherwise
+	DeletionScheduledAt *time.Time `json:"deletion_scheduled_at,omitempty"`
+	// Plan is the code of the user's plan tier, which decides their rate limits
+	Plan    string `json:"plan"`
+	Version int    `json:"version"`
+}
+
+// LanguageRX matches a two letter language code with an optional region, e.g. "en" or "fr-CA"
+var LanguageRX = regexp.MustCompile("^[a-z]{2}(-[A-Z]{2})?$")
+
+// Preferences holds user settings, stored in the users.preferences jsonb column
+type Preferences struct {
+	Language      string                  `json:"language,omitempty"`
+	Timezone      string                  `json:"timezone,omitempty"`
+	Notifications NotificationPreferences `json:"notifications"`
+}
+
+// DefaultPreferences() returns the preferences of a new user. Keys missing from the stored
+// jsonb keep these values when it is scanned
+func DefaultPreferences() Preferences {
+	return Preferences{
+		Notifications: DefaultNotificationPreferences(),
+	}
+}
+
+// Value() satisfies the driver.Valuer interface so Preferences can be written as jsonb
+func (p Preferences) Value() (driver.Value, error) {
+	return json.Marshal(p)
+}
+
+// Scan() satisfies the sql.Scanner interface so a jsonb column can be read into Preferences
+func (p *Preferences) Scan(src interface{}) error {
+	*p = DefaultPreferences()
+
+	switch src := src.(type) {
+	case []byte:
+		return json.Unmarshal(src, p)
+	case string:
+		return json.Unmarshal([]byte(src), p)
+	case nil:
+		return nil
+	default:
+		return errors.New("incompatible type for preferences")
+	}
+}
+
+func ValidatePreferences(v *validator.Validator, preferences Preferences) {
+	if preferences.Language != "" {
+		v.Check(validator.Matches(preferences.Language, LanguageRX), "preferences.language", "must be a language code such as en or fr-CA")
+	}
+
+	if preferences.Timezone != "" {
+		_, err := time.LoadLocation(preferences.Timezone)
+		v.Check(err == nil, "preferences.timezone", "must be a valid IANA time zone")
+	}
+
+	ValidateNotificationPreferences(v, preferences.Notifications)
 }
 
 func (u *User) IsAnonymous() bool {
@@ -74,9 +136,10 @@ func ValidateEmail(v *validator.Validator, email string) {
 	v.Check(validator.Matches(email, validator.EmailRX), "email", "must be a valid email address")
 }
 
+// ValidatePasswordPlaintext() only checks what bcrypt needs. The minimum length and other rules for
+// new passwords are left to the configured validator.PasswordPolicy
 func ValidatePasswordPlaintext(v *validator.Validator, password string) {
 	v.Check(password != "", "password", "must be provided")
-	v.Check(len(password) >= 8, "password", "must be at least 8 characters long")
 	v.Check(len(password) <= 72, "password", "must be more than 72 characters long")
 }
 
@@ -85,6 +148,7 @@ func ValidateUser(v *validator.Validator, user *User) {
 	v.Check(len(user.Name) <= 50, "name", "must not be more than 50 characters long")
 
 	ValidateEmail(v, user.Email)
+	ValidatePreferences(v, user.Preferences)
 
 	if user.Password.plaintext != nil {
 		ValidatePasswordPlaintext(v, *user.Password.plaintext)
@@ -97,25 +161,25 @@ func ValidateUser(v *validator.Validator, user *User) {
 }
 
 type UserModel struct {
-	DB *sql.DB
+	DB querier
 }
 
-func (m UserModel) Insert(user *User) error {
+func (m UserModel) Insert(ctx context.Context, user *User) error {
 	query := `
-		INSERT INTO users (name, email, password_hash, activated)
-		VALUES ($1, $2, $3, $4)
-		RETURNING id, created_at, version
+		INSERT INTO users (name, email, password_hash, activated, preferences)
+		VALUES ($1, $2, $3, $4, $5)
+		RETURNING id, created_at, plan, version
 	`
 
-	args := []interface{}{user.Name, user.Email, user.Password.hash, user.Activated}
+	args := []interface{}{user.Name, user.Email, user.Password.hash, user.Activated, user.Preferences}
 
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
 	defer cancel()
 
-	err := m.DB.QueryRowContext(ctx, query, args...).Scan(&user.ID, &user.CreatedAt, &user.Version)
+	err := m.DB.QueryRowContext(ctx, query, args...).Scan(&user.ID, &user.CreatedAt, &user.Plan, &user.Version)
 	if err != nil {
 		switch {
-		case err.Error() == `pq: duplicate key value violates unique constraint "users_email_key"`:
+		case IsConstraint(err, "users_email_key"):
 			return ErrDuplicateEmail
 		default:
 			return err
@@ -125,16 +189,60 @@ func (m UserModel) Insert(user *User) error {
 	return nil
 }
 
-func (m UserModel) GetByEmail(email string) (*User, error) {
+func (m UserModel) Get(ctx context.Context, id int64) (*User, error) {
+	if id < 1 {
+		return nil, ErrRecordNotFound
+	}
+
 	query := `
-		SELECT id, created_at, name, email, password_hash, activated, version
+		SELECT id, created_at, name, email, pending_email, password_hash, activated, preferences,
+		deletion_scheduled_at, plan, version
+		FROM users
+		WHERE id = $1
+	`
+
+	var user User
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, id).Scan(
+		&user.ID,
+		&user.CreatedAt,
+		&user.Name,
+		&user.Email,
+		&user.PendingEmail,
+		&user.Password.hash,
+		&user.Activated,
+		&user.Preferences,
+		&user.DeletionScheduledAt,
+		&user.Plan,
+		&user.Version,
+	)
+
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	return &user, nil
+}
+
+func (m UserModel) GetByEmail(ctx context.Context, email string) (*User, error) {
+	query := `
+		SELECT id, created_at, name, email, pending_email, password_hash, activated, preferences,
+		deletion_scheduled_at, plan, version
 		FROM users
 		WHERE email = $1
 	`
 
 	var user User
 
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
 	defer cancel()
 
 	err := m.DB.QueryRowContext(ctx, query, email).Scan(
@@ -142,8 +250,12 @@ func (m UserModel) GetByEmail(email string) (*User, error) {
 		&user.CreatedAt,
 		&user.Name,
 		&user.Email,
+		&user.PendingEmail,
 		&user.Password.hash,
 		&user.Activated,
+		&user.Preferences,
+		&user.DeletionScheduledAt,
+		&user.Plan,
 		&user.Version,
 	)
 
@@ -159,33 +271,37 @@ func (m UserModel) GetByEmail(email string) (*User, error) {
 	return &user, nil
 }
 
-func (m UserModel) Update(user *User) error {
+func (m UserModel) Update(ctx context.Context, user *User) error {
 	query := `
 		UPDATE users
-		SET name = $1, email = $2, password_hash = $3, activated = $4, version = version + 1
-		WHERE id = $5 AND version = $6
+		SET name = $1, email = $2, pending_email = $3, password_hash = $4, activated = $5,
+		preferences = $6, deletion_scheduled_at = $7, version = version + 1
+		WHERE id = $8 AND version = $9
 		RETURNING version
 	`
 
 	args := []interface{}{
 		user.Name,
 		user.Email,
+		user.PendingEmail,
 		user.Password.hash,
 		user.Activated,
+		user.Preferences,
+		user.DeletionScheduledAt,
 		user.ID,
 		user.Version,
 	}
 
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
 	defer cancel()
 
 	err := m.DB.QueryRowContext(ctx, query, args...).Scan(&user.Version)
 	if err != nil {
 		switch {
-		case err.Error() == `pq: duplicate key value violates unique constraint "users_email_key"`:
+		case IsConstraint(err, "users_email_key"):
 			return ErrDuplicateEmail
 		case errors.Is(err, sql.ErrNoRows):
-			return ErrRecordNotFound
+			return ErrEditConflict
 		default:
 			return err
 		}
@@ -194,12 +310,13 @@ func (m UserModel) Update(user *User) error {
 	return nil
 }
 
-func (m UserModel) GetForToken(tokenScope, tokenPlaintext string) (*User, error) {
+func (m UserModel) GetForToken(ctx context.Context, tokenScope, tokenPlaintext string) (*User, error) {
 	tokenHash := sha256.Sum256([]byte(tokenPlaintext))
 
 	query := `
-		SELECT users.id, users.created_at, users.name, users.email,
-		users.password_hash, users.activated, users.version
+		SELECT users.id, users.created_at, users.name, users.email, users.pending_email,
+		users.password_hash, users.activated, users.preferences, users.deletion_scheduled_at, users.plan,
+		users.version
 		FROM users
 		INNER JOIN tokens
 		ON users.id = tokens.user_id
@@ -212,7 +329,7 @@ func (m UserModel) GetForToken(tokenScope, tokenPlaintext string) (*User, error)
 
 	var user User
 
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
 	defer cancel()
 
 	err := m.DB.QueryRowContext(ctx, query, args...).Scan(
@@ -220,8 +337,12 @@ func (m UserModel) GetForToken(tokenScope, tokenPlaintext string) (*User, error)
 		&user.CreatedAt,
 		&user.Name,
 		&user.Email,
+		&user.PendingEmail,
 		&user.Password.hash,
 		&user.Activated,
+		&user.Preferences,
+		&user.DeletionScheduledAt,
+		&user.Plan,
 		&user.Version,
 	)
 	if err != nil {
@@ -235,3 +356,138 @@ func (m UserModel) GetForToken(tokenScope, tokenPlaintext string) (*User, error)
 
 	return &user, nil
 }
+
+// DeleteUnactivatedBefore() removes accounts that were never activated and were created before
+// the given time. Their tokens and permissions are removed by the ON DELETE CASCADE constraints
+func (m UserModel) DeleteUnactivatedBefore(ctx context.Context, before time.Time) (int64, error) {
+	query := `
+		DELETE FROM users
+		WHERE activated = false AND created_at < $1
+		AND NOT EXISTS (SELECT 1 FROM strategies WHERE strategies.user_id = users.id)
+	`
+
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, before)
+	if err != nil {
+		return 0, err
+	}
+
+	return result.RowsAffected()
+}
+
+// GetAllScheduledForDeletion() returns the IDs of users whose deletion grace period ended before
+// the given time
+func (m UserModel) GetAllScheduledForDeletion(ctx context.Context, before time.Time) ([]int64, error) {
+	query := `
+		SELECT id
+		FROM users
+		WHERE deletion_scheduled_at IS NOT NULL AND deletion_scheduled_at <= $1
+		ORDER BY id
+	`
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, before)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var ids []int64
+
+	for rows.Next() {
+		var id int64
+
+		err := rows.Scan(&id)
+		if err != nil {
+			return nil, err
+		}
+
+		ids = append(ids, id)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return ids, nil
+}
+
+// Purge() permanently removes a user's personal data. Private strategies, folders, tokens,
+// permissions and the emails sent to the user's addresses are deleted. If the user still owns public strategies that others may rely on, the
+// user row is anonymized rather than deleted so those strategies keep an owner. Call it inside
+// Models.WithTx() so a failure part way through leaves the account untouched
+func (m UserModel) Purge(ctx context.Context, userID int64) error {
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	statements := []string{
+		// The outbox is keyed by address, so it has to go before the user row is anonymized
+		`DELETE FROM email_outbox WHERE recipient IN (
+			SELECT email FROM users WHERE id = $1
+			UNION SELECT pending_email FROM users WHERE id = $1 AND pending_email <> ''
+		)`,
+		`DELETE FROM strategies WHERE user_id = $1 AND public = false`,
+		`DELETE FROM strategy_folders WHERE user_id = $1`,
+		`DELETE FROM tokens WHERE user_id = $1`,
+		`DELETE FROM users_permissions WHERE user_id = $1`,
+		`DELETE FROM notifications WHERE user_id = $1`,
+		`DELETE FROM webhook_deliveries WHERE user_id = $1`,
+		`DELETE FROM webhooks WHERE user_id = $1`,
+		`DELETE FROM backtest_runs WHERE user_id = $1`,
+		`DELETE FROM usage_ledger WHERE user_id = $1`,
+	}
+
+	for _, statement := range statements {
+		_, err := m.DB.ExecContext(ctx, statement, userID)
+		if err != nil {
+			return err
+		}
+	}
+
+	query := `
+		DELETE FROM users
+		WHERE id = $1 AND NOT EXISTS (SELECT 1 FROM strategies WHERE user_id = $1)
+	`
+
+	result, err := m.DB.ExecContext(ctx, query, userID)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected > 0 {
+		return nil
+	}
+
+	// An empty password hash can never match, so the anonymized account cannot be logged into
+	query = `
+		UPDATE users
+		SET name = 'Deleted user', email = 'deleted-' || id || '@users.invalid', pending_email = '',
+		password_hash = '', activated = false, preferences = '{}', deletion_scheduled_at = NULL,
+		version = version + 1
+		WHERE id = $1
+	`
+
+	result, err = m.DB.ExecContext(ctx, query, userID)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err = result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return ErrRecordNotFound
+	}
+
+	return nil
+}
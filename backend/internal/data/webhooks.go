@@ -0,0 +1,558 @@
+package data
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"time"
+
+	"github.com/lib/pq"
+
+	"github.com/lyttonliao/StratCheck/internal/validator"
+)
+
+const (
+	EventStrategyCreated = "strategy.created"
+	EventStrategyUpdated = "strategy.updated"
+	// EventPing is only sent by the test-ping endpoint and can't be subscribed to
+	EventPing = "ping"
+)
+
+// WebhookEvents lists the event types a webhook can subscribe to
+var WebhookEvents = []string{EventStrategyCreated, EventStrategyUpdated, EventBacktestCompleted}
+
+const (
+	DeliveryPending   = "pending"
+	DeliverySucceeded = "succeeded"
+	DeliveryFailed    = "failed"
+)
+
+// Webhook is an endpoint registered by a user to receive events. The secret signs every payload
+// sent to it and is only shown when the webhook is created
+type Webhook struct {
+	ID        int64     `json:"id"`
+	CreatedAt time.Time `json:"created_at"`
+	UserID    int64     `json:"-"`
+	URL       string    `json:"url"`
+	Secret    string    `json:"-"`
+	Events    []string  `json:"events"`
+	Active    bool      `json:"active"`
+	Version   int32     `json:"version"`
+}
+
+// GenerateWebhookSecret() returns a random secret for signing payloads
+func GenerateWebhookSecret() (string, error) {
+	randomBytes := make([]byte, 32)
+
+	_, err := rand.Read(randomBytes)
+	if err != nil {
+		return "", err
+	}
+
+	return "whsec_" + hex.EncodeToString(randomBytes), nil
+}
+
+func ValidateWebhook(v *validator.Validator, webhook *Webhook) {
+	v.Check(webhook.URL != "", "url", "must be provided")
+	v.Check(len(webhook.URL) <= 2000, "url", "must not be more than 2000 bytes long")
+
+	u, err := url.Parse(webhook.URL)
+	v.Check(err == nil && (u.Scheme == "https" || u.Scheme == "http") && u.Host != "", "url", "must be an absolute http or https URL")
+
+	v.Check(len(webhook.Events) >= 1, "events", "must contain at least 1 event")
+	v.Check(validator.Unique(webhook.Events), "events", "must not contain duplicate values")
+
+	for _, event := range webhook.Events {
+		v.Check(validator.In(event, WebhookEvents...), "events", "must only contain known event types")
+	}
+}
+
+type WebhookModel struct {
+	DB querier
+}
+
+func (m WebhookModel) Insert(ctx context.Context, webhook *Webhook) error {
+	query := `
+		INSERT INTO webhooks (user_id, url, secret, events, active)
+		VALUES ($1, $2, $3, $4, $5)
+		RETURNING id, created_at, version
+	`
+
+	args := []interface{}{webhook.UserID, webhook.URL, webhook.Secret, pq.Array(webhook.Events), webhook.Active}
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	return m.DB.QueryRowContext(ctx, query, args...).Scan(&webhook.ID, &webhook.CreatedAt, &webhook.Version)
+}
+
+func (m WebhookModel) Get(ctx context.Context, userID, webhookID int64) (*Webhook, error) {
+	if webhookID < 1 {
+		return nil, ErrRecordNotFound
+	}
+
+	query := `
+		SELECT id, created_at, user_id, url, secret, events, active, version
+		FROM webhooks
+		WHERE id = $1 AND user_id = $2
+	`
+
+	var webhook Webhook
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, webhookID, userID).Scan(
+		&webhook.ID,
+		&webhook.CreatedAt,
+		&webhook.UserID,
+		&webhook.URL,
+		&webhook.Secret,
+		pq.Array(&webhook.Events),
+		&webhook.Active,
+		&webhook.Version,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	return &webhook, nil
+}
+
+// GetByID() looks a webhook up without checking who owns it, for the delivery worker
+func (m WebhookModel) GetByID(ctx context.Context, webhookID int64) (*Webhook, error) {
+	if webhookID < 1 {
+		return nil, ErrRecordNotFound
+	}
+
+	query := `
+		SELECT id, created_at, user_id, url, secret, events, active, version
+		FROM webhooks
+		WHERE id = $1
+	`
+
+	var webhook Webhook
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, webhookID).Scan(
+		&webhook.ID,
+		&webhook.CreatedAt,
+		&webhook.UserID,
+		&webhook.URL,
+		&webhook.Secret,
+		pq.Array(&webhook.Events),
+		&webhook.Active,
+		&webhook.Version,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	return &webhook, nil
+}
+
+// GetAllForUser() returns the user's webhooks. With event set, only active webhooks subscribed to
+// that event are returned
+func (m WebhookModel) GetAllForUser(ctx context.Context, userID int64, event string) ([]*Webhook, error) {
+	query := `
+		SELECT id, created_at, user_id, url, secret, events, active, version
+		FROM webhooks
+		WHERE user_id = $1 AND ($2 = '' OR (active = true AND $2 = ANY(events)))
+		ORDER BY id
+	`
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, userID, event)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	webhooks := []*Webhook{}
+
+	for rows.Next() {
+		var webhook Webhook
+
+		err := rows.Scan(
+			&webhook.ID,
+			&webhook.CreatedAt,
+			&webhook.UserID,
+			&webhook.URL,
+			&webhook.Secret,
+			pq.Array(&webhook.Events),
+			&webhook.Active,
+			&webhook.Version,
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		webhooks = append(webhooks, &webhook)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return webhooks, nil
+}
+
+func (m WebhookModel) Update(ctx context.Context, webhook *Webhook) error {
+	query := `
+		UPDATE webhooks
+		SET url = $1, events = $2, active = $3, version = version + 1
+		WHERE id = $4 AND user_id = $5 AND version = $6
+		RETURNING version
+	`
+
+	args := []interface{}{
+		webhook.URL,
+		pq.Array(webhook.Events),
+		webhook.Active,
+		webhook.ID,
+		webhook.UserID,
+		webhook.Version,
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, args...).Scan(&webhook.Version)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return ErrEditConflict
+		default:
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (m WebhookModel) Delete(ctx context.Context, userID, webhookID int64) error {
+	if webhookID < 1 {
+		return ErrRecordNotFound
+	}
+
+	query := `
+		DELETE FROM webhooks
+		WHERE id = $1 AND user_id = $2
+	`
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, webhookID, userID)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return ErrRecordNotFound
+	}
+
+	return nil
+}
+
+// WebhookDelivery is one event queued for a webhook, together with the outcome of the most
+// recent attempt to deliver it. Notifications for the webhook URL in a user's notification
+// preferences are queued without a webhook, carrying the user and URL instead
+type WebhookDelivery struct {
+	ID            int64           `json:"id"`
+	CreatedAt     time.Time       `json:"created_at"`
+	WebhookID     int64           `json:"webhook_id"`
+	UserID        int64           `json:"-"`
+	URL           string          `json:"-"`
+	Event         string          `json:"event"`
+	Payload       json.RawMessage `json:"payload"`
+	Status        string          `json:"status"`
+	Attempts      int             `json:"attempts"`
+	NextAttemptAt time.Time       `json:"next_attempt_at"`
+	ResponseCode  int             `json:"response_code,omitempty"`
+	ResponseBody  string          `json:"response_body,omitempty"`
+	LastError     string          `json:"last_error,omitempty"`
+	DurationMS    int64           `json:"duration_ms"`
+	DeliveredAt   *time.Time      `json:"delivered_at,omitempty"`
+}
+
+func (d *WebhookDelivery) SortKey(column string) (int64, interface{}) {
+	switch column {
+	case "created_at":
+		return d.ID, d.CreatedAt
+	default:
+		return d.ID, d.ID
+	}
+}
+
+// DeliveryResult is the outcome of a single attempt
+type DeliveryResult struct {
+	ResponseCode int
+	ResponseBody string
+	Err          error
+	Duration     time.Duration
+}
+
+type WebhookDeliveryModel struct {
+	DB querier
+}
+
+const webhookDeliveryColumns = `id, created_at, COALESCE(webhook_id, 0) AS webhook_id, COALESCE(user_id, 0) AS user_id,
+	url, event, payload, status, attempts, next_attempt_at, response_code, response_body, last_error, duration_ms,
+	delivered_at`
+
+func (m WebhookDeliveryModel) Insert(ctx context.Context, delivery *WebhookDelivery) error {
+	query := `
+		INSERT INTO webhook_deliveries (webhook_id, user_id, url, event, payload)
+		VALUES (NULLIF($1, 0), NULLIF($2, 0), $3, $4, $5)
+		RETURNING id, created_at, status, attempts, next_attempt_at
+	`
+
+	args := []interface{}{delivery.WebhookID, delivery.UserID, delivery.URL, delivery.Event, []byte(delivery.Payload)}
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	return m.DB.QueryRowContext(ctx, query, args...).Scan(
+		&delivery.ID,
+		&delivery.CreatedAt,
+		&delivery.Status,
+		&delivery.Attempts,
+		&delivery.NextAttemptAt,
+	)
+}
+
+// Claim() works like EmailOutboxModel.Claim(), leasing due deliveries so concurrent workers skip
+// them. Deliveries for webhooks that have since been deactivated are left alone, those without a
+// webhook are always due
+func (m WebhookDeliveryModel) Claim(ctx context.Context, limit int, lease time.Duration) ([]*WebhookDelivery, error) {
+	query := fmt.Sprintf(`
+		UPDATE webhook_deliveries
+		SET next_attempt_at = NOW() + $2 * interval '1 second'
+		WHERE id IN (
+			SELECT webhook_deliveries.id FROM webhook_deliveries
+			LEFT JOIN webhooks ON webhooks.id = webhook_deliveries.webhook_id
+			WHERE webhook_deliveries.status = 'pending' AND webhook_deliveries.next_attempt_at <= NOW()
+			AND (webhooks.active = true OR webhook_deliveries.webhook_id IS NULL)
+			ORDER BY webhook_deliveries.next_attempt_at
+			LIMIT $1
+			FOR UPDATE OF webhook_deliveries SKIP LOCKED
+		)
+		RETURNING %s`, webhookDeliveryColumns)
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, limit, lease.Seconds())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	deliveries := []*WebhookDelivery{}
+
+	for rows.Next() {
+		delivery, err := scanWebhookDelivery(rows)
+		if err != nil {
+			return nil, err
+		}
+
+		deliveries = append(deliveries, delivery)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return deliveries, nil
+}
+
+// Record() stores the outcome of an attempt. A failed attempt is retried at nextAttempt unless
+// dead is true
+func (m WebhookDeliveryModel) Record(ctx context.Context, delivery *WebhookDelivery, result DeliveryResult, nextAttempt time.Time, dead bool) error {
+	delivery.Attempts++
+	delivery.ResponseCode = result.ResponseCode
+	delivery.ResponseBody = result.ResponseBody
+	delivery.DurationMS = result.Duration.Milliseconds()
+	delivery.LastError = ""
+	delivery.NextAttemptAt = nextAttempt
+
+	switch {
+	case result.Err == nil:
+		now := time.Now()
+		delivery.Status = DeliverySucceeded
+		delivery.DeliveredAt = &now
+	case dead:
+		delivery.Status = DeliveryFailed
+		delivery.LastError = result.Err.Error()
+	default:
+		delivery.Status = DeliveryPending
+		delivery.LastError = result.Err.Error()
+	}
+
+	query := `
+		UPDATE webhook_deliveries
+		SET status = $1, attempts = $2, next_attempt_at = $3, response_code = $4, response_body = $5,
+		last_error = $6, duration_ms = $7, delivered_at = $8
+		WHERE id = $9
+	`
+
+	args := []interface{}{
+		delivery.Status,
+		delivery.Attempts,
+		delivery.NextAttemptAt,
+		delivery.ResponseCode,
+		delivery.ResponseBody,
+		delivery.LastError,
+		delivery.DurationMS,
+		delivery.DeliveredAt,
+		delivery.ID,
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, args...)
+	return err
+}
+
+// GetAllForWebhook() returns the delivery log of a webhook, newest first by default
+func (m WebhookDeliveryModel) GetAllForWebhook(ctx context.Context, webhookID int64, status string, filters Filters) ([]*WebhookDelivery, Metadata, error) {
+	keyset, args := filters.keyset([]interface{}{webhookID, status}, "DESC")
+	window, args := filters.window(args)
+
+	query := fmt.Sprintf(`
+		SELECT * FROM (
+			SELECT %s, %s
+			FROM webhook_deliveries
+			WHERE webhook_id = $1 AND (status = $2 OR $2 = '')
+		) AS matches
+		WHERE %s
+		ORDER BY %s
+		%s`, filters.totalColumn(), webhookDeliveryColumns, keyset, filters.orderBy("DESC"), window)
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+	defer rows.Close()
+
+	totalRecords := 0
+	deliveries := []*WebhookDelivery{}
+
+	for rows.Next() {
+		var delivery WebhookDelivery
+		var payload []byte
+
+		err := rows.Scan(
+			&totalRecords,
+			&delivery.ID,
+			&delivery.CreatedAt,
+			&delivery.WebhookID,
+			&delivery.UserID,
+			&delivery.URL,
+			&delivery.Event,
+			&payload,
+			&delivery.Status,
+			&delivery.Attempts,
+			&delivery.NextAttemptAt,
+			&delivery.ResponseCode,
+			&delivery.ResponseBody,
+			&delivery.LastError,
+			&delivery.DurationMS,
+			&delivery.DeliveredAt,
+		)
+		if err != nil {
+			return nil, Metadata{}, err
+		}
+
+		delivery.Payload = payload
+		deliveries = append(deliveries, &delivery)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, Metadata{}, err
+	}
+
+	deliveries, metadata := Paginate(deliveries, totalRecords, filters)
+
+	return deliveries, metadata, nil
+}
+
+// Backlog() returns the number of deliveries that are due but not yet claimed by a worker, and
+// how long the oldest of them has been waiting. A growing backlog means the worker is stuck or
+// falling behind
+func (m WebhookDeliveryModel) Backlog(ctx context.Context) (int, time.Duration, error) {
+	query := `
+		SELECT count(*), COALESCE(EXTRACT(EPOCH FROM NOW() - MIN(next_attempt_at)), 0)
+		FROM webhook_deliveries
+		WHERE status = 'pending' AND next_attempt_at <= NOW()
+	`
+
+	var count int
+	var seconds float64
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query).Scan(&count, &seconds)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	return count, time.Duration(seconds * float64(time.Second)), nil
+}
+
+func scanWebhookDelivery(row rowScanner) (*WebhookDelivery, error) {
+	var delivery WebhookDelivery
+	var payload []byte
+
+	err := row.Scan(
+		&delivery.ID,
+		&delivery.CreatedAt,
+		&delivery.WebhookID,
+		&delivery.UserID,
+		&delivery.URL,
+		&delivery.Event,
+		&payload,
+		&delivery.Status,
+		&delivery.Attempts,
+		&delivery.NextAttemptAt,
+		&delivery.ResponseCode,
+		&delivery.ResponseBody,
+		&delivery.LastError,
+		&delivery.DurationMS,
+		&delivery.DeliveredAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	delivery.Payload = payload
+
+	return &delivery, nil
+}
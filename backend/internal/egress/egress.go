@@ -0,0 +1,181 @@
+// Package egress guards requests sent to URLs chosen by users, such as webhooks, so they can't be
+// pointed at the API's own network or the cloud metadata service
+package egress
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// ErrForbiddenAddress is returned when a URL resolves to an address that isn't publicly routable
+// or belongs to an internal service
+var ErrForbiddenAddress = errors.New("address is not allowed")
+
+// reserved holds the ranges which aren't covered by the netip.Addr methods but still aren't
+// reachable on the public internet
+var reserved = []netip.Prefix{
+	netip.MustParsePrefix("0.0.0.0/8"),
+	netip.MustParsePrefix("100.64.0.0/10"),
+	netip.MustParsePrefix("192.0.0.0/24"),
+	netip.MustParsePrefix("198.18.0.0/15"),
+	netip.MustParsePrefix("240.0.0.0/4"),
+	netip.MustParsePrefix("64:ff9b::/96"),
+}
+
+// Guard decides which addresses outgoing requests may reach. The zero value only allows public
+// addresses
+type Guard struct {
+	// AllowPrivate turns the checks off, for local development against receivers on localhost
+	AllowPrivate bool
+	// internal holds the addresses and ports of services the API talks to itself, which are
+	// refused even if they're public or AllowPrivate is set
+	internal []netip.AddrPort
+	// internalHosts holds their host names and ports, refused before they are resolved
+	internalHosts []string
+}
+
+// Deny() refuses the host of each URL along with the addresses it currently resolves to. A host
+// that can't be resolved yet, like a service that hasn't started, is still refused by name
+func (g *Guard) Deny(ctx context.Context, rawURLs ...string) error {
+	for _, rawURL := range rawURLs {
+		u, err := url.Parse(rawURL)
+		if err != nil {
+			return err
+		}
+
+		host, port := strings.ToLower(u.Hostname()), urlPort(u)
+		g.internalHosts = append(g.internalHosts, net.JoinHostPort(host, strconv.Itoa(int(port))))
+
+		addrs, err := resolve(ctx, host)
+		if err == nil {
+			for _, addr := range addrs {
+				g.internal = append(g.internal, netip.AddrPortFrom(addr.Unmap(), port))
+			}
+		}
+	}
+
+	return nil
+}
+
+// Allowed() reports whether requests may be sent to the address and port
+func (g *Guard) Allowed(addrPort netip.AddrPort) bool {
+	addr := addrPort.Addr().Unmap()
+
+	for _, internal := range g.internal {
+		if netip.AddrPortFrom(addr, addrPort.Port()) == internal {
+			return false
+		}
+	}
+
+	if g.AllowPrivate {
+		return true
+	}
+
+	if !addr.IsGlobalUnicast() || addr.IsPrivate() {
+		return false
+	}
+
+	for _, prefix := range reserved {
+		if prefix.Contains(addr) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// CheckURL() resolves the URL's host and returns ErrForbiddenAddress if any of its addresses
+// aren't allowed. The host can resolve differently by the time a request is sent, so clients
+// also need to use Client() or Control()
+func (g *Guard) CheckURL(ctx context.Context, rawURL string) error {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return err
+	}
+
+	host, port := strings.ToLower(u.Hostname()), urlPort(u)
+
+	for _, internal := range g.internalHosts {
+		if net.JoinHostPort(host, strconv.Itoa(int(port))) == internal {
+			return fmt.Errorf("%w: %s is an internal service", ErrForbiddenAddress, host)
+		}
+	}
+
+	addrs, err := resolve(ctx, host)
+	if err != nil {
+		return err
+	}
+
+	for _, addr := range addrs {
+		if !g.Allowed(netip.AddrPortFrom(addr, port)) {
+			return fmt.Errorf("%w: %s resolves to %s", ErrForbiddenAddress, host, addr)
+		}
+	}
+
+	return nil
+}
+
+// Control() is a net.Dialer Control function refusing connections to addresses that aren't
+// allowed. It runs after the host has been resolved, so a DNS record changed after CheckURL()
+// can't be used to reach an internal address
+func (g *Guard) Control(network, address string, c syscall.RawConn) error {
+	addrPort, err := netip.ParseAddrPort(address)
+	if err != nil {
+		return err
+	}
+
+	if !g.Allowed(addrPort) {
+		return fmt.Errorf("%w: %s", ErrForbiddenAddress, addrPort.Addr())
+	}
+
+	return nil
+}
+
+// Client() returns an HTTP client whose connections are checked by Control(). Proxies from the
+// environment are ignored, since the proxy would make the connection instead
+func (g *Guard) Client(timeout time.Duration) *http.Client {
+	dialer := &net.Dialer{
+		Timeout: 5 * time.Second,
+		Control: g.Control,
+	}
+
+	return &http.Client{
+		Timeout: timeout,
+		Transport: &http.Transport{
+			DialContext:         dialer.DialContext,
+			MaxIdleConns:        100,
+			IdleConnTimeout:     90 * time.Second,
+			TLSHandshakeTimeout: 10 * time.Second,
+		},
+	}
+}
+
+// urlPort() returns the URL's port, or the default port of its scheme
+func urlPort(u *url.URL) uint16 {
+	if p, err := strconv.ParseUint(u.Port(), 10, 16); err == nil {
+		return uint16(p)
+	}
+
+	if u.Scheme == "https" {
+		return 443
+	}
+
+	return 80
+}
+
+func resolve(ctx context.Context, host string) ([]netip.Addr, error) {
+	if addr, err := netip.ParseAddr(host); err == nil {
+		return []netip.Addr{addr}, nil
+	}
+
+	return net.DefaultResolver.LookupNetIP(ctx, "ip", host)
+}
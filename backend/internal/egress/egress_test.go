@@ -0,0 +1,82 @@
+package egress
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+func TestAllowed(t *testing.T) {
+	tests := []struct {
+		addr string
+		want bool
+	}{
+		{"93.184.216.34:443", true},
+		{"[2606:2800:220:1::]:443", true},
+		{"127.0.0.1:80", false},
+		{"10.1.2.3:80", false},
+		{"172.16.0.1:80", false},
+		{"192.168.1.1:80", false},
+		{"169.254.169.254:80", false},
+		{"100.64.0.1:80", false},
+		{"0.0.0.0:80", false},
+		{"[::1]:80", false},
+		{"[::ffff:127.0.0.1]:80", false},
+		{"[fd00::1]:80", false},
+		{"[fe80::1]:80", false},
+	}
+
+	var g Guard
+
+	for _, tt := range tests {
+		got := g.Allowed(netip.MustParseAddrPort(tt.addr))
+		if got != tt.want {
+			t.Errorf("Allowed(%s) = %t; want %t", tt.addr, got, tt.want)
+		}
+	}
+}
+
+func TestDenyInternalService(t *testing.T) {
+	g := &Guard{AllowPrivate: true}
+
+	err := g.Deny(context.Background(), "http://127.0.0.1:8000")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = g.CheckURL(context.Background(), "http://127.0.0.1:8000/strategies")
+	if !errors.Is(err, ErrForbiddenAddress) {
+		t.Errorf("got %v for the internal service; want ErrForbiddenAddress", err)
+	}
+
+	err = g.CheckURL(context.Background(), "http://127.0.0.1:9000/hook")
+	if err != nil {
+		t.Errorf("got %v for another local port with AllowPrivate; want nil", err)
+	}
+}
+
+// The client has to refuse the connection itself, since the host may resolve to a different
+// address than it did when the URL was checked
+func TestClientRefusesPrivateAddress(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer ts.Close()
+
+	var g Guard
+
+	_, err := g.Client(time.Second).Get(ts.URL)
+	if !errors.Is(err, ErrForbiddenAddress) {
+		t.Errorf("got %v; want ErrForbiddenAddress", err)
+	}
+
+	g.AllowPrivate = true
+
+	res, err := g.Client(time.Second).Get(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+}
@@ -2,10 +2,13 @@ package jsonlog
 
 import (
 	"encoding/json"
+	"fmt"
 	"io"
 	"os"
 	"runtime/debug"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -15,80 +18,177 @@ type Level int8
 // Initialize constants which represent a specific severity level. We use the iota keyword
 // as a shortcut to assign successive integer values to the constants
 const (
-	LevelInfo  Level = iota // Has the value 0.
-	LevelError              // Has the value 1.
-	LevelFatal              // Has the value 2.
-	LevelOff                // Has the value 3.
+	LevelDebug Level = iota // Has the value 0.
+	LevelInfo               // Has the value 1.
+	LevelWarn               // Has the value 2.
+	LevelError              // Has the value 3.
+	LevelFatal              // Has the value 4.
+	LevelOff                // Has the value 5.
 )
 
 // Return a human-friendly string for the severity level
 func (l Level) String() string {
 	switch l {
+	case LevelDebug:
+		return "DEBUG"
 	case LevelInfo:
 		return "INFO"
+	case LevelWarn:
+		return "WARN"
 	case LevelError:
 		return "ERROR"
 	case LevelFatal:
 		return "FATAL"
+	case LevelOff:
+		return "OFF"
 	default:
 		return ""
 	}
 }
 
+// ParseLevel() converts a level name, in any case, back to a Level
+func ParseLevel(s string) (Level, error) {
+	for l := LevelDebug; l <= LevelOff; l++ {
+		if strings.EqualFold(s, l.String()) {
+			return l, nil
+		}
+	}
+
+	return LevelOff, fmt.Errorf("unknown log level %q", s)
+}
+
+// Properties holds the fields of a log entry. Values can be of any type that encodes to JSON;
+// error values are written as their message
+type Properties map[string]interface{}
+
+// Sampling limits how often an identical message is written. Within each Tick the first First
+// entries with the same level and message are written, then only every Thereafter-th one. FATAL
+// entries are never sampled
+type Sampling struct {
+	First      int
+	Thereafter int
+	Tick       time.Duration
+}
+
 // Define a custom Logger type. This holds the output destination that the log entries
 // will be written to, the minimum severity level that log entries will be written for,
-// plus a mutex for coordinating the writes
+// plus a mutex for coordinating the writes. Child loggers created with With() share all of
+// this with their parent and only add their own bound fields
 type Logger struct {
+	*core
+	fields Properties
+}
+
+type core struct {
 	out      io.Writer
-	minLevel Level
+	minLevel atomic.Int32
 	mu       sync.Mutex
+	sampler  *sampler
 }
 
 // Return a new Logger instance which writes log entries at or above a minimum severity
 // level to a specific output destination
 func New(out io.Writer, minLevel Level) *Logger {
-	return &Logger{
-		out:      out,
-		minLevel: minLevel,
+	c := &core{out: out}
+	c.minLevel.Store(int32(minLevel))
+
+	return &Logger{core: c}
+}
+
+// SetLevel() changes the minimum severity level of the logger, its parent and all of its
+// children while the application is running
+func (l *Logger) SetLevel(level Level) {
+	l.minLevel.Store(int32(level))
+}
+
+func (l *Logger) Level() Level {
+	return Level(l.minLevel.Load())
+}
+
+// SetSampling() turns sampling of repetitive messages on, or off if First is 0
+func (l *Logger) SetSampling(s Sampling) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if s.First <= 0 {
+		l.sampler = nil
+		return
+	}
+
+	if s.Tick <= 0 {
+		s.Tick = time.Second
+	}
+
+	l.sampler = &sampler{config: s, counts: make(map[string]*sampleCount)}
+}
+
+// With() returns a child logger which adds the given fields to every entry it writes. Fields
+// passed when printing take precedence over bound ones with the same name
+func (l *Logger) With(fields Properties) *Logger {
+	merged := make(Properties, len(l.fields)+len(fields))
+	for k, v := range l.fields {
+		merged[k] = v
+	}
+	for k, v := range fields {
+		merged[k] = v
 	}
+
+	return &Logger{core: l.core, fields: merged}
 }
 
 // Declare some helper methods for writing log entries at the different levels. Notice
 // that these all accept a map as the second parameter which can contain any arbitrary
 // properties that you want to appear in the log entry
-func (l *Logger) PrintInfo(message string, properties map[string]string) {
-	l.print(LevelInfo, message, properties)
+func (l *Logger) PrintDebug(message string, properties Properties) {
+	l.print(LevelDebug, message, properties, false)
+}
+
+func (l *Logger) PrintInfo(message string, properties Properties) {
+	l.print(LevelInfo, message, properties, false)
+}
+
+func (l *Logger) PrintWarn(message string, properties Properties) {
+	l.print(LevelWarn, message, properties, false)
 }
 
-func (l *Logger) PrintError(err error, properties map[string]string) {
-	l.print(LevelError, err.Error(), properties)
+func (l *Logger) PrintError(err error, properties Properties) {
+	l.print(LevelError, err.Error(), properties, false)
 }
 
-func (l *Logger) PrintFatal(err error, properties map[string]string) {
-	l.print(LevelFatal, err.Error(), properties)
+// PrintErrorTrace() is PrintError() with the stack trace of the calling goroutine attached, for
+// errors like recovered panics where the trace is worth the space
+func (l *Logger) PrintErrorTrace(err error, properties Properties) {
+	l.print(LevelError, err.Error(), properties, true)
+}
+
+func (l *Logger) PrintFatal(err error, properties Properties) {
+	l.print(LevelFatal, err.Error(), properties, true)
 	os.Exit(1)
 }
 
-func (l *Logger) print(level Level, message string, properties map[string]string) (int, error) {
-	if level < l.minLevel {
+func (l *Logger) print(level Level, message string, properties Properties, trace bool) (int, error) {
+	if level < l.Level() {
+		return 0, nil
+	}
+
+	if level < LevelFatal && !l.sample(level, message) {
 		return 0, nil
 	}
 
 	aux := struct {
-		Level      string            `json:"level"`
-		Time       string            `json:"time"`
-		Message    string            `json:"message"`
-		Properties map[string]string `json:"properties,omitempty"`
-		Trace      string            `json:"trace,omitempty"`
+		Level      string     `json:"level"`
+		Time       string     `json:"time"`
+		Message    string     `json:"message"`
+		Properties Properties `json:"properties,omitempty"`
+		Trace      string     `json:"trace,omitempty"`
 	}{
 		Level:      level.String(),
 		Time:       time.Now().UTC().Format(time.RFC3339),
 		Message:    message,
-		Properties: properties,
+		Properties: l.merge(properties),
 	}
 
-	// Include a stack trace for entries at the ERROR and FATAL levels
-	if level >= LevelError {
+	if trace {
 		aux.Trace = string(debug.Stack())
 	}
 
@@ -110,8 +210,74 @@ func (l *Logger) print(level Level, message string, properties map[string]string
 	return l.out.Write(append(line, '\n'))
 }
 
+// merge() combines the bound fields with the entry's own. Errors are replaced by their message
+// because they would otherwise encode as an empty object
+func (l *Logger) merge(properties Properties) Properties {
+	if len(l.fields) == 0 && len(properties) == 0 {
+		return nil
+	}
+
+	merged := make(Properties, len(l.fields)+len(properties))
+	for k, v := range l.fields {
+		merged[k] = v
+	}
+	for k, v := range properties {
+		merged[k] = v
+	}
+
+	for k, v := range merged {
+		if err, ok := v.(error); ok {
+			merged[k] = err.Error()
+		}
+	}
+
+	return merged
+}
+
 // Implement a Write() method on our logger type so that it satisfies the io.Writer interface
 // This writes a log entry at the ERROR level with no additonal properties
 func (l *Logger) Write(message []byte) (n int, err error) {
-	return l.print(LevelError, string(message), nil)
+	return l.print(LevelError, string(message), nil, false)
+}
+
+type sampler struct {
+	config Sampling
+	counts map[string]*sampleCount
+}
+
+type sampleCount struct {
+	resetAt time.Time
+	n       int
+}
+
+// sample() reports whether an entry should be written under the sampling policy
+func (l *Logger) sample(level Level, message string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.sampler == nil {
+		return true
+	}
+
+	now := time.Now()
+	key := level.String() + "\x00" + message
+
+	count, ok := l.sampler.counts[key]
+	if !ok || now.After(count.resetAt) {
+		// Drop counters from earlier ticks so the map doesn't grow with every distinct message
+		if len(l.sampler.counts) > 10000 {
+			l.sampler.counts = make(map[string]*sampleCount)
+		}
+
+		count = &sampleCount{resetAt: now.Add(l.sampler.config.Tick)}
+		l.sampler.counts[key] = count
+	}
+
+	count.n++
+
+	if count.n <= l.sampler.config.First {
+		return true
+	}
+
+	return l.sampler.config.Thereafter > 0 && (count.n-l.sampler.config.First)%l.sampler.config.Thereafter == 0
 }
@@ -3,10 +3,13 @@ package mailer
 import (
 	"bytes"
 	"embed"
+	"errors"
+	"fmt"
 	"html/template"
-	"time"
-
-	"github.com/go-mail/mail/v2"
+	"io/fs"
+	"os"
+	"sort"
+	"strings"
 )
 
 // embed.FS (embedded file system) holds email templates, has a comment directive in the
@@ -16,62 +19,187 @@ import (
 //go:embed "templates"
 var templateFS embed.FS
 
+// ErrTemplateNotFound is returned when no variant of a template exists for any locale
+var ErrTemplateNotFound = errors.New("email template not found")
+
 type Mailer struct {
-	dialer *mail.Dialer
-	sender string
+	transport Transport
+	sender    string
+	// templates is keyed by file name, locale variants are named like user_welcome.fr.tmpl
+	templates map[string]*template.Template
 }
 
-func New(host string, port int, username, password, sender string) Mailer {
-	// Initialize a new mail.Dialer with the given SMTP server settings
-	dialer := mail.NewDialer(host, port, username, password)
-	dialer.Timeout = 5 * time.Second
+// New() returns a Mailer which renders templates and hands the result to the given transport.
+// Every template is parsed up front so a broken one stops the application from starting rather
+// than failing when the email is sent. Templates in overrideDir, if given, replace the embedded
+// ones with the same file name and may add new locale variants
+func New(transport Transport, sender string, overrideDir string) (Mailer, error) {
+	m := Mailer{
+		transport: transport,
+		sender:    sender,
+		templates: make(map[string]*template.Template),
+	}
+
+	templates, err := fs.Sub(templateFS, "templates")
+	if err != nil {
+		return Mailer{}, err
+	}
+
+	err = m.parseTemplates(templates)
+	if err != nil {
+		return Mailer{}, err
+	}
 
-	return Mailer{
-		dialer: dialer,
-		sender: sender,
+	if overrideDir != "" {
+		err = m.parseTemplates(os.DirFS(overrideDir))
+		if err != nil {
+			return Mailer{}, err
+		}
 	}
+
+	return m, nil
 }
 
-func (m Mailer) Send(recipient, templateFile string, data interface{}) error {
-	// ParseFS() method parses the required template file from the embedded file system
-	tmpl, err := template.New("email").ParseFS(templateFS, "templates/"+templateFile)
+func (m Mailer) parseTemplates(fsys fs.FS) error {
+	names, err := fs.Glob(fsys, "*.tmpl")
 	if err != nil {
 		return err
 	}
 
+	for _, name := range names {
+		tmpl, err := template.New("email").ParseFS(fsys, name)
+		if err != nil {
+			return fmt.Errorf("parsing email template %s: %w", name, err)
+		}
+
+		for _, block := range []string{"subject", "plainBody", "htmlBody"} {
+			if tmpl.Lookup(block) == nil {
+				return fmt.Errorf("email template %s is missing the %q block", name, block)
+			}
+		}
+
+		m.templates[name] = tmpl
+	}
+
+	return nil
+}
+
+// Templates() returns the names of the base templates, without locale variants
+func (m Mailer) Templates() []string {
+	var names []string
+
+	for name := range m.templates {
+		if strings.Count(name, ".") == 1 {
+			names = append(names, name)
+		}
+	}
+
+	sort.Strings(names)
+
+	return names
+}
+
+// Locales() returns the locales which have their own variant of the template
+func (m Mailer) Locales(templateFile string) []string {
+	prefix := strings.TrimSuffix(templateFile, ".tmpl") + "."
+
+	var locales []string
+
+	for name := range m.templates {
+		if name == templateFile || !strings.HasPrefix(name, prefix) {
+			continue
+		}
+
+		locale := strings.TrimSuffix(strings.TrimPrefix(name, prefix), ".tmpl")
+		if !strings.Contains(locale, ".") {
+			locales = append(locales, locale)
+		}
+	}
+
+	sort.Strings(locales)
+
+	return locales
+}
+
+// lookup() picks the closest variant of the template for the locale. For "fr-CA" it tries
+// user_welcome.fr-CA.tmpl, then user_welcome.fr.tmpl, then falls back to user_welcome.tmpl
+func (m Mailer) lookup(templateFile, locale string) (*template.Template, error) {
+	base := strings.TrimSuffix(templateFile, ".tmpl")
+
+	var candidates []string
+
+	if locale != "" {
+		candidates = append(candidates, base+"."+locale+".tmpl")
+
+		if language, _, found := strings.Cut(locale, "-"); found {
+			candidates = append(candidates, base+"."+language+".tmpl")
+		}
+	}
+
+	candidates = append(candidates, templateFile)
+
+	for _, name := range candidates {
+		if tmpl, ok := m.templates[name]; ok {
+			return tmpl, nil
+		}
+	}
+
+	return nil, ErrTemplateNotFound
+}
+
+// Render() executes the template for the locale without sending it, which is used both by Send()
+// and to preview templates
+func (m Mailer) Render(recipient, templateFile, locale string, data interface{}) (*Message, error) {
+	tmpl, err := m.lookup(templateFile, locale)
+	if err != nil {
+		return nil, err
+	}
+
 	subject := new(bytes.Buffer)
 	err = tmpl.ExecuteTemplate(subject, "subject", data)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	plainBody := new(bytes.Buffer)
 	err = tmpl.ExecuteTemplate(plainBody, "plainBody", data)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	htmlBody := new(bytes.Buffer)
 	err = tmpl.ExecuteTemplate(htmlBody, "htmlBody", data)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	msg := mail.NewMessage()
-	msg.SetHeader("To", recipient)
-	msg.SetHeader("From", m.sender)
-	msg.SetHeader("Subject", subject.String())
-	msg.SetBody("text/plain", plainBody.String())
-	msg.AddAlternative("text/html", htmlBody.String())
+	return &Message{
+		From:      m.sender,
+		To:        recipient,
+		Subject:   subject.String(),
+		PlainBody: plainBody.String(),
+		HTMLBody:  htmlBody.String(),
+		Template:  templateFile,
+	}, nil
+}
 
-	for i := 1; i <= 3; i++ {
-		err = m.dialer.DialAndSend(msg)
-		if nil == err {
-			return nil
-		}
+func (m Mailer) Send(recipient, templateFile, locale string, data interface{}) error {
+	msg, err := m.Render(recipient, templateFile, locale, data)
+	if err != nil {
+		return err
+	}
+
+	// Retries are left to the email outbox worker, which backs off between attempts
+	return m.transport.Send(msg)
+}
 
-		time.Sleep(500 * time.Millisecond)
+// Check() reports whether the transport is able to deliver. Transports that can't tell, like the
+// log transport, are always considered able to
+func (m Mailer) Check() error {
+	checker, ok := m.transport.(Checker)
+	if !ok {
+		return nil
 	}
 
-	return err
+	return checker.Check()
 }
@@ -0,0 +1,65 @@
+package mailer
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestSendCapturesMessage(t *testing.T) {
+	transport := NewCaptureTransport()
+
+	m, err := New(transport, "StratCheck <no-reply@stratcheck.test>", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data := map[string]interface{}{
+		"activationToken": "Y3QMGX3PJ3WLRL2YRTQGQ6KRHU",
+		"activationURL":   "https://stratcheck.test/v1/users/activate?token=Y3QMGX3PJ3WLRL2YRTQGQ6KRHU",
+		"userID":          123,
+	}
+
+	err = m.Send("alice@example.com", "user_welcome.tmpl", "en-GB", data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	messages := transport.Messages()
+	if len(messages) != 1 {
+		t.Fatalf("got %d messages; want 1", len(messages))
+	}
+
+	msg := messages[0]
+
+	if msg.To != "alice@example.com" {
+		t.Errorf("got recipient %q; want %q", msg.To, "alice@example.com")
+	}
+
+	if msg.From != "StratCheck <no-reply@stratcheck.test>" {
+		t.Errorf("got sender %q", msg.From)
+	}
+
+	if msg.Subject != "Welcome to StratCheck!" {
+		t.Errorf("got subject %q; want %q", msg.Subject, "Welcome to StratCheck!")
+	}
+
+	if msg.Template != "user_welcome.tmpl" {
+		t.Errorf("got template %q; want %q", msg.Template, "user_welcome.tmpl")
+	}
+
+	for _, want := range []string{"Y3QMGX3PJ3WLRL2YRTQGQ6KRHU", "your user ID number is 123"} {
+		if !strings.Contains(msg.PlainBody, want) {
+			t.Errorf("plain body doesn't contain %q", want)
+		}
+	}
+
+	if !strings.Contains(msg.HTMLBody, `href="https://stratcheck.test/v1/users/activate?token=Y3QMGX3PJ3WLRL2YRTQGQ6KRHU"`) {
+		t.Error("html body doesn't link to the activation page")
+	}
+
+	transport.Reset()
+
+	if n := len(transport.Messages()); n != 0 {
+		t.Errorf("got %d messages after Reset(); want 0", n)
+	}
+}
@@ -0,0 +1,202 @@
+package mailer
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/go-mail/mail/v2"
+
+	"github.com/lyttonliao/StratCheck/internal/jsonlog"
+)
+
+// Message is a rendered email ready to be delivered
+type Message struct {
+	From      string
+	To        string
+	Subject   string
+	PlainBody string
+	HTMLBody  string
+	// Template is the file the message was rendered from, it isn't part of the email
+	Template string
+}
+
+// WriteTo() writes the message in RFC 5322 format, satisfying the io.WriterTo interface
+func (msg *Message) WriteTo(w io.Writer) (int64, error) {
+	return msg.build().WriteTo(w)
+}
+
+func (msg *Message) build() *mail.Message {
+	m := mail.NewMessage()
+	m.SetHeader("To", msg.To)
+	m.SetHeader("From", msg.From)
+	m.SetHeader("Subject", msg.Subject)
+	m.SetBody("text/plain", msg.PlainBody)
+	m.AddAlternative("text/html", msg.HTMLBody)
+
+	return m
+}
+
+// Transport delivers rendered messages. Mailer only renders templates, so swapping the transport
+// changes where emails go without touching any of the code that sends them
+type Transport interface {
+	Send(msg *Message) error
+}
+
+// Checker is implemented by transports that can tell whether they are currently able to deliver,
+// for the readiness check
+type Checker interface {
+	Check() error
+}
+
+// SMTPTransport delivers messages through an SMTP server
+type SMTPTransport struct {
+	dialer *mail.Dialer
+}
+
+func NewSMTPTransport(host string, port int, username, password string) *SMTPTransport {
+	// Initialize a new mail.Dialer with the given SMTP server settings
+	dialer := mail.NewDialer(host, port, username, password)
+	dialer.Timeout = 5 * time.Second
+
+	return &SMTPTransport{dialer: dialer}
+}
+
+func (t *SMTPTransport) Send(msg *Message) error {
+	return t.dialer.DialAndSend(msg.build())
+}
+
+// Check() connects and authenticates to the SMTP server without sending anything
+func (t *SMTPTransport) Check() error {
+	conn, err := t.dialer.Dial()
+	if err != nil {
+		return err
+	}
+
+	return conn.Close()
+}
+
+// FileTransport writes each message to its own .eml file using the maildir layout, so local
+// development doesn't need an SMTP server and the output can be opened in any mail client.
+// Files are written to dir/tmp and renamed into dir/new, so readers never see a partial message
+type FileTransport struct {
+	dir string
+	mu  sync.Mutex
+	seq int
+}
+
+func NewFileTransport(dir string) (*FileTransport, error) {
+	for _, sub := range []string{"tmp", "new", "cur"} {
+		err := os.MkdirAll(filepath.Join(dir, sub), 0o755)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return &FileTransport{dir: dir}, nil
+}
+
+func (t *FileTransport) Send(msg *Message) error {
+	t.mu.Lock()
+	t.seq++
+	name := fmt.Sprintf("%d.%d_%d.stratcheck.eml", time.Now().UnixNano(), os.Getpid(), t.seq)
+	t.mu.Unlock()
+
+	tmpPath := filepath.Join(t.dir, "tmp", name)
+
+	f, err := os.Create(tmpPath)
+	if err != nil {
+		return err
+	}
+
+	_, err = msg.WriteTo(f)
+	if err != nil {
+		f.Close()
+		os.Remove(tmpPath)
+		return err
+	}
+
+	err = f.Close()
+	if err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+
+	return os.Rename(tmpPath, filepath.Join(t.dir, "new", name))
+}
+
+// Check() makes sure the maildir still exists, since it may be on a volume that went away
+func (t *FileTransport) Check() error {
+	for _, sub := range []string{"tmp", "new"} {
+		info, err := os.Stat(filepath.Join(t.dir, sub))
+		if err != nil {
+			return err
+		}
+
+		if !info.IsDir() {
+			return fmt.Errorf("%s is not a directory", filepath.Join(t.dir, sub))
+		}
+	}
+
+	return nil
+}
+
+// CaptureTransport keeps messages in memory so tests can assert on what would have been sent
+type CaptureTransport struct {
+	mu       sync.Mutex
+	messages []Message
+}
+
+func NewCaptureTransport() *CaptureTransport {
+	return &CaptureTransport{}
+}
+
+func (t *CaptureTransport) Send(msg *Message) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.messages = append(t.messages, *msg)
+	return nil
+}
+
+// Messages() returns a copy of every message sent so far, oldest first
+func (t *CaptureTransport) Messages() []Message {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	messages := make([]Message, len(t.messages))
+	copy(messages, t.messages)
+
+	return messages
+}
+
+// Reset() discards the captured messages
+func (t *CaptureTransport) Reset() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.messages = nil
+}
+
+// LogTransport logs each message instead of delivering it. Only the envelope is logged, the body
+// can hold one-time tokens
+type LogTransport struct {
+	logger *jsonlog.Logger
+}
+
+func NewLogTransport(logger *jsonlog.Logger) *LogTransport {
+	return &LogTransport{logger: logger}
+}
+
+func (t *LogTransport) Send(msg *Message) error {
+	t.logger.PrintInfo("email sent to log transport", jsonlog.Properties{
+		"to":       msg.To,
+		"subject":  msg.Subject,
+		"template": msg.Template,
+	})
+
+	return nil
+}
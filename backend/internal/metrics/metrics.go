@@ -0,0 +1,299 @@
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// DefaultBuckets are the upper bounds, in seconds, used for latency histograms
+var DefaultBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// collector is a metric family that can write itself in the Prometheus text exposition format
+type collector interface {
+	write(w *bufio.Writer)
+}
+
+// Registry holds metric families and serves them in the order they were registered
+type Registry struct {
+	mu         sync.Mutex
+	names      map[string]bool
+	collectors []collector
+}
+
+func NewRegistry() *Registry {
+	return &Registry{names: make(map[string]bool)}
+}
+
+func (r *Registry) register(name string, c collector) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.names[name] {
+		panic(fmt.Sprintf("metrics: %s registered twice", name))
+	}
+
+	r.names[name] = true
+	r.collectors = append(r.collectors, c)
+}
+
+// WriteTo() writes every metric in the Prometheus text exposition format
+func (r *Registry) WriteTo(w io.Writer) (int64, error) {
+	r.mu.Lock()
+	collectors := append([]collector(nil), r.collectors...)
+	r.mu.Unlock()
+
+	cw := &countingWriter{w: w}
+	bw := bufio.NewWriter(cw)
+
+	for _, c := range collectors {
+		c.write(bw)
+	}
+
+	err := bw.Flush()
+	return cw.n, err
+}
+
+// Handler() serves the registry for Prometheus to scrape
+func (r *Registry) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		r.WriteTo(w)
+	})
+}
+
+// CounterVec is a counter partitioned by a fixed set of labels
+type CounterVec struct {
+	desc   desc
+	mu     sync.Mutex
+	values map[string]*sample
+}
+
+func (r *Registry) NewCounterVec(name, help string, labels ...string) *CounterVec {
+	c := &CounterVec{desc: desc{name, help, "counter", labels}, values: make(map[string]*sample)}
+	r.register(name, c)
+	return c
+}
+
+// Add() adds delta to the counter for the label values, given in the order the labels were declared
+func (c *CounterVec) Add(delta float64, labelValues ...string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	key := strings.Join(labelValues, "\xff")
+
+	s, ok := c.values[key]
+	if !ok {
+		s = &sample{labelValues: labelValues}
+		c.values[key] = s
+	}
+
+	s.value += delta
+}
+
+func (c *CounterVec) Inc(labelValues ...string) {
+	c.Add(1, labelValues...)
+}
+
+func (c *CounterVec) write(w *bufio.Writer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.desc.writeHeader(w)
+
+	for _, s := range sortedSamples(c.values) {
+		writeSample(w, c.desc.name, c.desc.labels, s.labelValues, "", "", s.value)
+	}
+}
+
+// HistogramVec counts observations into cumulative buckets, partitioned by a fixed set of labels
+type HistogramVec struct {
+	desc    desc
+	buckets []float64
+	mu      sync.Mutex
+	values  map[string]*histogram
+}
+
+type histogram struct {
+	labelValues []string
+	counts      []uint64
+	count       uint64
+	sum         float64
+}
+
+func (r *Registry) NewHistogramVec(name, help string, buckets []float64, labels ...string) *HistogramVec {
+	h := &HistogramVec{
+		desc:    desc{name, help, "histogram", labels},
+		buckets: append([]float64(nil), buckets...),
+		values:  make(map[string]*histogram),
+	}
+	sort.Float64s(h.buckets)
+	r.register(name, h)
+	return h
+}
+
+func (h *HistogramVec) Observe(value float64, labelValues ...string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	key := strings.Join(labelValues, "\xff")
+
+	hist, ok := h.values[key]
+	if !ok {
+		hist = &histogram{labelValues: labelValues, counts: make([]uint64, len(h.buckets))}
+		h.values[key] = hist
+	}
+
+	for i, bound := range h.buckets {
+		if value <= bound {
+			hist.counts[i]++
+		}
+	}
+
+	hist.count++
+	hist.sum += value
+}
+
+func (h *HistogramVec) write(w *bufio.Writer) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.desc.writeHeader(w)
+
+	keys := make([]string, 0, len(h.values))
+	for key := range h.values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		hist := h.values[key]
+
+		for i, bound := range h.buckets {
+			writeSample(w, h.desc.name+"_bucket", h.desc.labels, hist.labelValues, "le", formatFloat(bound), float64(hist.counts[i]))
+		}
+		writeSample(w, h.desc.name+"_bucket", h.desc.labels, hist.labelValues, "le", "+Inf", float64(hist.count))
+		writeSample(w, h.desc.name+"_sum", h.desc.labels, hist.labelValues, "", "", hist.sum)
+		writeSample(w, h.desc.name+"_count", h.desc.labels, hist.labelValues, "", "", float64(hist.count))
+	}
+}
+
+// funcMetric reads its value when scraped, for values kept elsewhere such as sql.DBStats
+type funcMetric struct {
+	desc desc
+	fn   func() float64
+}
+
+func (r *Registry) NewGaugeFunc(name, help string, fn func() float64) {
+	r.register(name, &funcMetric{desc{name, help, "gauge", nil}, fn})
+}
+
+// NewCounterFunc() is like NewGaugeFunc() for values that only ever increase
+func (r *Registry) NewCounterFunc(name, help string, fn func() float64) {
+	r.register(name, &funcMetric{desc{name, help, "counter", nil}, fn})
+}
+
+func (f *funcMetric) write(w *bufio.Writer) {
+	f.desc.writeHeader(w)
+	writeSample(w, f.desc.name, nil, nil, "", "", f.fn())
+}
+
+type desc struct {
+	name   string
+	help   string
+	kind   string
+	labels []string
+}
+
+func (d desc) writeHeader(w *bufio.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n", d.name, strings.NewReplacer(`\`, `\\`, "\n", `\n`).Replace(d.help))
+	fmt.Fprintf(w, "# TYPE %s %s\n", d.name, d.kind)
+}
+
+type sample struct {
+	labelValues []string
+	value       float64
+}
+
+func sortedSamples(values map[string]*sample) []*sample {
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	samples := make([]*sample, len(keys))
+	for i, key := range keys {
+		samples[i] = values[key]
+	}
+
+	return samples
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// writeSample() writes one line. extraName and extraValue add a label after the declared ones,
+// which histograms use for le
+func writeSample(w *bufio.Writer, name string, labels, labelValues []string, extraName, extraValue string, value float64) {
+	w.WriteString(name)
+
+	if len(labels) > 0 || extraName != "" {
+		w.WriteByte('{')
+
+		for i, label := range labels {
+			if i > 0 {
+				w.WriteByte(',')
+			}
+
+			lv := ""
+			if i < len(labelValues) {
+				lv = labelValues[i]
+			}
+
+			fmt.Fprintf(w, `%s="%s"`, label, labelEscaper.Replace(lv))
+		}
+
+		if extraName != "" {
+			if len(labels) > 0 {
+				w.WriteByte(',')
+			}
+			fmt.Fprintf(w, `%s="%s"`, extraName, extraValue)
+		}
+
+		w.WriteByte('}')
+	}
+
+	w.WriteByte(' ')
+	w.WriteString(formatFloat(value))
+	w.WriteByte('\n')
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	default:
+		return strconv.FormatFloat(v, 'g', -1, 64)
+	}
+}
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	cw.n += int64(n)
+	return n, err
+}
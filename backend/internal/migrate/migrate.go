@@ -0,0 +1,506 @@
+package migrate
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io/fs"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	// ErrSchemaOutdated is returned by Check() when the database is missing migrations this binary has
+	ErrSchemaOutdated = errors.New("database schema is older than this version of the application")
+	// ErrDirty means a migration failed part way through. Failed index builds are retried by Up(),
+	// anything else has to be fixed by hand and recorded with Force() before migrating any further
+	ErrDirty = errors.New("database schema is dirty")
+	// ErrNoChange is returned by Down() when there is nothing left to roll back
+	ErrNoChange = errors.New("no migrations to roll back")
+	// ErrUnknownVersion is returned by Force() for a version without an embedded migration
+	ErrUnknownVersion = errors.New("no migration with this version")
+)
+
+// lockID is the key of the Postgres advisory lock held while migrating, so only one instance
+// migrates at a time and the others wait for it to finish
+const lockID = 8316592047
+
+// fileRX matches migration file names like 000001_create_users_table.up.sql
+var fileRX = regexp.MustCompile(`^(\d+)_(.+)\.(up|down)\.sql$`)
+
+// noTransactionMarker starts the scripts that mustn't run in a transaction, such as CREATE INDEX
+// CONCURRENTLY. Postgres runs a script of several statements in an implicit transaction, so
+// these scripts have to hold a single statement
+const noTransactionMarker = "-- migrate:no-transaction"
+
+// concurrentIndexRX matches the name of the index a CREATE INDEX CONCURRENTLY script builds
+var concurrentIndexRX = regexp.MustCompile(`(?i)CREATE\s+(?:UNIQUE\s+)?INDEX\s+CONCURRENTLY\s+(?:IF\s+NOT\s+EXISTS\s+)?(\w+)`)
+
+// Migration is a numbered pair of up and down SQL scripts
+type Migration struct {
+	Version int64  `json:"version"`
+	Name    string `json:"name"`
+	// NoTransaction is set for migrations whose scripts start with noTransactionMarker. They only
+	// build indexes, so the application doesn't wait for them before serving
+	NoTransaction bool `json:"no_transaction"`
+	up            string
+	down          string
+}
+
+// Status describes where the database is relative to the embedded migrations
+type Status struct {
+	// Version is the last applied migration, 0 if none have been
+	Version int64       `json:"version"`
+	Dirty   bool        `json:"dirty"`
+	Latest  int64       `json:"latest"`
+	Pending []Migration `json:"pending"`
+}
+
+// Migrator applies migrations and records the version reached in the schema_migrations table.
+// The table has the same layout the golang-migrate CLI uses, so databases it migrated carry on
+// where they left off
+type Migrator struct {
+	db         *sql.DB
+	migrations []Migration
+}
+
+// New() reads every migration in fsys, which must hold an up and a down script for each version
+func New(db *sql.DB, fsys fs.FS) (*Migrator, error) {
+	entries, err := fs.ReadDir(fsys, ".")
+	if err != nil {
+		return nil, err
+	}
+
+	byVersion := make(map[int64]*Migration)
+
+	for _, entry := range entries {
+		matches := fileRX.FindStringSubmatch(entry.Name())
+		if entry.IsDir() || matches == nil {
+			continue
+		}
+
+		version, err := strconv.ParseInt(matches[1], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("migration %s: %w", entry.Name(), err)
+		}
+
+		script, err := fs.ReadFile(fsys, entry.Name())
+		if err != nil {
+			return nil, err
+		}
+
+		m, ok := byVersion[version]
+		if !ok {
+			m = &Migration{Version: version, Name: matches[2]}
+			byVersion[version] = m
+		}
+
+		if m.Name != matches[2] {
+			return nil, fmt.Errorf("migration %d has scripts with different names", version)
+		}
+
+		if matches[3] == "up" {
+			m.up = string(script)
+			m.NoTransaction = noTransaction(m.up)
+		} else {
+			m.down = string(script)
+		}
+	}
+
+	migrator := &Migrator{db: db}
+
+	for _, m := range byVersion {
+		if m.up == "" || m.down == "" {
+			return nil, fmt.Errorf("migration %d_%s must have both an up and a down script", m.Version, m.Name)
+		}
+
+		if noTransaction(m.up) != noTransaction(m.down) {
+			return nil, fmt.Errorf("migration %d_%s must have the no-transaction marker on both scripts or neither", m.Version, m.Name)
+		}
+
+		migrator.migrations = append(migrator.migrations, *m)
+	}
+
+	sort.Slice(migrator.migrations, func(i, j int) bool {
+		return migrator.migrations[i].Version < migrator.migrations[j].Version
+	})
+
+	return migrator, nil
+}
+
+// Latest() returns the version of the newest embedded migration
+func (m *Migrator) Latest() int64 {
+	if len(m.migrations) == 0 {
+		return 0
+	}
+
+	return m.migrations[len(m.migrations)-1].Version
+}
+
+// Up() applies every pending migration in order, each in its own transaction along with the
+// version update, so a failing migration leaves the schema at the previous version
+func (m *Migrator) Up(ctx context.Context) ([]Migration, error) {
+	return m.up(ctx, m.Latest())
+}
+
+// UpRequired() applies the pending migrations up to the last one that isn't NoTransaction,
+// leaving the index builds after it to be applied with Up()
+func (m *Migrator) UpRequired(ctx context.Context) ([]Migration, error) {
+	return m.up(ctx, m.required())
+}
+
+func (m *Migrator) up(ctx context.Context, target int64) ([]Migration, error) {
+	var applied []Migration
+
+	err := m.withLock(ctx, func(conn *sql.Conn) error {
+		version, dirty, err := m.version(ctx, conn)
+		if err != nil {
+			return err
+		}
+
+		if dirty {
+			// A failed index build is safe to run again, so carry on from the version before it
+			previous, ok := m.retryable(version)
+			if !ok {
+				return fmt.Errorf("%w at version %d, fix it by hand then run `api migrate force <version>`", ErrDirty, version)
+			}
+			version = previous
+		}
+
+		for _, migration := range m.migrations {
+			if migration.Version <= version || migration.Version > target {
+				continue
+			}
+
+			err = m.apply(ctx, conn, migration.up, migration.Version)
+			if err != nil {
+				return fmt.Errorf("migration %d_%s: %w", migration.Version, migration.Name, err)
+			}
+
+			applied = append(applied, migration)
+		}
+
+		return nil
+	})
+
+	return applied, err
+}
+
+// retryable() reports whether a dirty version is a NoTransaction migration, which Up() can run
+// again, and returns the version before it
+func (m *Migrator) retryable(version int64) (int64, bool) {
+	for i, migration := range m.migrations {
+		if migration.Version != version {
+			continue
+		}
+
+		if !migration.NoTransaction {
+			return 0, false
+		}
+
+		if i == 0 {
+			return 0, true
+		}
+
+		return m.migrations[i-1].Version, true
+	}
+
+	return 0, false
+}
+
+// required() returns the version of the newest migration that isn't NoTransaction
+func (m *Migrator) required() int64 {
+	for i := len(m.migrations) - 1; i >= 0; i-- {
+		if !m.migrations[i].NoTransaction {
+			return m.migrations[i].Version
+		}
+	}
+
+	return 0
+}
+
+// Down() rolls back the last steps applied migrations, newest first
+func (m *Migrator) Down(ctx context.Context, steps int) ([]Migration, error) {
+	var reverted []Migration
+
+	err := m.withLock(ctx, func(conn *sql.Conn) error {
+		version, dirty, err := m.version(ctx, conn)
+		if err != nil {
+			return err
+		}
+
+		if dirty {
+			return fmt.Errorf("%w at version %d, fix it by hand then run `api migrate force <version>`", ErrDirty, version)
+		}
+
+		for i := len(m.migrations) - 1; i >= 0 && len(reverted) < steps; i-- {
+			migration := m.migrations[i]
+			if migration.Version > version {
+				continue
+			}
+
+			var previous int64
+			if i > 0 {
+				previous = m.migrations[i-1].Version
+			}
+
+			err = m.apply(ctx, conn, migration.down, previous)
+			if err != nil {
+				return fmt.Errorf("migration %d_%s: %w", migration.Version, migration.Name, err)
+			}
+
+			reverted = append(reverted, migration)
+		}
+
+		if len(reverted) == 0 {
+			return ErrNoChange
+		}
+
+		return nil
+	})
+
+	return reverted, err
+}
+
+// Force() records version as applied and clean without running anything. It's for repairing a
+// dirty schema once whatever the failed migration left behind has been fixed by hand. Version 0
+// records that no migrations are applied
+func (m *Migrator) Force(ctx context.Context, version int64) error {
+	known := version == 0
+	for _, migration := range m.migrations {
+		if migration.Version == version {
+			known = true
+		}
+	}
+
+	if !known {
+		return fmt.Errorf("%w: %d", ErrUnknownVersion, version)
+	}
+
+	return m.withLock(ctx, func(conn *sql.Conn) error {
+		return setVersion(ctx, conn, version, false)
+	})
+}
+
+// Status() reports the applied version and the migrations still to be applied
+func (m *Migrator) Status(ctx context.Context) (*Status, error) {
+	conn, err := m.db.Conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	version, dirty, err := m.version(ctx, conn)
+	if err != nil {
+		return nil, err
+	}
+
+	status := &Status{Version: version, Dirty: dirty, Latest: m.Latest(), Pending: []Migration{}}
+
+	for _, migration := range m.migrations {
+		if migration.Version > version {
+			status.Pending = append(status.Pending, migration)
+		}
+	}
+
+	return status, nil
+}
+
+// Check() returns an error if the database is dirty or is missing a migration that isn't
+// NoTransaction. Pending and failed index builds are allowed, since queries still work without
+// them, just more slowly. A schema newer than the binary is allowed too, since migrations only add
+// to the schema and an older instance may still be running during a deploy
+func (m *Migrator) Check(ctx context.Context) error {
+	status, err := m.Status(ctx)
+	if err != nil {
+		return err
+	}
+
+	_, retryable := m.retryable(status.Version)
+
+	switch {
+	case status.Dirty && !retryable:
+		return fmt.Errorf("%w at version %d", ErrDirty, status.Version)
+	case status.Version < m.required():
+		return fmt.Errorf("%w: database is at version %d, expected %d", ErrSchemaOutdated, status.Version, m.required())
+	}
+
+	return nil
+}
+
+// withLock() runs fn holding the advisory lock. Advisory locks belong to a database session, so
+// everything runs on the one connection that took it
+func (m *Migrator) withLock(ctx context.Context, fn func(conn *sql.Conn) error) error {
+	conn, err := m.db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	_, err = conn.ExecContext(ctx, `SELECT pg_advisory_lock($1)`, lockID)
+	if err != nil {
+		return fmt.Errorf("acquiring migration lock: %w", err)
+	}
+
+	defer func() {
+		// Use a fresh context so the lock is released even if ctx has been cancelled
+		unlockCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+
+		conn.ExecContext(unlockCtx, `SELECT pg_advisory_unlock($1)`, lockID)
+	}()
+
+	err = m.ensureTable(ctx, conn)
+	if err != nil {
+		return err
+	}
+
+	return fn(conn)
+}
+
+func (m *Migrator) ensureTable(ctx context.Context, conn *sql.Conn) error {
+	query := `
+		CREATE TABLE IF NOT EXISTS schema_migrations (
+			version bigint NOT NULL PRIMARY KEY,
+			dirty boolean NOT NULL
+		)
+	`
+
+	_, err := conn.ExecContext(ctx, query)
+	return err
+}
+
+// version() returns the applied version, treating a database that was never migrated as version 0
+func (m *Migrator) version(ctx context.Context, conn *sql.Conn) (int64, bool, error) {
+	var exists bool
+
+	err := conn.QueryRowContext(ctx, `SELECT to_regclass('schema_migrations') IS NOT NULL`).Scan(&exists)
+	if err != nil || !exists {
+		return 0, false, err
+	}
+
+	var version int64
+	var dirty bool
+
+	err = conn.QueryRowContext(ctx, `SELECT version, dirty FROM schema_migrations LIMIT 1`).Scan(&version, &dirty)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return 0, false, nil
+		default:
+			return 0, false, err
+		}
+	}
+
+	return version, dirty, nil
+}
+
+// apply() runs a script and records the version it leaves the schema at in one transaction.
+// Scripts are sent without arguments so lib/pq runs them as a simple query, which allows several
+// statements in one script
+func (m *Migrator) apply(ctx context.Context, conn *sql.Conn, script string, version int64) error {
+	if noTransaction(script) {
+		return m.applyWithoutTx(ctx, conn, script, version)
+	}
+
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx, script)
+	if err != nil {
+		return err
+	}
+
+	err = setVersion(ctx, tx, version, false)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// applyWithoutTx() runs a NoTransaction script straight on the connection. The version is marked
+// dirty while it runs, so a failed index build is run again by the next Up()
+func (m *Migrator) applyWithoutTx(ctx context.Context, conn *sql.Conn, script string, version int64) error {
+	err := setVersion(ctx, conn, version, true)
+	if err != nil {
+		return err
+	}
+
+	err = dropInvalidIndex(ctx, conn, script)
+	if err != nil {
+		return err
+	}
+
+	_, err = conn.ExecContext(ctx, script)
+	if err != nil {
+		return err
+	}
+
+	return setVersion(ctx, conn, version, false)
+}
+
+// dropInvalidIndex() drops the index a CREATE INDEX CONCURRENTLY script builds if an earlier,
+// failed build left it behind marked invalid. IF NOT EXISTS would otherwise skip the build and
+// leave the index unused
+func dropInvalidIndex(ctx context.Context, conn *sql.Conn, script string) error {
+	matches := concurrentIndexRX.FindStringSubmatch(script)
+	if matches == nil {
+		return nil
+	}
+
+	var invalid bool
+
+	query := `SELECT NOT indisvalid FROM pg_index WHERE indexrelid = to_regclass($1)`
+
+	err := conn.QueryRowContext(ctx, query, matches[1]).Scan(&invalid)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil
+		default:
+			return err
+		}
+	}
+
+	if !invalid {
+		return nil
+	}
+
+	// The name comes from an embedded script and only holds word characters
+	_, err = conn.ExecContext(ctx, fmt.Sprintf(`DROP INDEX CONCURRENTLY IF EXISTS %s`, matches[1]))
+	return err
+}
+
+type execer interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+}
+
+// setVersion() records the version the schema is at. Version 0 is recorded as an empty table
+func setVersion(ctx context.Context, db execer, version int64, dirty bool) error {
+	_, err := db.ExecContext(ctx, `DELETE FROM schema_migrations`)
+	if err != nil {
+		return err
+	}
+
+	if version > 0 {
+		_, err = db.ExecContext(ctx, `INSERT INTO schema_migrations (version, dirty) VALUES ($1, $2)`, version, dirty)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// noTransaction() reports whether a script starts with noTransactionMarker
+func noTransaction(script string) bool {
+	return strings.HasPrefix(strings.TrimSpace(script), noTransactionMarker)
+}
@@ -0,0 +1,98 @@
+package migrate
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"testing/fstest"
+
+	"github.com/lyttonliao/StratCheck/migrations"
+)
+
+func TestNoTransactionMigrations(t *testing.T) {
+	fsys := fstest.MapFS{
+		"000001_create_users_table.up.sql":   {Data: []byte("CREATE TABLE users (id bigserial PRIMARY KEY);")},
+		"000001_create_users_table.down.sql": {Data: []byte("DROP TABLE users;")},
+		"000002_add_users_index.up.sql":      {Data: []byte("-- migrate:no-transaction\nCREATE INDEX CONCURRENTLY users_idx ON users (id);")},
+		"000002_add_users_index.down.sql":    {Data: []byte("-- migrate:no-transaction\nDROP INDEX CONCURRENTLY users_idx;")},
+	}
+
+	m, err := New(nil, fsys)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if m.migrations[0].NoTransaction || !m.migrations[1].NoTransaction {
+		t.Errorf("got NoTransaction %t, %t; want false, true", m.migrations[0].NoTransaction, m.migrations[1].NoTransaction)
+	}
+
+	if got := m.required(); got != 1 {
+		t.Errorf("got required version %d; want 1", got)
+	}
+
+	if got := m.Latest(); got != 2 {
+		t.Errorf("got latest version %d; want 2", got)
+	}
+
+	// Only a failed index build is run again, from the version before it
+	if previous, ok := m.retryable(2); !ok || previous != 1 {
+		t.Errorf("got retryable(2) %d, %t; want 1, true", previous, ok)
+	}
+
+	if _, ok := m.retryable(1); ok {
+		t.Error("got a failed transactional migration as retryable")
+	}
+
+	err = m.Force(context.Background(), 3)
+	if !errors.Is(err, ErrUnknownVersion) {
+		t.Errorf("got %v forcing an unknown version; want ErrUnknownVersion", err)
+	}
+
+	// Both scripts of a migration have to agree
+	fsys["000002_add_users_index.down.sql"] = &fstest.MapFile{Data: []byte("DROP INDEX users_idx;")}
+
+	_, err = New(nil, fsys)
+	if err == nil {
+		t.Error("got no error for a marker on only the up script")
+	}
+}
+
+func TestEmbeddedMigrations(t *testing.T) {
+	m, err := New(nil, migrations.FS)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i, migration := range m.migrations {
+		if migration.Version != int64(i+1) {
+			t.Fatalf("got migration %d at position %d; want versions without gaps", migration.Version, i+1)
+		}
+	}
+
+	// Index builds come after every migration the application needs
+	if m.required() >= m.Latest() {
+		t.Errorf("got required version %d; want it before the index builds ending at %d", m.required(), m.Latest())
+	}
+}
+
+func TestConcurrentIndexName(t *testing.T) {
+	tests := []struct {
+		script string
+		want   string
+	}{
+		{"-- migrate:no-transaction\nCREATE INDEX CONCURRENTLY IF NOT EXISTS strategies_tags_idx ON strategies USING GIN (tags);", "strategies_tags_idx"},
+		{"-- migrate:no-transaction\nCREATE UNIQUE INDEX CONCURRENTLY users_idx ON users (id);", "users_idx"},
+		{"-- migrate:no-transaction\nDROP INDEX CONCURRENTLY IF EXISTS strategies_tags_idx;", ""},
+	}
+
+	for _, tt := range tests {
+		var got string
+		if matches := concurrentIndexRX.FindStringSubmatch(tt.script); matches != nil {
+			got = matches[1]
+		}
+
+		if got != tt.want {
+			t.Errorf("got index %q for %q; want %q", got, tt.script, tt.want)
+		}
+	}
+}
@@ -0,0 +1,72 @@
+package ratelimit
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// MemoryLimiter keeps buckets in process memory. It only works if the api runs on a single
+// machine; behind a load balancer each instance would allow the full rate, so use
+// PostgresLimiter there instead
+type MemoryLimiter struct {
+	mu      sync.Mutex
+	clients map[string]*client
+}
+
+type client struct {
+	limiter  *rate.Limiter
+	lastSeen time.Time
+}
+
+// NewMemoryLimiter() returns a limiter keeping every client until DeleteIdle() removes it
+func NewMemoryLimiter() *MemoryLimiter {
+	return &MemoryLimiter{clients: make(map[string]*client)}
+}
+
+// DeleteIdle() forgets clients that haven't been seen since before. A forgotten client starts
+// again with a full bucket, so before should be further back than it takes a bucket to refill
+func (l *MemoryLimiter) DeleteIdle(ctx context.Context, before time.Time) (int64, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	var deleted int64
+
+	for key, client := range l.clients {
+		if client.lastSeen.Before(before) {
+			delete(l.clients, key)
+			deleted++
+		}
+	}
+
+	return deleted, nil
+}
+
+func (l *MemoryLimiter) Allow(ctx context.Context, key string, r Rate) (Result, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+
+	c, found := l.clients[key]
+	if !found {
+		c = &client{limiter: rate.NewLimiter(rate.Limit(r.PerSecond), r.Burst)}
+		l.clients[key] = c
+	}
+
+	// Keep an existing bucket in step with the policy if it has been changed
+	if c.limiter.Limit() != rate.Limit(r.PerSecond) {
+		c.limiter.SetLimitAt(now, rate.Limit(r.PerSecond))
+	}
+	if c.limiter.Burst() != r.Burst {
+		c.limiter.SetBurstAt(now, r.Burst)
+	}
+
+	c.lastSeen = now
+
+	allowed := c.limiter.AllowN(now, 1)
+
+	return result(allowed, c.limiter.TokensAt(now), r, now), nil
+}
@@ -0,0 +1,194 @@
+package ratelimit
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+)
+
+// Route groups that policies are set for. Requests outside the named groups use GroupDefault.
+// GroupClient is the ceiling on every request from one IP, checked before the caller is known.
+// GroupBacktestSubmit limits the backtest.started events the Backtrader service sends for a user
+const (
+	GroupClient         = "client"
+	GroupLogin          = "login"
+	GroupRegister       = "register"
+	GroupBacktestSubmit = "backtest_submit"
+	GroupReads          = "reads"
+	GroupDefault        = "default"
+)
+
+// Groups lists every route group a policy file can configure
+var Groups = []string{GroupClient, GroupLogin, GroupRegister, GroupBacktestSubmit, GroupReads, GroupDefault}
+
+const (
+	// KeyUser gives each authenticated user their own bucket and falls back to the client IP for
+	// anonymous requests
+	KeyUser = "user"
+	// KeyIP always keys on the client IP, for routes like login where the caller isn't known yet
+	KeyIP = "ip"
+)
+
+// Policy is the limit for one route group
+type Policy struct {
+	PerSecond float64 `json:"rps"`
+	Burst     int     `json:"burst"`
+	Key       string  `json:"key"`
+}
+
+func (p Policy) Rate() Rate {
+	return Rate{PerSecond: p.PerSecond, Burst: p.Burst}
+}
+
+// Policies holds the limit of each route group, and per plan overrides of them. A plan only has
+// to list the groups it changes
+type Policies struct {
+	Groups map[string]Policy            `json:"groups"`
+	Plans  map[string]map[string]Policy `json:"plans"`
+}
+
+// DefaultPolicies() are used when no policy file is given. Reads and everything else share the
+// rate set on the command line, while logins, registrations and backtest submissions get their
+// own stricter buckets so heavy use of one can't starve the others. Each IP may send several
+// times the per-user rate, leaving room for users behind a shared address
+func DefaultPolicies(rps float64, burst int) *Policies {
+	return &Policies{
+		Groups: map[string]Policy{
+			GroupClient:         {PerSecond: 5 * rps, Burst: 5 * burst, Key: KeyIP},
+			GroupLogin:          {PerSecond: 5.0 / 60, Burst: 5, Key: KeyIP},
+			GroupRegister:       {PerSecond: 3.0 / 3600, Burst: 3, Key: KeyIP},
+			GroupBacktestSubmit: {PerSecond: 10.0 / 60, Burst: 5, Key: KeyUser},
+			GroupReads:          {PerSecond: rps, Burst: burst, Key: KeyUser},
+			GroupDefault:        {PerSecond: rps, Burst: burst, Key: KeyUser},
+		},
+		Plans: map[string]map[string]Policy{},
+	}
+}
+
+// LoadPolicies() reads a JSON policy file. Groups missing from the file keep their policy from
+// defaults, so a file can change only the limits it cares about
+func LoadPolicies(path string, defaults *Policies) (*Policies, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var file Policies
+
+	dec := json.NewDecoder(f)
+	dec.DisallowUnknownFields()
+
+	err = dec.Decode(&file)
+	if err != nil {
+		return nil, fmt.Errorf("rate limit policy file %s: %w", path, err)
+	}
+
+	policies := &Policies{Groups: map[string]Policy{}, Plans: map[string]map[string]Policy{}}
+
+	for group, policy := range defaults.Groups {
+		policies.Groups[group] = policy
+	}
+
+	for group, policy := range file.Groups {
+		policies.Groups[group] = policy
+	}
+
+	for plan, groups := range file.Plans {
+		policies.Plans[plan] = groups
+	}
+
+	err = policies.validate()
+	if err != nil {
+		return nil, fmt.Errorf("rate limit policy file %s: %w", path, err)
+	}
+
+	return policies, nil
+}
+
+func (p *Policies) validate() error {
+	check := func(where, group string, policy Policy) error {
+		known := false
+		for _, g := range Groups {
+			if g == group {
+				known = true
+			}
+		}
+
+		switch {
+		case !known:
+			return fmt.Errorf("%s: unknown route group %q", where, group)
+		case policy.PerSecond <= 0 || policy.Burst < 1:
+			return fmt.Errorf("%s: group %q must have a positive rps and a burst of at least 1", where, group)
+		case policy.Key != KeyUser && policy.Key != KeyIP:
+			return fmt.Errorf("%s: group %q key must be %q or %q", where, group, KeyUser, KeyIP)
+		case group == GroupClient && policy.Key != KeyIP:
+			return fmt.Errorf("%s: group %q must be keyed by %q", where, group, KeyIP)
+		case group == GroupBacktestSubmit && policy.Key != KeyUser:
+			return fmt.Errorf("%s: group %q must be keyed by %q", where, group, KeyUser)
+		}
+
+		return nil
+	}
+
+	for group, policy := range p.Groups {
+		if err := check("groups", group, policy); err != nil {
+			return err
+		}
+	}
+
+	for plan, groups := range p.Plans {
+		for group, policy := range groups {
+			if err := check("plans."+plan, group, policy); err != nil {
+				return err
+			}
+
+			// The plan isn't known until the caller has been authenticated
+			if group == GroupClient {
+				return fmt.Errorf("plans.%s: group %q can't be set per plan", plan, group)
+			}
+		}
+	}
+
+	return nil
+}
+
+// For() returns the policy for a route group under a plan, falling back to the group's own
+// policy and then to the default group's
+func (p *Policies) For(group, plan string) Policy {
+	if policy, ok := p.Plans[plan][group]; ok {
+		return policy
+	}
+
+	if policy, ok := p.Groups[group]; ok {
+		return policy
+	}
+
+	return p.Groups[GroupDefault]
+}
+
+// MaxRefill() is the longest any policy's bucket takes to refill from empty. A bucket left idle
+// for longer is full again, so stores can forget it without clients gaining anything
+func (p *Policies) MaxRefill() time.Duration {
+	var longest time.Duration
+
+	check := func(policy Policy) {
+		refill := time.Duration(float64(policy.Burst) / policy.PerSecond * float64(time.Second))
+		if refill > longest {
+			longest = refill
+		}
+	}
+
+	for _, policy := range p.Groups {
+		check(policy)
+	}
+
+	for _, groups := range p.Plans {
+		for _, policy := range groups {
+			check(policy)
+		}
+	}
+
+	return longest
+}
@@ -0,0 +1,89 @@
+package ratelimit
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+)
+
+// PostgresLimiter keeps buckets in the rate_limits table, so every api instance sharing the
+// database enforces one budget per client. Each decision is a single locked row update
+type PostgresLimiter struct {
+	DB *sql.DB
+}
+
+func NewPostgresLimiter(db *sql.DB) *PostgresLimiter {
+	return &PostgresLimiter{DB: db}
+}
+
+func (l *PostgresLimiter) Allow(ctx context.Context, key string, rate Rate) (Result, error) {
+	ctx, cancel := context.WithTimeout(ctx, time.Second)
+	defer cancel()
+
+	// The bucket is refilled for the time since it was last touched, capped at the burst, and a
+	// token is taken only if a whole one is available. The subquery locks the row so concurrent
+	// requests for the same key are applied one after another
+	query := `
+		UPDATE rate_limits
+		SET tokens = CASE WHEN bucket.refilled >= 1 THEN bucket.refilled - 1 ELSE bucket.refilled END,
+		updated_at = bucket.now
+		FROM (
+			SELECT key, clock_timestamp() AS now,
+			LEAST($3::double precision,
+				tokens + GREATEST(EXTRACT(EPOCH FROM clock_timestamp() - updated_at), 0) * $2::double precision
+			) AS refilled
+			FROM rate_limits
+			WHERE key = $1
+			FOR UPDATE
+		) AS bucket
+		WHERE rate_limits.key = bucket.key
+		RETURNING rate_limits.tokens, bucket.refilled >= 1
+	`
+
+	var tokens float64
+	var allowed bool
+
+	err := l.DB.QueryRowContext(ctx, query, key, rate.PerSecond, rate.Burst).Scan(&tokens, &allowed)
+	if errors.Is(err, sql.ErrNoRows) {
+		// First request from this client, so create a full bucket and take a token from it. If
+		// another instance got there first the insert does nothing and the update is retried
+		insert := `
+			INSERT INTO rate_limits (key, tokens, updated_at)
+			VALUES ($1, $2::double precision - 1, clock_timestamp())
+			ON CONFLICT (key) DO NOTHING
+		`
+
+		res, err := l.DB.ExecContext(ctx, insert, key, rate.Burst)
+		if err != nil {
+			return Result{}, err
+		}
+
+		if n, _ := res.RowsAffected(); n == 1 {
+			return result(rate.Burst > 0, float64(rate.Burst-1), rate, time.Now()), nil
+		}
+
+		err = l.DB.QueryRowContext(ctx, query, key, rate.PerSecond, rate.Burst).Scan(&tokens, &allowed)
+		if err != nil {
+			return Result{}, err
+		}
+	} else if err != nil {
+		return Result{}, err
+	}
+
+	return result(allowed, tokens, rate, time.Now()), nil
+}
+
+// DeleteIdle() removes buckets that haven't been used since before the given time. Those buckets
+// would be full by now anyway, so the clients don't gain anything from their removal
+func (l *PostgresLimiter) DeleteIdle(ctx context.Context, before time.Time) (int64, error) {
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	res, err := l.DB.ExecContext(ctx, `DELETE FROM rate_limits WHERE updated_at < $1`, before)
+	if err != nil {
+		return 0, err
+	}
+
+	return res.RowsAffected()
+}
@@ -0,0 +1,52 @@
+package ratelimit
+
+import (
+	"context"
+	"math"
+	"time"
+)
+
+// Rate is a token bucket policy. The bucket holds up to Burst tokens and refills at PerSecond
+// tokens a second; every allowed request takes one token
+type Rate struct {
+	PerSecond float64
+	Burst     int
+}
+
+// Result describes the bucket after a request, with enough detail for the X-RateLimit headers
+type Result struct {
+	Allowed   bool
+	Limit     int
+	Remaining int
+	// Reset is when the bucket will be full again
+	Reset time.Time
+	// RetryAfter is how long until the next request would be allowed, zero if it already would be
+	RetryAfter time.Duration
+}
+
+// Limiter decides whether the client identified by key may make another request under rate.
+// Implementations must be safe for concurrent use
+type Limiter interface {
+	Allow(ctx context.Context, key string, rate Rate) (Result, error)
+}
+
+// result() builds a Result from the number of tokens left in the bucket after the request
+func result(allowed bool, tokens float64, rate Rate, now time.Time) Result {
+	res := Result{
+		Allowed:   allowed,
+		Limit:     rate.Burst,
+		Remaining: int(math.Max(0, math.Floor(tokens))),
+		Reset:     now,
+	}
+
+	if rate.PerSecond > 0 {
+		missing := float64(rate.Burst) - tokens
+		res.Reset = now.Add(time.Duration(missing / rate.PerSecond * float64(time.Second)))
+
+		if tokens < 1 {
+			res.RetryAfter = time.Duration((1 - tokens) / rate.PerSecond * float64(time.Second))
+		}
+	}
+
+	return res
+}
@@ -0,0 +1,182 @@
+package tracing
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// StdoutExporter writes each span as a line of JSON, for development and for log pipelines that
+// collect spans from stdout
+type StdoutExporter struct {
+	mu  sync.Mutex
+	out io.Writer
+}
+
+func NewStdoutExporter(out io.Writer) *StdoutExporter {
+	return &StdoutExporter{out: out}
+}
+
+func (e *StdoutExporter) Export(spans []SpanData) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	enc := json.NewEncoder(e.out)
+
+	for _, span := range spans {
+		aux := struct {
+			Name         string                 `json:"name"`
+			TraceID      string                 `json:"trace_id"`
+			SpanID       string                 `json:"span_id"`
+			ParentSpanID string                 `json:"parent_span_id,omitempty"`
+			Kind         SpanKind               `json:"kind"`
+			Start        time.Time              `json:"start"`
+			DurationMS   float64                `json:"duration_ms"`
+			Attributes   map[string]interface{} `json:"attributes,omitempty"`
+			Error        string                 `json:"error,omitempty"`
+		}{
+			Name:       span.Name,
+			TraceID:    span.SpanContext.TraceID.String(),
+			SpanID:     span.SpanContext.SpanID.String(),
+			Kind:       span.Kind,
+			Start:      span.Start.UTC(),
+			DurationMS: float64(span.End.Sub(span.Start).Microseconds()) / 1000,
+			Attributes: span.Attributes,
+			Error:      span.Error,
+		}
+
+		if span.ParentSpanID != (SpanID{}) {
+			aux.ParentSpanID = span.ParentSpanID.String()
+		}
+
+		err := enc.Encode(aux)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// OTLPExporter posts spans to an OpenTelemetry collector using OTLP over HTTP with the JSON
+// encoding, usually at http://<collector>:4318/v1/traces
+type OTLPExporter struct {
+	endpoint string
+	service  string
+	client   *http.Client
+}
+
+func NewOTLPExporter(endpoint, service string) *OTLPExporter {
+	return &OTLPExporter{
+		endpoint: endpoint,
+		service:  service,
+		client:   &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+type otlpKeyValue struct {
+	Key   string                 `json:"key"`
+	Value map[string]interface{} `json:"value"`
+}
+
+type otlpSpan struct {
+	TraceID           string         `json:"traceId"`
+	SpanID            string         `json:"spanId"`
+	ParentSpanID      string         `json:"parentSpanId,omitempty"`
+	Name              string         `json:"name"`
+	Kind              SpanKind       `json:"kind"`
+	StartTimeUnixNano string         `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string         `json:"endTimeUnixNano"`
+	Attributes        []otlpKeyValue `json:"attributes,omitempty"`
+	Status            struct {
+		Code    int    `json:"code,omitempty"`
+		Message string `json:"message,omitempty"`
+	} `json:"status"`
+}
+
+func (e *OTLPExporter) Export(spans []SpanData) error {
+	otlpSpans := make([]otlpSpan, 0, len(spans))
+
+	for _, span := range spans {
+		s := otlpSpan{
+			TraceID:           span.SpanContext.TraceID.String(),
+			SpanID:            span.SpanContext.SpanID.String(),
+			Name:              span.Name,
+			Kind:              span.Kind,
+			StartTimeUnixNano: strconv.FormatInt(span.Start.UnixNano(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(span.End.UnixNano(), 10),
+		}
+
+		if span.ParentSpanID != (SpanID{}) {
+			s.ParentSpanID = span.ParentSpanID.String()
+		}
+
+		for key, value := range span.Attributes {
+			s.Attributes = append(s.Attributes, otlpKeyValue{Key: key, Value: otlpValue(value)})
+		}
+
+		// Status code 2 is STATUS_CODE_ERROR
+		if span.Error != "" {
+			s.Status.Code = 2
+			s.Status.Message = span.Error
+		}
+
+		otlpSpans = append(otlpSpans, s)
+	}
+
+	payload := map[string]interface{}{
+		"resourceSpans": []interface{}{
+			map[string]interface{}{
+				"resource": map[string]interface{}{
+					"attributes": []otlpKeyValue{{Key: "service.name", Value: otlpValue(e.service)}},
+				},
+				"scopeSpans": []interface{}{
+					map[string]interface{}{
+						"scope": map[string]interface{}{"name": "github.com/lyttonliao/StratCheck/internal/tracing"},
+						"spans": otlpSpans,
+					},
+				},
+			},
+		},
+	}
+
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	res, err := e.client.Post(e.endpoint, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return fmt.Errorf("otlp collector returned %s", res.Status)
+	}
+
+	return nil
+}
+
+// otlpValue() converts an attribute to an OTLP AnyValue. 64-bit integers are strings in OTLP JSON
+func otlpValue(value interface{}) map[string]interface{} {
+	switch v := value.(type) {
+	case string:
+		return map[string]interface{}{"stringValue": v}
+	case bool:
+		return map[string]interface{}{"boolValue": v}
+	case int:
+		return map[string]interface{}{"intValue": strconv.Itoa(v)}
+	case int64:
+		return map[string]interface{}{"intValue": strconv.FormatInt(v, 10)}
+	case float64:
+		return map[string]interface{}{"doubleValue": v}
+	default:
+		return map[string]interface{}{"stringValue": fmt.Sprint(v)}
+	}
+}
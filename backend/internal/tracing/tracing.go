@@ -0,0 +1,385 @@
+package tracing
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+type TraceID [16]byte
+
+type SpanID [8]byte
+
+func (t TraceID) String() string { return hex.EncodeToString(t[:]) }
+
+func (s SpanID) String() string { return hex.EncodeToString(s[:]) }
+
+// SpanContext identifies a span and is what travels between services in the traceparent header
+type SpanContext struct {
+	TraceID TraceID
+	SpanID  SpanID
+	Sampled bool
+	Remote  bool
+}
+
+func (sc SpanContext) IsValid() bool {
+	return sc.TraceID != TraceID{} && sc.SpanID != SpanID{}
+}
+
+// Traceparent() formats the span context as a W3C traceparent header value
+func (sc SpanContext) Traceparent() string {
+	flags := "00"
+	if sc.Sampled {
+		flags = "01"
+	}
+
+	return fmt.Sprintf("00-%s-%s-%s", sc.TraceID, sc.SpanID, flags)
+}
+
+// ParseTraceparent() parses a W3C traceparent header value. Only version 00 is understood, as the
+// spec requires
+func ParseTraceparent(s string) (SpanContext, bool) {
+	var sc SpanContext
+
+	parts := strings.Split(strings.TrimSpace(s), "-")
+	if len(parts) != 4 || parts[0] != "00" || len(parts[1]) != 32 || len(parts[2]) != 16 || len(parts[3]) != 2 {
+		return sc, false
+	}
+
+	if _, err := hex.Decode(sc.TraceID[:], []byte(parts[1])); err != nil {
+		return sc, false
+	}
+	if _, err := hex.Decode(sc.SpanID[:], []byte(parts[2])); err != nil {
+		return sc, false
+	}
+
+	flags, err := hex.DecodeString(parts[3])
+	if err != nil {
+		return sc, false
+	}
+
+	sc.Sampled = flags[0]&1 == 1
+	sc.Remote = true
+
+	return sc, sc.IsValid()
+}
+
+type SpanKind int
+
+// The values match the OTLP SpanKind enum
+const (
+	KindInternal SpanKind = 1
+	KindServer   SpanKind = 2
+	KindClient   SpanKind = 3
+)
+
+// SpanData is a finished span as handed to an Exporter
+type SpanData struct {
+	Name         string
+	Kind         SpanKind
+	SpanContext  SpanContext
+	ParentSpanID SpanID
+	Start        time.Time
+	End          time.Time
+	Attributes   map[string]interface{}
+	Error        string
+}
+
+// Span is a timed operation within a trace. A nil *Span is valid and records nothing, so callers
+// never have to check whether tracing is enabled
+type Span struct {
+	tracer *Tracer
+	mu     sync.Mutex
+	data   SpanData
+	ended  bool
+}
+
+func (s *Span) SpanContext() SpanContext {
+	if s == nil {
+		return SpanContext{}
+	}
+
+	return s.data.SpanContext
+}
+
+func (s *Span) SetAttribute(key string, value interface{}) {
+	if s == nil {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.data.Attributes[key] = value
+}
+
+// SetError() marks the span as failed. A nil error is ignored
+func (s *Span) SetError(err error) {
+	if s == nil || err == nil {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.data.Error = err.Error()
+}
+
+// End() records the span's end time and queues it for export. Calls after the first are ignored
+func (s *Span) End() {
+	if s == nil {
+		return
+	}
+
+	s.mu.Lock()
+	if s.ended {
+		s.mu.Unlock()
+		return
+	}
+	s.ended = true
+	s.data.End = time.Now()
+	data := s.data
+	s.mu.Unlock()
+
+	if data.SpanContext.Sampled {
+		s.tracer.enqueue(data)
+	}
+}
+
+type contextKey string
+
+const spanContextKey = contextKey("span")
+
+const remoteContextKey = contextKey("remote_span_context")
+
+// ContextWithSpan() returns a copy of ctx carrying span as the parent of spans started from it
+func ContextWithSpan(ctx context.Context, span *Span) context.Context {
+	return context.WithValue(ctx, spanContextKey, span)
+}
+
+func SpanFromContext(ctx context.Context) *Span {
+	span, _ := ctx.Value(spanContextKey).(*Span)
+	return span
+}
+
+// Extract() reads the traceparent header sent by a caller, so the next span started from the
+// returned context continues the caller's trace
+func Extract(ctx context.Context, header http.Header) context.Context {
+	sc, ok := ParseTraceparent(header.Get("traceparent"))
+	if !ok {
+		return ctx
+	}
+
+	return context.WithValue(ctx, remoteContextKey, sc)
+}
+
+// Inject() sets the traceparent header for the span in ctx, so a downstream service can continue
+// the trace
+func Inject(ctx context.Context, header http.Header) {
+	sc := SpanFromContext(ctx).SpanContext()
+	if !sc.IsValid() {
+		return
+	}
+
+	header.Set("traceparent", sc.Traceparent())
+}
+
+// Exporter sends finished spans somewhere they can be viewed
+type Exporter interface {
+	Export(spans []SpanData) error
+}
+
+// Tracer starts spans and exports them in batches from a background goroutine
+type Tracer struct {
+	exporter    Exporter
+	sampleRatio float64
+	onError     func(error)
+
+	mu     sync.RWMutex
+	closed bool
+	queue  chan SpanData
+	done   chan struct{}
+}
+
+// New() returns a tracer that samples the given fraction of new traces. Traces started by a
+// caller keep the caller's sampling decision. Export errors are passed to onError
+func New(exporter Exporter, sampleRatio float64, onError func(error)) *Tracer {
+	t := &Tracer{
+		exporter:    exporter,
+		sampleRatio: sampleRatio,
+		onError:     onError,
+		queue:       make(chan SpanData, 2048),
+		done:        make(chan struct{}),
+	}
+
+	go t.run()
+
+	return t
+}
+
+var (
+	globalMu sync.RWMutex
+	global   *Tracer
+)
+
+// SetTracer() installs the tracer used by Start(). Until one is set Start() returns nil spans
+func SetTracer(t *Tracer) {
+	globalMu.Lock()
+	defer globalMu.Unlock()
+
+	global = t
+}
+
+// Start() begins a span as a child of the span in ctx, or of a remote parent found by Extract()
+func Start(ctx context.Context, name string, kind SpanKind) (context.Context, *Span) {
+	globalMu.RLock()
+	t := global
+	globalMu.RUnlock()
+
+	if t == nil {
+		return ctx, nil
+	}
+
+	return t.Start(ctx, name, kind)
+}
+
+func (t *Tracer) Start(ctx context.Context, name string, kind SpanKind) (context.Context, *Span) {
+	var parent SpanContext
+
+	if span := SpanFromContext(ctx); span != nil {
+		parent = span.SpanContext()
+	} else if sc, ok := ctx.Value(remoteContextKey).(SpanContext); ok {
+		parent = sc
+	}
+
+	sc := SpanContext{SpanID: newSpanID()}
+
+	if parent.IsValid() {
+		sc.TraceID = parent.TraceID
+		sc.Sampled = parent.Sampled
+	} else {
+		sc.TraceID = newTraceID()
+		sc.Sampled = t.sample(sc.TraceID)
+	}
+
+	span := &Span{
+		tracer: t,
+		data: SpanData{
+			Name:         name,
+			Kind:         kind,
+			SpanContext:  sc,
+			ParentSpanID: parent.SpanID,
+			Start:        time.Now(),
+			Attributes:   make(map[string]interface{}),
+		},
+	}
+
+	return ContextWithSpan(ctx, span), span
+}
+
+// sample() bases the decision on the trace ID, so it's the same wherever it's made
+func (t *Tracer) sample(id TraceID) bool {
+	switch {
+	case t.sampleRatio >= 1:
+		return true
+	case t.sampleRatio <= 0:
+		return false
+	default:
+		return float64(binary.BigEndian.Uint64(id[8:])>>1) < t.sampleRatio*(1<<63)
+	}
+}
+
+func (t *Tracer) enqueue(data SpanData) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	if t.closed {
+		return
+	}
+
+	select {
+	case t.queue <- data:
+	default:
+		// The exporter can't keep up, so drop the span rather than block the request
+	}
+}
+
+func (t *Tracer) run() {
+	defer close(t.done)
+
+	ticker := time.NewTicker(5 * time.Second)
+	defer ticker.Stop()
+
+	batch := make([]SpanData, 0, 512)
+
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+
+		err := t.exporter.Export(batch)
+		if err != nil && t.onError != nil {
+			t.onError(err)
+		}
+
+		batch = make([]SpanData, 0, 512)
+	}
+
+	for {
+		select {
+		case data, ok := <-t.queue:
+			if !ok {
+				flush()
+				return
+			}
+
+			batch = append(batch, data)
+			if len(batch) == cap(batch) {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		}
+	}
+}
+
+// Shutdown() exports the spans still queued. Spans ended afterwards are dropped
+func (t *Tracer) Shutdown(ctx context.Context) error {
+	globalMu.Lock()
+	if global == t {
+		global = nil
+	}
+	globalMu.Unlock()
+
+	t.mu.Lock()
+	if !t.closed {
+		t.closed = true
+		close(t.queue)
+	}
+	t.mu.Unlock()
+
+	select {
+	case <-t.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func newTraceID() TraceID {
+	var id TraceID
+	rand.Read(id[:])
+	return id
+}
+
+func newSpanID() SpanID {
+	var id SpanID
+	rand.Read(id[:])
+	return id
+}
@@ -0,0 +1,172 @@
+package validator
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha1"
+	"embed"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"unicode"
+)
+
+// The bundled list holds the most commonly used passwords, one per line. It is embedded
+// so the policy works without any files being deployed alongside the binary
+
+//go:embed "passwords"
+var passwordFS embed.FS
+
+var commonPasswords = loadCommonPasswords()
+
+func loadCommonPasswords() map[string]bool {
+	list, err := passwordFS.ReadFile("passwords/common.txt")
+	if err != nil {
+		panic(err)
+	}
+
+	passwords := make(map[string]bool)
+
+	scanner := bufio.NewScanner(bytes.NewReader(list))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line != "" {
+			passwords[strings.ToLower(line)] = true
+		}
+	}
+
+	return passwords
+}
+
+// PasswordPolicy describes the rules a new password must satisfy. The zero value only
+// enforces the common password and personal information checks
+type PasswordPolicy struct {
+	MinLength     int
+	RequireUpper  bool
+	RequireLower  bool
+	RequireDigit  bool
+	RequireSymbol bool
+	// BreachedDir is a directory of k-anonymity range files, each named after the first 5 hex
+	// characters of a SHA-1 hash and holding "SUFFIX:COUNT" lines for the remaining 35
+	// characters, the same format served by the Pwned Passwords range API. Leave empty to
+	// skip the breached password check
+	BreachedDir string
+}
+
+// Check() adds an error to the "password" key for the first rule the password breaks.
+// The personal values (usually the user's name and email) must not appear in the password.
+// An error is only returned if the breached password files could not be read
+func (p PasswordPolicy) Check(v *Validator, password string, personal ...string) error {
+	const key = "password"
+
+	v.Check(len(password) >= p.MinLength, key, fmt.Sprintf("must be at least %d characters long", p.MinLength))
+	v.Check(!IsCommonPassword(password), key, "must not be a commonly used password")
+
+	var upper, lower, digit, symbol bool
+	for _, r := range password {
+		switch {
+		case unicode.IsUpper(r):
+			upper = true
+		case unicode.IsLower(r):
+			lower = true
+		case unicode.IsDigit(r):
+			digit = true
+		case unicode.IsPunct(r) || unicode.IsSymbol(r) || unicode.IsSpace(r):
+			symbol = true
+		}
+	}
+
+	v.Check(upper || !p.RequireUpper, key, "must contain at least one uppercase letter")
+	v.Check(lower || !p.RequireLower, key, "must contain at least one lowercase letter")
+	v.Check(digit || !p.RequireDigit, key, "must contain at least one digit")
+	v.Check(symbol || !p.RequireSymbol, key, "must contain at least one symbol")
+	v.Check(!ContainsPersonalInfo(password, personal...), key, "must not contain your name or email address")
+
+	// Skip the file lookup when the password has already been rejected
+	if _, rejected := v.Errors[key]; rejected || p.BreachedDir == "" {
+		return nil
+	}
+
+	breached, err := p.isBreached(password)
+	if err != nil {
+		return err
+	}
+
+	v.Check(!breached, key, "has appeared in a data breach, please choose a different password")
+
+	return nil
+}
+
+// isBreached() only reads the range file for the hash prefix, so the full hash of the
+// password is never compared against anything other than the suffixes sharing its prefix
+func (p PasswordPolicy) isBreached(password string) (bool, error) {
+	sum := sha1.Sum([]byte(password))
+	hash := strings.ToUpper(hex.EncodeToString(sum[:]))
+	prefix, suffix := hash[:5], hash[5:]
+
+	var file []byte
+	var err error
+
+	for _, name := range []string{prefix, prefix + ".txt"} {
+		file, err = os.ReadFile(filepath.Join(p.BreachedDir, name))
+		if err == nil || !errors.Is(err, fs.ErrNotExist) {
+			break
+		}
+	}
+
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return false, nil
+		}
+		return false, err
+	}
+
+	scanner := bufio.NewScanner(bytes.NewReader(file))
+	for scanner.Scan() {
+		candidate, _, _ := strings.Cut(strings.TrimSpace(scanner.Text()), ":")
+		if strings.EqualFold(candidate, suffix) {
+			return true, nil
+		}
+	}
+
+	return false, scanner.Err()
+}
+
+// IsCommonPassword() returns true if the password is on the bundled common password list,
+// ignoring case
+func IsCommonPassword(password string) bool {
+	return commonPasswords[strings.ToLower(password)]
+}
+
+// ContainsPersonalInfo() returns true if the password contains any of the given values, or
+// any word of at least 3 characters in them. Email addresses are also checked by their local part
+func ContainsPersonalInfo(password string, personal ...string) bool {
+	password = strings.ToLower(password)
+
+	for _, value := range personal {
+		value = strings.ToLower(strings.TrimSpace(value))
+
+		parts := []string{value}
+
+		if local, _, found := strings.Cut(value, "@"); found {
+			parts = append(parts, local)
+			value = local
+		}
+
+		parts = append(parts, strings.FieldsFunc(value, func(r rune) bool {
+			return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+		})...)
+
+		for _, part := range parts {
+			if len(part) >= 3 && strings.Contains(password, part) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
@@ -0,0 +1 @@
+ALTER TABLE email_outbox ADD COLUMN IF NOT EXISTS locale text NOT NULL DEFAULT '';
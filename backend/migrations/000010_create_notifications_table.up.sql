@@ -0,0 +1,11 @@
+CREATE TABLE IF NOT EXISTS notifications (
+    id bigserial PRIMARY KEY,
+    created_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+    user_id bigint NOT NULL REFERENCES users ON DELETE CASCADE,
+    type text NOT NULL,
+    data jsonb NOT NULL DEFAULT '{}',
+    digest_pending bool NOT NULL DEFAULT false
+);
+
+CREATE INDEX IF NOT EXISTS notifications_user_id_idx ON notifications (user_id);
+CREATE INDEX IF NOT EXISTS notifications_digest_pending_idx ON notifications (user_id) WHERE digest_pending = true;
@@ -0,0 +1,13 @@
+CREATE TABLE IF NOT EXISTS plans (
+    code text PRIMARY KEY,
+    name text NOT NULL,
+    created_at timestamp(0) with time zone NOT NULL DEFAULT NOW()
+);
+
+INSERT INTO plans (code, name)
+VALUES
+    ('free', 'Free'),
+    ('pro', 'Pro')
+ON CONFLICT (code) DO NOTHING;
+
+ALTER TABLE users ADD COLUMN IF NOT EXISTS plan text NOT NULL DEFAULT 'free' REFERENCES plans (code);
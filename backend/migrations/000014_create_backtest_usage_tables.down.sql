@@ -0,0 +1,5 @@
+DROP TABLE IF EXISTS usage_ledger;
+DROP TABLE IF EXISTS backtest_runs;
+ALTER TABLE plans DROP COLUMN IF EXISTS monthly_bars;
+ALTER TABLE plans DROP COLUMN IF EXISTS monthly_compute_seconds;
+ALTER TABLE plans DROP COLUMN IF EXISTS max_concurrent_runs;
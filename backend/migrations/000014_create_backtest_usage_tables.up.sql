@@ -0,0 +1,28 @@
+ALTER TABLE plans ADD COLUMN IF NOT EXISTS max_concurrent_runs integer NOT NULL DEFAULT 1;
+ALTER TABLE plans ADD COLUMN IF NOT EXISTS monthly_compute_seconds bigint NOT NULL DEFAULT 0;
+ALTER TABLE plans ADD COLUMN IF NOT EXISTS monthly_bars bigint NOT NULL DEFAULT 0;
+
+UPDATE plans SET max_concurrent_runs = 1, monthly_compute_seconds = 3600, monthly_bars = 10000000 WHERE code = 'free';
+UPDATE plans SET max_concurrent_runs = 5, monthly_compute_seconds = 72000, monthly_bars = 500000000 WHERE code = 'pro';
+
+CREATE TABLE IF NOT EXISTS backtest_runs (
+    id bigserial PRIMARY KEY,
+    user_id bigint NOT NULL REFERENCES users ON DELETE CASCADE,
+    status text NOT NULL DEFAULT 'running',
+    started_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+    finished_at timestamp(0) with time zone,
+    compute_seconds double precision NOT NULL DEFAULT 0,
+    bars_processed bigint NOT NULL DEFAULT 0
+);
+
+CREATE INDEX IF NOT EXISTS backtest_runs_running_idx ON backtest_runs (user_id) WHERE status = 'running';
+
+CREATE TABLE IF NOT EXISTS usage_ledger (
+    user_id bigint NOT NULL REFERENCES users ON DELETE CASCADE,
+    period date NOT NULL,
+    runs bigint NOT NULL DEFAULT 0,
+    compute_seconds double precision NOT NULL DEFAULT 0,
+    bars_processed bigint NOT NULL DEFAULT 0,
+    updated_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+    PRIMARY KEY (user_id, period)
+);
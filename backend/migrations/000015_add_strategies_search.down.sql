@@ -0,0 +1,2 @@
+ALTER TABLE strategies DROP COLUMN IF EXISTS tags;
+ALTER TABLE strategies DROP COLUMN IF EXISTS description;
@@ -0,0 +1,5 @@
+-- The strategies table belongs to the Backtrader service, so this only adds the columns the API
+-- manages. Adding a column with a constant default doesn't rewrite the table, and its indexes are
+-- built concurrently by their own migrations
+ALTER TABLE strategies ADD COLUMN IF NOT EXISTS description text NOT NULL DEFAULT '';
+ALTER TABLE strategies ADD COLUMN IF NOT EXISTS tags text[] NOT NULL DEFAULT '{}';
@@ -0,0 +1,2 @@
+ALTER TABLE strategies DROP COLUMN IF EXISTS folder_id;
+DROP TABLE IF EXISTS strategy_folders;
@@ -0,0 +1,15 @@
+CREATE TABLE IF NOT EXISTS strategy_folders (
+    id bigserial PRIMARY KEY,
+    created_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+    user_id bigint NOT NULL REFERENCES users ON DELETE CASCADE,
+    parent_id bigint REFERENCES strategy_folders ON DELETE CASCADE,
+    name text NOT NULL,
+    version integer NOT NULL DEFAULT 1
+);
+
+-- Folder names are unique among their siblings, top-level folders having no parent
+CREATE UNIQUE INDEX IF NOT EXISTS strategy_folders_name_key ON strategy_folders (user_id, COALESCE(parent_id, 0), name);
+CREATE INDEX IF NOT EXISTS strategy_folders_parent_id_idx ON strategy_folders (parent_id);
+
+-- Deleting a folder moves its strategies back to the top level
+ALTER TABLE strategies ADD COLUMN IF NOT EXISTS folder_id bigint REFERENCES strategy_folders ON DELETE SET NULL;
@@ -0,0 +1,7 @@
+DELETE FROM webhook_deliveries WHERE webhook_id IS NULL;
+
+DROP INDEX IF EXISTS webhook_deliveries_user_id_idx;
+
+ALTER TABLE webhook_deliveries DROP COLUMN IF EXISTS url;
+ALTER TABLE webhook_deliveries DROP COLUMN IF EXISTS user_id;
+ALTER TABLE webhook_deliveries ALTER COLUMN webhook_id SET NOT NULL;
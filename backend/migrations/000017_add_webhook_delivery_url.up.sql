@@ -0,0 +1,5 @@
+ALTER TABLE webhook_deliveries ALTER COLUMN webhook_id DROP NOT NULL;
+ALTER TABLE webhook_deliveries ADD COLUMN IF NOT EXISTS user_id bigint REFERENCES users ON DELETE CASCADE;
+ALTER TABLE webhook_deliveries ADD COLUMN IF NOT EXISTS url text NOT NULL DEFAULT '';
+
+CREATE INDEX IF NOT EXISTS webhook_deliveries_user_id_idx ON webhook_deliveries (user_id);
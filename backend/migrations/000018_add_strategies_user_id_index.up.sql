@@ -0,0 +1,2 @@
+-- migrate:no-transaction
+CREATE INDEX CONCURRENTLY IF NOT EXISTS strategies_user_id_idx ON strategies (user_id);
@@ -0,0 +1,4 @@
+-- migrate:no-transaction
+-- Name matches are weighted above description matches when ranking. The expression has to match
+-- strategySearchVector in internal/data/strategies.go for searches to use the index
+CREATE INDEX CONCURRENTLY IF NOT EXISTS strategies_search_idx ON strategies USING GIN ((setweight(to_tsvector('simple', name), 'A') || setweight(to_tsvector('simple', description), 'B')));
@@ -0,0 +1,2 @@
+-- migrate:no-transaction
+CREATE INDEX CONCURRENTLY IF NOT EXISTS strategies_fields_idx ON strategies USING GIN (fields);
@@ -0,0 +1,2 @@
+-- migrate:no-transaction
+CREATE INDEX CONCURRENTLY IF NOT EXISTS strategies_criteria_idx ON strategies USING GIN (criteria);
@@ -0,0 +1,9 @@
+// Package migrations embeds the SQL migration files so the api binary can apply them itself
+package migrations
+
+import "embed"
+
+// FS holds every migration, named like 000001_create_users_table.up.sql
+
+//go:embed "*.sql"
+var FS embed.FS